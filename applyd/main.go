@@ -2,28 +2,48 @@ package main
 
 import (
     "flag"
+    "fmt"
     "github.com/fathomdb/applyd"
     "log"
     "math/rand"
+    "net"
     "os"
+    "strconv"
+    "strings"
     "time"
 )
 
+const basedir = "/etc/apply.d"
+const configFile = "/etc/applyd.conf"
+
 func main() {
     rand.Seed(time.Now().UTC().UnixNano())
 
     flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+    conf := flags.String("conf", configFile, "Host configuration file")
 
     err := flags.Parse(os.Args[1:])
     if err != nil {
         log.Panicf("Error parsing flags %v", err)
     }
 
+    command := "apply"
+    args := flags.Args()
+    if len(args) > 0 {
+        command = args[0]
+        args = args[1:]
+    }
+
     runtime, err := applyd.NewRuntime()
     if err != nil {
         log.Panicf("Error initializing %v", err)
     }
 
+    runtime.Config, err = applyd.ReadConfig(*conf)
+    if err != nil {
+        log.Panicf("Error reading configuration %v", err)
+    }
+
     //	packages, err := runtime.Packages.List()
     //	if err != nil {
     //		log.Panicf("Error listing packages %v", err)
@@ -38,39 +58,312 @@ func main() {
     //		log.Panicf("Error installing package %v", err)
     //	}
 
-    //	err = runtime.Firewall.Save("/tmp/state")
-    //	if err != nil {
-    //		log.Panicf("Error saving firewall state %v", err)
-    //	}
+    switch command {
+    case "apply":
+        runApply(runtime, args)
+    case "plan":
+        runPlan(runtime, args)
+    case "check":
+        runCheck(runtime, args)
+    case "validate":
+        runValidate(runtime, args)
+    case "save":
+        runSave(runtime, args)
+    case "snapshot":
+        runSnapshot(runtime, args)
+    case "confirm":
+        runConfirm(runtime, args)
+    case "explain":
+        runExplain(runtime, args)
+    case "firewall":
+        runFirewall(runtime, args)
+    default:
+        log.Fatalf("Unknown command: %s", command)
+    }
+}
 
-    err = runtime.Firewall.Apply("/etc/apply.d")
+func parseFlags(flags *flag.FlagSet, args []string) {
+    err := flags.Parse(args)
     if err != nil {
-        log.Panicf("Error applying state %v", err)
+        log.Panicf("Error parsing flags %v", err)
     }
+}
 
-    err = runtime.IpNeighbors.Apply("/etc/apply.d/ip6neigh")
+func runApply(runtime *applyd.Runtime, args []string) {
+    flags := flag.NewFlagSet("apply", flag.ExitOnError)
+    verify := flags.Bool("verify", false, "Plan again after applying, and report anything that did not converge")
+    confirmTimeout := flags.Duration("confirm-timeout", 0, "Revert the firewall unless 'applyd confirm' is run within this time")
+    parseFlags(flags, args)
+
+    var err error
+    if *confirmTimeout != 0 {
+        err = runtime.ApplyConfirmed(basedir, *confirmTimeout)
+    } else {
+        err = runtime.Apply(basedir)
+    }
+    if !runtime.Report.IsEmpty() {
+        fmt.Print(runtime.Report.Describe())
+    }
     if err != nil {
         log.Panicf("Error applying state %v", err)
     }
 
-    err = runtime.Tunnels.Apply("/etc/apply.d/tunnel")
+    if *verify {
+        remaining, err := runtime.Verify(basedir)
+        if err != nil {
+            log.Panicf("Error verifying state %v", err)
+        }
+
+        if !remaining.IsEmpty() {
+            fmt.Println("Non-convergent items:")
+            fmt.Print(remaining.Describe())
+            os.Exit(1)
+        }
+    }
+}
+
+func runPlan(runtime *applyd.Runtime, args []string) {
+    flags := flag.NewFlagSet("plan", flag.ExitOnError)
+    config := flags.String("config", basedir, "Configuration directory")
+    state := flags.String("state", "", "Snapshot to use as the current state, instead of the live host")
+    parseFlags(flags, args)
+
+    if *state != "" {
+        snapshot, err := applyd.ReadSnapshot(*state)
+        if err != nil {
+            log.Panicf("Error reading snapshot %v", err)
+        }
+        runtime.UseSnapshot(snapshot)
+    }
+
+    plan, err := runtime.Plan(*config)
+    if err != nil {
+        log.Panicf("Error building plan %v", err)
+    }
+
+    fmt.Print(plan.Describe())
+}
+
+func runCheck(runtime *applyd.Runtime, args []string) {
+    flags := flag.NewFlagSet("check", flag.ExitOnError)
+    parseFlags(flags, args)
+
+    result := runtime.Check(basedir)
+    fmt.Print(result.Output())
+    os.Exit(result.Status)
+}
+
+func runValidate(runtime *applyd.Runtime, args []string) {
+    flags := flag.NewFlagSet("validate", flag.ExitOnError)
+    parseFlags(flags, args)
+
+    dir := basedir
+    if flags.NArg() > 0 {
+        dir = flags.Arg(0)
+    }
+
+    diagnostics, err := runtime.Validate(dir)
     if err != nil {
-        log.Panicf("Error applying tunnels %v", err)
+        log.Panicf("Error validating %v", err)
+    }
+
+    for _, d := range diagnostics {
+        fmt.Println(d)
     }
 
-    err = runtime.Vips.Apply("/etc/apply.d/vips")
+    if applyd.HasErrors(diagnostics) {
+        os.Exit(1)
+    }
+}
+
+func runSave(runtime *applyd.Runtime, args []string) {
+    flags := flag.NewFlagSet("save", flag.ExitOnError)
+    state := flags.String("state", "", "Snapshot to save from, instead of the live host")
+    split := flags.Bool("split", false, "Write a file per iptables table and chain")
+    parseFlags(flags, args)
+
+    if *split {
+        runtime.Config.IptablesSaveLayout = applyd.IptablesLayoutSplit
+    }
+
+    dir := basedir
+    if flags.NArg() > 0 {
+        dir = flags.Arg(0)
+    }
+
+    if *state != "" {
+        snapshot, err := applyd.ReadSnapshot(*state)
+        if err != nil {
+            log.Panicf("Error reading snapshot %v", err)
+        }
+        runtime.UseSnapshot(snapshot)
+    }
+
+    err := runtime.Save(dir)
     if err != nil {
-        log.Panicf("Error applying vips %v", err)
+        log.Panicf("Error saving state %v", err)
     }
+}
 
-    err = runtime.Routes4.Apply("/etc/apply.d/route4")
+func runSnapshot(runtime *applyd.Runtime, args []string) {
+    flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+    output := flags.String("output", "snapshot.json", "File to write the snapshot to")
+    parseFlags(flags, args)
+
+    snapshot, err := runtime.CaptureSnapshot()
     if err != nil {
-        log.Panicf("Error applying ipv4 routes %v", err)
+        log.Panicf("Error capturing snapshot %v", err)
     }
 
-    err = runtime.Routes6.Apply("/etc/apply.d/route6")
+    err = snapshot.Write(*output)
     if err != nil {
-        log.Panicf("Error applying ipv6 routes %v", err)
+        log.Panicf("Error writing snapshot %v", err)
     }
+}
+
+func runConfirm(runtime *applyd.Runtime, args []string) {
+    flags := flag.NewFlagSet("confirm", flag.ExitOnError)
+    socket := flags.String("socket", applyd.ControlSocket, "Control socket of the waiting apply")
+    parseFlags(flags, args)
 
+    err := applyd.Confirm(*socket)
+    if err != nil {
+        log.Fatalf("Error confirming %v", err)
+    }
+
+    fmt.Println("Confirmed")
+}
+
+func runExplain(runtime *applyd.Runtime, args []string) {
+    flags := flag.NewFlagSet("explain", flag.ExitOnError)
+    parseFlags(flags, args)
+
+    if flags.NArg() != 4 || (flags.Arg(0) != "iptables" && flags.Arg(0) != "ip6tables") {
+        log.Fatalf("Usage: explain iptables|ip6tables <table> <chain> <rule number>")
+    }
+
+    n, err := strconv.Atoi(flags.Arg(3))
+    if err != nil {
+        log.Fatalf("Invalid rule number: %s", flags.Arg(3))
+    }
+
+    explanation, err := runtime.ExplainIptables(basedir, flags.Arg(0) == "ip6tables", flags.Arg(1), flags.Arg(2), n)
+    if err != nil {
+        log.Panicf("Error explaining rule %v", err)
+    }
+
+    fmt.Print(explanation)
+}
+
+func runFirewall(runtime *applyd.Runtime, args []string) {
+    if len(args) == 0 {
+        log.Fatalf("Usage: firewall stats|trace|lint")
+    }
+
+    switch args[0] {
+    case "stats":
+        runFirewallStats(runtime, args[1:])
+    case "trace":
+        runFirewallTrace(runtime, args[1:])
+    case "lint":
+        runFirewallLint(runtime, args[1:])
+    default:
+        log.Fatalf("Unknown firewall command: %s", args[0])
+    }
+}
+
+func runFirewallStats(runtime *applyd.Runtime, args []string) {
+    flags := flag.NewFlagSet("firewall stats", flag.ExitOnError)
+    config := flags.String("config", basedir, "Configuration directory")
+    unusedAfter := flags.Duration("unused-after", runtime.Config.FirewallUnusedAfter, "Report rules with no hits for this long as unused")
+    listen := flags.String("listen", "", "Run as a daemon, serving counter metrics on this address")
+    interval := flags.Duration("interval", time.Minute, "How often the daemon polls the counters")
+    parseFlags(flags, args)
+
+    runtime.Config.FirewallUnusedAfter = *unusedAfter
+
+    if *listen != "" {
+        err := runtime.ServeFirewallMetrics(*config, *listen, *interval)
+        if err != nil {
+            log.Panicf("Error serving metrics %v", err)
+        }
+        return
+    }
+
+    stats, err := runtime.FirewallStats(*config)
+    if err != nil {
+        log.Panicf("Error reading firewall stats %v", err)
+    }
+
+    fmt.Print(stats.Describe())
+}
+
+func runFirewallTrace(runtime *applyd.Runtime, args []string) {
+    flags := flag.NewFlagSet("firewall trace", flag.ExitOnError)
+    config := flags.String("config", basedir, "Configuration directory")
+    protocol := flags.String("proto", "tcp", "Protocol")
+    source := flags.String("src", "", "Source address")
+    destination := flags.String("dst", "", "Destination address")
+    sourcePort := flags.Int("sport", 49152, "Source port")
+    destinationPort := flags.Int("dport", 0, "Destination port")
+    in := flags.String("in", "", "Input interface; without --out, the packet is for this host")
+    out := flags.String("out", "", "Output interface; without --in, the packet is from this host")
+    state := flags.String("state", "NEW", "Connection tracking state")
+    tcpFlags := flags.String("flags", "", "TCP flags, e.g. SYN or ACK,PSH (default SYN for a new connection)")
+    icmpType := flags.String("icmp-type", "", "ICMP type (and code) as numbers, e.g. 8 or 3/1")
+    parseFlags(flags, args)
+
+    packet := &applyd.TracePacket{}
+    packet.Protocol = *protocol
+    packet.SourcePort = *sourcePort
+    packet.DestinationPort = *destinationPort
+    packet.InInterface = *in
+    packet.OutInterface = *out
+    packet.State = *state
+    packet.IcmpType = *icmpType
+
+    if *source != "" {
+        packet.Source = net.ParseIP(*source)
+        if packet.Source == nil {
+            log.Fatalf("Invalid source address: %s", *source)
+        }
+    }
+    if *destination != "" {
+        packet.Destination = net.ParseIP(*destination)
+        if packet.Destination == nil {
+            log.Fatalf("Invalid destination address: %s", *destination)
+        }
+    }
+    if packet.Source == nil && packet.Destination == nil {
+        log.Fatalf("Usage: firewall trace --src <address> --dst <address> [--dport <port>] [--in <interface>] [--out <interface>]")
+    }
+    if *tcpFlags != "" {
+        packet.TcpFlags = strings.Split(strings.ToUpper(*tcpFlags), ",")
+    }
+
+    trace, err := runtime.TraceFirewall(*config, packet)
+    if err != nil {
+        log.Panicf("Error tracing packet %v", err)
+    }
+
+    fmt.Print(trace.Describe())
+}
+
+func runFirewallLint(runtime *applyd.Runtime, args []string) {
+    flags := flag.NewFlagSet("firewall lint", flag.ExitOnError)
+    config := flags.String("config", basedir, "Configuration directory")
+    parseFlags(flags, args)
+
+    diagnostics, err := runtime.LintFirewall(*config)
+    if err != nil {
+        log.Panicf("Error linting firewall %v", err)
+    }
+
+    for _, d := range diagnostics {
+        fmt.Println(d)
+    }
+
+    if applyd.HasErrors(diagnostics) {
+        os.Exit(1)
+    }
 }
@@ -22,9 +22,9 @@ func NewPackageManager(runtime *Runtime) *PackageManager {
     return p
 }
 
-func (*PackageManager) List() ([]*PackageInfo, error) {
+func (s *PackageManager) List() ([]*PackageInfo, error) {
     cmd := exec.Command("/usr/bin/dpkg", "--get-selections")
-    output, err := Execute(cmd)
+    output, err := Execute(cmd, s.runtime.retryPolicy())
     if err != nil {
         return nil, err
     }
@@ -51,11 +51,11 @@ func (*PackageManager) List() ([]*PackageInfo, error) {
     return ret, nil
 }
 
-func (*PackageManager) Install(packages ...string) ([]*PackageInfo, error) {
+func (s *PackageManager) Install(packages ...string) ([]*PackageInfo, error) {
     cmd := exec.Command("apt-get", "install", "--yes")
     cmd.Args = append(cmd.Args, packages...)
 
-    output, err := Execute(cmd)
+    output, err := Execute(cmd, s.runtime.retryPolicy())
     if err != nil {
         return nil, err
     }
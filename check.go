@@ -0,0 +1,146 @@
+package applyd
+
+import (
+    "bytes"
+    "fmt"
+    "sort"
+    "strings"
+)
+
+// Nagios plugin exit codes
+const (
+    CheckOk       = 0
+    CheckWarning  = 1
+    CheckCritical = 2
+    CheckUnknown  = 3
+)
+
+type CheckResult struct {
+    Status   int
+    Summary  []string
+    Details  []string
+    Perfdata []string
+}
+
+type checkTarget struct {
+    name     string
+    critical bool
+    plan     func() (*Plan, error)
+}
+
+func (s *Runtime) checkTargets(basedir string) []*checkTarget {
+    firewall := s.Firewall
+
+    targets := []*checkTarget{}
+    if firewall.useNftables() {
+        targets = append(targets, &checkTarget{"nftables", true, func() (*Plan, error) { return firewall.nftables.Plan(basedir + "/nftables") }})
+    } else {
+        targets = append(targets, []*checkTarget{
+            {"ipset", true, func() (*Plan, error) { return firewall.ipsets.Plan(basedir + "/ipset") }},
+            {"iptables", true, func() (*Plan, error) { return firewall.ip4tables.Plan(basedir + "/iptables") }},
+            {"ip6tables", true, func() (*Plan, error) { return firewall.ip6tables.Plan(basedir + "/ip6tables") }},
+        }...)
+    }
+
+    return append(targets, []*checkTarget{
+        {"ip6neigh", false, func() (*Plan, error) { return s.IpNeighbors.Plan(basedir + "/ip6neigh") }},
+        {"tunnel", false, func() (*Plan, error) { return s.Tunnels.Plan(basedir + "/tunnel") }},
+        {"vips", false, func() (*Plan, error) { return s.Vips.Plan(basedir + "/vips") }},
+        {"route4", false, func() (*Plan, error) { return s.Routes4.Plan(basedir + "/route4") }},
+        {"route6", false, func() (*Plan, error) { return s.Routes6.Plan(basedir + "/route6") }},
+    }...)
+}
+
+// Check compares the kernel state against apply.d without changing anything.
+// Drift in the firewall, or any error reading state or configuration, is critical; drift elsewhere is a warning.
+func (s *Runtime) Check(basedir string) *CheckResult {
+    result := &CheckResult{}
+    result.Status = CheckOk
+
+    if !s.Firewall.useNftables() {
+        backend, err := s.Firewall.IptablesBackend()
+        if err != nil {
+            result.raise(CheckCritical)
+            result.Summary = append(result.Summary, fmt.Sprintf("iptables backend: %v", err))
+        } else {
+            result.Details = append(result.Details, backend.String())
+            for _, warning := range backend.Warnings {
+                result.raise(CheckWarning)
+                result.Summary = append(result.Summary, "iptables backend: "+warning)
+            }
+        }
+    }
+
+    for _, target := range s.checkTargets(basedir) {
+        plan, err := target.plan()
+        if err != nil {
+            result.raise(CheckCritical)
+            result.Summary = append(result.Summary, fmt.Sprintf("%s: %v", target.name, err))
+            continue
+        }
+
+        drift := len(plan.Changes)
+        if drift != 0 {
+            if target.critical {
+                result.raise(CheckCritical)
+            } else {
+                result.raise(CheckWarning)
+            }
+
+            result.Summary = append(result.Summary, fmt.Sprintf("%s: %d changes", target.name, drift))
+            for _, change := range plan.Changes {
+                result.Details = append(result.Details, change.String())
+            }
+        }
+
+        if target.critical {
+            result.Perfdata = append(result.Perfdata, fmt.Sprintf("%s=%d;;0;0", target.name, drift))
+        } else {
+            result.Perfdata = append(result.Perfdata, fmt.Sprintf("%s=%d;0;;0", target.name, drift))
+        }
+    }
+
+    sort.Strings(result.Details)
+
+    return result
+}
+
+func (s *CheckResult) raise(status int) {
+    if status > s.Status {
+        s.Status = status
+    }
+}
+
+func (s *CheckResult) StatusName() string {
+    switch s.Status {
+    case CheckOk:
+        return "OK"
+    case CheckWarning:
+        return "WARNING"
+    case CheckCritical:
+        return "CRITICAL"
+    }
+    return "UNKNOWN"
+}
+
+// Output renders the result in the Nagios plugin format: a status line with perfdata, then long output
+func (s *CheckResult) Output() string {
+    var buffer bytes.Buffer
+
+    summary := "configuration matches"
+    if len(s.Summary) != 0 {
+        summary = strings.Join(s.Summary, "; ")
+    }
+
+    buffer.WriteString("APPLYD " + s.StatusName() + " - " + summary)
+    if len(s.Perfdata) != 0 {
+        buffer.WriteString(" | " + strings.Join(s.Perfdata, " "))
+    }
+    buffer.WriteString("\n")
+
+    for _, detail := range s.Details {
+        buffer.WriteString(detail + "\n")
+    }
+
+    return buffer.String()
+}
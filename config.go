@@ -0,0 +1,210 @@
+package applyd
+
+import (
+    "github.com/fathomdb/gommons"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    // applyd owns every table it has configuration for
+    IptablesScopeFull = "full"
+    // applyd owns only the chains it declares (or that match the prefix), and the rules it declares in other chains
+    IptablesScopeChains = "chains"
+)
+
+const (
+    FirewallBackendIptables = "iptables"
+    FirewallBackendNftables = "nftables"
+)
+
+// Config holds the per-host settings, read from /etc/applyd.conf
+type Config struct {
+    FirewallBackend string
+
+    // Which iptables backend (legacy or nft) to manage, or auto to use the one with rules
+    IptablesBackend string
+
+    IptablesScope       string
+    IptablesChainPrefix string
+    IptablesSaveLayout  string
+
+    // Tag each rule with a comment naming the file it came from
+    IptablesCommentSource bool
+
+    // Treat ambiguities between files (such as conflicting chain policies) as errors
+    Strict bool
+
+    // Where firewall stats remember when each rule was last hit
+    FirewallStatsFile string
+    // Rules with no hits for this long are reported as unused
+    FirewallUnusedAfter time.Duration
+
+    // The policy statements last applied, so plans can show policy changes
+    PolicyStateFile string
+
+    // Delete the tracked flows that a firewall change cuts off or redirects (conntrack-cleanup = yes; off by default,
+    // as it ends live connections)
+    ConntrackCleanup bool
+
+    // How long iptables waits for the xtables lock, in seconds (0 to fail at once)
+    XtablesWait int
+
+    // The retry policy for the commands we run
+    CommandAttempts       int
+    CommandBackoff        time.Duration
+    CommandRetryExitCodes []int
+}
+
+func NewConfig() *Config {
+    c := &Config{}
+    c.FirewallBackend = FirewallBackendIptables
+    c.IptablesBackend = IptablesBackendAuto
+    c.IptablesScope = IptablesScopeFull
+    c.IptablesSaveLayout = IptablesLayoutSingle
+    c.FirewallStatsFile = "/var/lib/applyd/firewall-stats.json"
+    c.FirewallUnusedAfter = 30 * 24 * time.Hour
+    c.PolicyStateFile = "/var/lib/applyd/policy"
+    c.XtablesWait = 10
+    c.CommandAttempts = 3
+    c.CommandBackoff = 500 * time.Millisecond
+    c.CommandRetryExitCodes = []int{xtablesResourceProblem}
+    return c
+}
+
+func ReadConfig(path string) (*Config, error) {
+    text, err := gommons.TryReadTextFile(path, "")
+    if err != nil {
+        return nil, err
+    }
+
+    config, err := parseConfig(text)
+    if err != nil {
+        return nil, fileError(path, 0, err)
+    }
+
+    return config, nil
+}
+
+func parseConfig(text string) (*Config, error) {
+    config := NewConfig()
+
+    for i, line := range strings.Split(text, "\n") {
+        fields := strings.Fields(line)
+        if len(fields) == 0 {
+            continue
+        }
+
+        if strings.HasPrefix(fields[0], "#") {
+            continue
+        }
+
+        if len(fields) != 2 {
+            return nil, parseErrorf(i+1, "Error parsing line: %s", line)
+        }
+
+        key := fields[0]
+        value := fields[1]
+
+        switch key {
+        case "firewall-backend":
+            if value != FirewallBackendIptables && value != FirewallBackendNftables {
+                return nil, parseErrorf(i+1, "Unknown firewall backend: %s", value)
+            }
+            config.FirewallBackend = value
+
+        case "iptables-backend":
+            if value != IptablesBackendAuto && value != IptablesBackendLegacy && value != IptablesBackendNft {
+                return nil, parseErrorf(i+1, "Unknown iptables backend: %s", value)
+            }
+            config.IptablesBackend = value
+
+        case "iptables-scope":
+            if value != IptablesScopeFull && value != IptablesScopeChains {
+                return nil, parseErrorf(i+1, "Unknown iptables scope: %s", value)
+            }
+            config.IptablesScope = value
+
+        case "iptables-chain-prefix":
+            config.IptablesChainPrefix = value
+
+        case "iptables-save-layout":
+            if value != IptablesLayoutSingle && value != IptablesLayoutSplit {
+                return nil, parseErrorf(i+1, "Unknown iptables save layout: %s", value)
+            }
+            config.IptablesSaveLayout = value
+
+        case "iptables-comment-source":
+            if value != "yes" && value != "no" {
+                return nil, parseErrorf(i+1, "Expected yes or no for %s: %s", key, value)
+            }
+            config.IptablesCommentSource = value == "yes"
+
+        case "strict":
+            if value != "yes" && value != "no" {
+                return nil, parseErrorf(i+1, "Expected yes or no for %s: %s", key, value)
+            }
+            config.Strict = value == "yes"
+
+        case "firewall-stats-file":
+            config.FirewallStatsFile = value
+
+        case "firewall-unused-after":
+            d, err := time.ParseDuration(value)
+            if err != nil || d <= 0 {
+                return nil, parseErrorf(i+1, "Invalid duration for %s: %s", key, value)
+            }
+            config.FirewallUnusedAfter = d
+
+        case "policy-state-file":
+            config.PolicyStateFile = value
+
+        case "conntrack-cleanup":
+            if value != "yes" && value != "no" {
+                return nil, parseErrorf(i+1, "Expected yes or no for %s: %s", key, value)
+            }
+            config.ConntrackCleanup = value == "yes"
+
+        case "xtables-wait":
+            n, err := strconv.Atoi(value)
+            if err != nil || n < 0 {
+                return nil, parseErrorf(i+1, "Invalid number of seconds for %s: %s", key, value)
+            }
+            config.XtablesWait = n
+
+        case "command-attempts":
+            n, err := strconv.Atoi(value)
+            if err != nil || n < 1 {
+                return nil, parseErrorf(i+1, "Invalid number of attempts for %s: %s", key, value)
+            }
+            config.CommandAttempts = n
+
+        case "command-backoff":
+            d, err := time.ParseDuration(value)
+            if err != nil || d < 0 {
+                return nil, parseErrorf(i+1, "Invalid duration for %s: %s", key, value)
+            }
+            config.CommandBackoff = d
+
+        case "command-retry-exit-codes":
+            // A comma-separated list, or none
+            codes := []int{}
+            if value != "none" {
+                for _, item := range strings.Split(value, ",") {
+                    code, err := strconv.Atoi(item)
+                    if err != nil {
+                        return nil, parseErrorf(i+1, "Invalid exit code for %s: %s", key, item)
+                    }
+                    codes = append(codes, code)
+                }
+            }
+            config.CommandRetryExitCodes = codes
+
+        default:
+            return nil, parseErrorf(i+1, "Unknown configuration key: %s", key)
+        }
+    }
+
+    return config, nil
+}
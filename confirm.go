@@ -0,0 +1,292 @@
+package applyd
+
+import (
+    "bufio"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "os/exec"
+    "os/signal"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// Safe apply, in the style of iptables-apply: the firewall is applied, and reverted automatically
+// unless the change is confirmed in time, so a bad rule can't leave a remote host unreachable.
+
+const ControlSocket = "/run/applyd.sock"
+
+// firewallBackup is the firewall state before an apply
+type firewallBackup struct {
+    ipsets    *IpsetState
+    ip4tables *IptablesState
+    ip6tables *IptablesState
+    nftables  string
+
+    // By manager, for those that are installed
+    l2tables map[*L2tablesManager]*L2tablesState
+}
+
+func (s *FirewallManager) backup() (*firewallBackup, error) {
+    var err error
+
+    backup := &firewallBackup{}
+
+    if s.useNftables() {
+        output, err := s.runtime.query("nft-ruleset", exec.Command("/usr/sbin/nft", "list", "ruleset"))
+        if err != nil {
+            return nil, err
+        }
+        backup.nftables = string(output)
+        return backup, nil
+    }
+
+    backup.ipsets, err = ipsetSave(s.runtime, nil)
+    if err != nil {
+        return nil, err
+    }
+
+    backup.ip4tables, err = iptablesSave(s.runtime, false)
+    if err != nil {
+        return nil, err
+    }
+
+    backup.ip6tables, err = iptablesSave(s.runtime, true)
+    if err != nil {
+        return nil, err
+    }
+
+    backup.l2tables = make(map[*L2tablesManager]*L2tablesState)
+    for _, manager := range []*L2tablesManager{s.ebtables, s.arptables} {
+        if !s.runtime.hasCommand(manager.saveCommand()) {
+            continue
+        }
+
+        state, err := l2tablesSave(s.runtime, manager)
+        if err != nil {
+            return nil, err
+        }
+        backup.l2tables[manager] = state
+    }
+
+    return backup, nil
+}
+
+func (s *FirewallManager) restore(backup *firewallBackup) error {
+    if s.useNftables() {
+        return nftablesApply(s.runtime, "flush ruleset\n"+backup.nftables)
+    }
+
+    // ipsets first, so the restored rules find the sets they reference
+    for _, ipset := range backup.ipsets.Ipsets {
+        err := ipset.apply(s.runtime, true)
+        if err != nil {
+            return err
+        }
+    }
+
+    for _, state := range []*IptablesState{backup.ip4tables, backup.ip6tables} {
+        err := iptablesRestore(s.runtime, state.Ipv6, state.restoreConf(), "--counters")
+        if err != nil {
+            return err
+        }
+    }
+
+    for manager, state := range backup.l2tables {
+        conf, err := manager.conf(state)
+        if err != nil {
+            return err
+        }
+
+        err = manager.restore(conf)
+        if err != nil {
+            return err
+        }
+    }
+
+    // Sets the apply created are no longer referenced
+    current, err := ipsetSave(s.runtime, nil)
+    if err != nil {
+        return err
+    }
+
+    for name, _ := range current.Ipsets {
+        if backup.ipsets.Ipsets[name] != nil {
+            continue
+        }
+
+        err = ipsetDestroy(s.runtime, name)
+        if err != nil {
+            log.Printf("confirm: Unable to destroy ipset %s: %v", name, err)
+        }
+    }
+
+    return nil
+}
+
+// ApplyConfirmed applies basedir, then waits up to timeout for a confirmation on the control socket (or stdin).
+// If none arrives, the firewall is restored to its state before the apply.
+// Losing the terminal (SIGHUP) must not stop the revert, so we ignore it; SIGINT and SIGTERM revert at once.
+func (s *Runtime) ApplyConfirmed(basedir string, timeout time.Duration) error {
+    if s.snapshot != nil {
+        return fmt.Errorf("Cannot apply against a snapshot")
+    }
+
+    signal.Ignore(syscall.SIGHUP)
+    defer signal.Reset(syscall.SIGHUP)
+
+    // Caught from before the apply, so that an interrupt during it still reverts
+    interrupted := make(chan os.Signal, 1)
+    signal.Notify(interrupted, syscall.SIGINT, syscall.SIGTERM)
+    defer signal.Stop(interrupted)
+
+    backup, err := s.Firewall.backup()
+    if err != nil {
+        return err
+    }
+
+    // Listen before changing anything, so we never apply without a way to confirm
+    listener, err := listenControlSocket(ControlSocket)
+    if err != nil {
+        return err
+    }
+    defer func() {
+        listener.Close()
+        os.Remove(ControlSocket)
+    }()
+
+    err = s.Apply(basedir)
+    if err != nil {
+        log.Printf("confirm: Apply failed; restoring previous firewall")
+
+        restoreErr := s.Firewall.restore(backup)
+        if restoreErr != nil {
+            log.Printf("confirm: Error restoring previous firewall: %v", restoreErr)
+        }
+        return err
+    }
+
+    fmt.Printf("Applied; confirm within %s with 'applyd confirm' (or type yes) to keep the changes\n", timeout)
+
+    err = waitForConfirm(listener, timeout, interrupted)
+    if err == nil {
+        log.Printf("confirm: Changes confirmed")
+        return nil
+    }
+
+    log.Printf("confirm: %v; restoring previous firewall", err)
+
+    restoreErr := s.Firewall.restore(backup)
+    if restoreErr != nil {
+        return restoreErr
+    }
+
+    return fmt.Errorf("Changes were not confirmed (%v) and have been reverted", err)
+}
+
+func listenControlSocket(path string) (net.Listener, error) {
+    // Only one apply can wait for confirmation at a time
+    conn, err := net.Dial("unix", path)
+    if err == nil {
+        conn.Close()
+        return nil, fmt.Errorf("Another apply is waiting for confirmation on %s", path)
+    }
+
+    // A stale socket from an apply that was killed
+    os.Remove(path)
+
+    listener, err := net.Listen("unix", path)
+    if err != nil {
+        return nil, err
+    }
+
+    err = os.Chmod(path, 0700)
+    if err != nil {
+        listener.Close()
+        return nil, err
+    }
+
+    return listener, nil
+}
+
+// waitForConfirm returns nil once the changes are confirmed, or an error saying why they weren't
+func waitForConfirm(listener net.Listener, timeout time.Duration, interrupted <-chan os.Signal) error {
+    confirmed := make(chan bool, 1)
+    confirm := func() {
+        select {
+        case confirmed <- true:
+        default:
+        }
+    }
+
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                // Closed when we return
+                return
+            }
+
+            line, _ := bufio.NewReader(conn).ReadString('\n')
+            if strings.TrimSpace(line) == "confirm" {
+                conn.Write([]byte("ok\n"))
+                conn.Close()
+                confirm()
+                return
+            }
+
+            conn.Write([]byte("error unknown command\n"))
+            conn.Close()
+        }
+    }()
+
+    go func() {
+        scanner := bufio.NewScanner(os.Stdin)
+        for scanner.Scan() {
+            answer := strings.ToLower(strings.TrimSpace(scanner.Text()))
+            if answer == "yes" || answer == "y" {
+                confirm()
+                return
+            }
+        }
+    }()
+
+    select {
+    case <-confirmed:
+        return nil
+    case sig := <-interrupted:
+        return fmt.Errorf("Interrupted by %s", sig)
+    case <-time.After(timeout):
+        return fmt.Errorf("No confirmation within %s", timeout)
+    }
+}
+
+// Confirm tells an apply that is waiting on the control socket to keep its changes
+func Confirm(path string) error {
+    conn, err := net.Dial("unix", path)
+    if err != nil {
+        return fmt.Errorf("No apply is waiting for confirmation: %v", err)
+    }
+    defer conn.Close()
+
+    _, err = conn.Write([]byte("confirm\n"))
+    if err != nil {
+        return err
+    }
+
+    conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+    reply, err := bufio.NewReader(conn).ReadString('\n')
+    if err != nil {
+        return err
+    }
+
+    reply = strings.TrimSpace(reply)
+    if reply != "ok" {
+        return fmt.Errorf("Confirmation failed: %s", reply)
+    }
+
+    return nil
+}
@@ -8,6 +8,12 @@ type FirewallManager struct {
     ipsets    *IpsetManager
     ip4tables *IptablesManager
     ip6tables *IptablesManager
+    nftables  *NftablesManager
+    ebtables  *L2tablesManager
+    arptables *L2tablesManager
+
+    // Detected on first use
+    iptablesBackend *IptablesBackendStatus
 }
 
 func NewFirewallManager(runtime *Runtime) *FirewallManager {
@@ -17,11 +23,22 @@ func NewFirewallManager(runtime *Runtime) *FirewallManager {
     p.ipsets = NewIpsetManager(p)
     p.ip4tables = NewIptablesManager(p, false)
     p.ip6tables = NewIptablesManager(p, true)
+    p.nftables = NewNftablesManager(p)
+    p.ebtables = NewL2tablesManager(p, "ebtables")
+    p.arptables = NewL2tablesManager(p, "arptables")
 
     return p
 }
 
+func (s *FirewallManager) useNftables() bool {
+    return s.runtime.Config.FirewallBackend == FirewallBackendNftables
+}
+
 func (s *FirewallManager) Save(basedir string) (err error) {
+    if s.useNftables() {
+        return s.nftables.Save(basedir + "/nftables")
+    }
+
     err = s.ipsets.Save(basedir + "/ipset")
     if err != nil {
         return err
@@ -37,24 +54,98 @@ func (s *FirewallManager) Save(basedir string) (err error) {
         return err
     }
 
+    err = s.ebtables.Save(basedir + "/ebtables")
+    if err != nil {
+        return err
+    }
+
+    err = s.arptables.Save(basedir + "/arptables")
+    if err != nil {
+        return err
+    }
+
     return nil
 }
 
-func (s *FirewallManager) Apply(basedir string) (err error) {
-    err = s.ipsets.Apply(basedir + "/ipset")
+func (s *FirewallManager) Plan(basedir string) (*Plan, error) {
+    if s.useNftables() {
+        // Named sets take the place of ipsets
+        return s.nftables.Plan(basedir + "/nftables")
+    }
+
+    plan := &Plan{}
+
+    // A rule referencing a missing ipset would fail part-way through a table commit
+    ipsetNames, err := s.ipsets.names(basedir + "/ipset")
     if err != nil {
-        return err
+        return nil, err
     }
 
-    err = s.ip4tables.Apply(basedir + "/iptables")
+    for _, iptables := range []*IptablesManager{s.ip4tables, s.ip6tables} {
+        err = iptables.checkIpsets(basedir+"/"+iptables.command(), ipsetNames)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    err = s.checkNatRoutes(basedir)
     if err != nil {
-        return err
+        return nil, err
+    }
+
+    ipsets, err := s.ipsets.Plan(basedir + "/ipset")
+    if err != nil {
+        return nil, err
+    }
+    plan.merge(ipsets)
+
+    ip4tables, err := s.ip4tables.Plan(basedir + "/iptables")
+    if err != nil {
+        return nil, err
+    }
+    plan.merge(ip4tables)
+
+    ip6tables, err := s.ip6tables.Plan(basedir + "/ip6tables")
+    if err != nil {
+        return nil, err
+    }
+    plan.merge(ip6tables)
+
+    ebtables, err := s.ebtables.Plan(basedir + "/ebtables")
+    if err != nil {
+        return nil, err
     }
+    plan.merge(ebtables)
 
-    err = s.ip6tables.Apply(basedir + "/ip6tables")
+    arptables, err := s.arptables.Plan(basedir + "/arptables")
+    if err != nil {
+        return nil, err
+    }
+    plan.merge(arptables)
+
+    // Flows are only deleted once the rules that would let them back in are gone
+    conntrack, err := s.planConntrack(basedir)
+    if err != nil {
+        return nil, err
+    }
+    plan.merge(conntrack)
+
+    // Recorded last, once the rules it compiles to are in place
+    policy, err := s.planPolicy(basedir)
+    if err != nil {
+        return nil, err
+    }
+    plan.merge(policy)
+
+    return plan, nil
+}
+
+// Apply applies ipsets, both iptables families, ebtables and arptables as one plan, so every preflight check runs before anything changes
+func (s *FirewallManager) Apply(basedir string) (err error) {
+    plan, err := s.Plan(basedir)
     if err != nil {
         return err
     }
 
-    return nil
+    return plan.Apply()
 }
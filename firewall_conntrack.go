@@ -0,0 +1,595 @@
+package applyd
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "os/exec"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Changing the rules doesn't touch flows the kernel is already tracking: an established connection that an allow
+// rule let in stays up after the rule is gone, and a DNAT flow keeps going to the old target.  So after the firewall
+// is applied, we delete the conntrack entries of the flows the change affects:
+//   - flows DNATed by a rule that is removed (including a forward whose target changes)
+//   - flows matching an allow rule that is removed, unless a remaining allow rule in the chain covers it
+//   - flows matching a block rule that is added
+//   - flows from ipset members newly blocked, or no longer allowed
+// A rule is only used if conntrack can express what it matches; otherwise we leave its flows alone.
+// The plan lists the flows that would be deleted, so 'applyd plan' is the dry run.
+
+type ConntrackFilter struct {
+    Ipv6   bool
+    Args   []string
+    Reason string
+}
+
+// The number of flows listed per filter in the plan
+const conntrackListLimit = 20
+
+func (s *ConntrackFilter) args() []string {
+    if s.Ipv6 {
+        return append([]string{"-f", "ipv6"}, s.Args...)
+    }
+    return s.Args
+}
+
+func (s *ConntrackFilter) String() string {
+    return strings.Join(s.args(), " ")
+}
+
+func conntrackList(runtime *Runtime, filter *ConntrackFilter) ([]string, error) {
+    cmd := exec.Command("/usr/sbin/conntrack", append([]string{"-L"}, filter.args()...)...)
+
+    output, err := runtime.query("conntrack "+filter.String(), cmd)
+    if err != nil {
+        return nil, err
+    }
+
+    entries := []string{}
+    for _, line := range strings.Split(string(output), "\n") {
+        line = strings.TrimSpace(line)
+        // The summary goes to stderr
+        if line == "" || strings.HasPrefix(line, "conntrack v") {
+            continue
+        }
+        entries = append(entries, line)
+    }
+    return entries, nil
+}
+
+func conntrackDelete(runtime *Runtime, filter *ConntrackFilter) error {
+    cmd := exec.Command("/usr/sbin/conntrack", append([]string{"-D"}, filter.args()...)...)
+
+    output, err := Execute(cmd, runtime.retryPolicy())
+    if err != nil {
+        // Older versions fail if there was nothing to delete; the flows may have ended since we planned
+        if strings.Contains(string(output), " 0 flow entries") {
+            return nil
+        }
+
+        return err
+    }
+
+    log.Printf("conntrack: %s", strings.TrimSpace(string(output)))
+    return nil
+}
+
+// conntrackAddressArgs renders an address or network as a conntrack filter
+func conntrackAddressArgs(option string, maskOption string, value string) ([]string, bool) {
+    if !strings.Contains(value, "/") {
+        ip := net.ParseIP(value)
+        if ip == nil {
+            return nil, false
+        }
+        return []string{option, ip.String()}, true
+    }
+
+    ip, network, err := net.ParseCIDR(value)
+    if err != nil {
+        return nil, false
+    }
+
+    ones, bits := network.Mask.Size()
+    if ones == bits {
+        return []string{option, ip.String()}, true
+    }
+    return []string{option, network.IP.String(), maskOption, net.IP(network.Mask).String()}, true
+}
+
+// conntrackRuleArgs returns the conntrack filter matching the flows the rule matches, if conntrack can express it.
+// member stands in for the rule's ipset.  Interfaces aren't tracked, so they are only ignored if allowInterfaces is set.
+// Rules that would match every flow of a protocol are refused.
+func conntrackRuleArgs(rule *IptablesRule, member string, allowInterfaces bool) ([]string, bool) {
+    args := []string{}
+    narrow := false
+    source := false
+
+    for _, o := range rule.Options {
+        if o.Negated || len(o.Values) != 1 {
+            return nil, false
+        }
+
+        switch o.Name {
+        case "-s", "-d":
+            option, maskOption := "--orig-src", "--mask-src"
+            if o.Name == "-d" {
+                option, maskOption = "--orig-dst", "--mask-dst"
+            } else {
+                source = true
+            }
+
+            a, ok := conntrackAddressArgs(option, maskOption, o.Values[0])
+            if !ok {
+                return nil, false
+            }
+            args = append(args, a...)
+            narrow = true
+
+        case "-p":
+            if o.Values[0] != "all" {
+                args = append(args, "-p", o.Values[0])
+            }
+
+        case "-i", "-o":
+            if !allowInterfaces {
+                return nil, false
+            }
+
+        default:
+            return nil, false
+        }
+    }
+
+    for _, m := range rule.Matches {
+        if m.Module == "comment" {
+            continue
+        }
+
+        for _, o := range m.Options {
+            if o.Negated {
+                return nil, false
+            }
+
+            switch {
+            case (m.Module == "conntrack" && o.Name == "--ctstate") || (m.Module == "state" && o.Name == "--state"):
+                // Deleting a flow deletes it whatever its state
+
+            case (m.Module == "tcp" || m.Module == "udp" || m.Module == "sctp") && (o.Name == "--sport" || o.Name == "--dport"):
+                port := o.Values[0]
+                if _, err := strconv.Atoi(port); err != nil {
+                    // conntrack can't filter on a range
+                    return nil, false
+                }
+
+                if o.Name == "--sport" {
+                    args = append(args, "--orig-port-src", port)
+                } else {
+                    args = append(args, "--orig-port-dst", port)
+                }
+                narrow = true
+
+            case m.Module == "set" && o.Name == "--match-set" && member != "" && len(o.Values) == 2:
+                if source || strings.Split(o.Values[1], ",")[0] != "src" {
+                    return nil, false
+                }
+
+                a, ok := conntrackAddressArgs("--orig-src", "--mask-src", member)
+                if !ok {
+                    return nil, false
+                }
+                args = append(args, a...)
+                source = true
+                narrow = true
+
+            default:
+                return nil, false
+            }
+        }
+    }
+
+    return args, narrow
+}
+
+// ruleIpset returns the ipset the rule matches on, if any
+func ruleIpset(rule *IptablesRule) string {
+    for _, m := range rule.Matches {
+        if m.Module != "set" {
+            continue
+        }
+        for _, o := range m.Options {
+            if o.Name == "--match-set" && len(o.Values) == 2 {
+                return o.Values[0]
+            }
+        }
+    }
+    return ""
+}
+
+// ipsetAddresses returns the addresses and networks in the set, which must be of the given family
+func ipsetAddresses(ipset *Ipset, ipv6 bool) map[string]bool {
+    addresses := make(map[string]bool)
+    if ipset == nil {
+        return addresses
+    }
+
+    for _, member := range ipset.Members {
+        fields := strings.Fields(member)
+        if len(fields) == 0 || containsString(fields, "nomatch") {
+            continue
+        }
+
+        address := strings.Split(fields[0], ",")[0]
+        family := addressFamily(address)
+        if family == familyAny || (family == familyIpv6) != ipv6 {
+            continue
+        }
+        addresses[address] = true
+    }
+    return addresses
+}
+
+// rulesMissing returns the rules in a that aren't in b; a rule that is only tagged differently is the same rule
+func rulesMissing(a *IptablesChain, b *IptablesChain) []*IptablesRule {
+    missing := []*IptablesRule{}
+    if a == nil {
+        return missing
+    }
+
+    remaining := make(map[string]int)
+    if b != nil {
+        for _, rule := range b.Rules {
+            remaining[rule.untaggedSpec()]++
+        }
+    }
+
+    for _, rule := range a.Rules {
+        spec := rule.untaggedSpec()
+        if remaining[spec] > 0 {
+            remaining[spec]--
+            continue
+        }
+        missing = append(missing, rule)
+    }
+    return missing
+}
+
+// chainReaches returns true if a packet in chain from can reach chain to, through jumps
+func chainReaches(table *IptablesTable, from string, to string, depth int) bool {
+    if from == to {
+        return true
+    }
+
+    chain := table.Chains[from]
+    if chain == nil || depth > traceMaxDepth {
+        return false
+    }
+
+    for _, rule := range chain.Rules {
+        if table.Chains[rule.Target] != nil && chainReaches(table, rule.Target, to, depth+1) {
+            return true
+        }
+    }
+    return false
+}
+
+// coveredIn returns true if a rule of the chain, or of a chain it jumps to, matches every packet rule matches and
+// treats them the same (as same decides).  Jumps are followed only if they too match every such packet.
+func coveredIn(table *IptablesTable, name string, rule *IptablesRule, same func(*IptablesRule) bool, depth int) bool {
+    chain := table.Chains[name]
+    if chain == nil || depth > traceMaxDepth {
+        return false
+    }
+
+    for _, r := range chain.Rules {
+        if !r.covers(rule) {
+            continue
+        }
+        if same(r) {
+            return true
+        }
+        if table.Chains[r.Target] != nil && coveredIn(table, r.Target, rule, same, depth+1) {
+            return true
+        }
+    }
+    return false
+}
+
+// stillCovered returns true if the desired rules still treat the packets of a removed rule the same, whether in its
+// chain or in another reached from the same built-in chains (a rule moved into a policy chain, for instance)
+func stillCovered(current *IptablesTable, desired *IptablesTable, chainName string, rule *IptablesRule, same func(*IptablesRule) bool) bool {
+    starts := []string{chainName}
+    for name, _ := range current.Chains {
+        if isBuiltinChain(name) && name != chainName && chainReaches(current, name, chainName, 0) {
+            starts = append(starts, name)
+        }
+    }
+
+    for _, name := range starts {
+        if coveredIn(desired, name, rule, same, 0) {
+            return true
+        }
+    }
+    return false
+}
+
+func isBlockTarget(target string) bool {
+    return target == "DROP" || target == "REJECT"
+}
+
+type conntrackPlanner struct {
+    ipv6    bool
+    filters []*ConntrackFilter
+    seen    map[string]bool
+}
+
+func (p *conntrackPlanner) add(args []string, reason string) {
+    filter := &ConntrackFilter{Ipv6: p.ipv6, Args: args, Reason: reason}
+
+    key := filter.String()
+    if p.seen[key] {
+        return
+    }
+    p.seen[key] = true
+
+    p.filters = append(p.filters, filter)
+}
+
+func describeConntrackRule(table string, chain string, rule *IptablesRule) string {
+    text := fmt.Sprintf("%s/%s -A %s %s", table, chain, chain, rule.Spec)
+    if rule.location() != "" {
+        text += " at " + rule.location()
+    }
+    return text
+}
+
+// dnatBackend returns the address a DNAT rule sends flows to, or "" if it is a range
+func dnatBackend(rule *IptablesRule) string {
+    to := targetOption(rule, "--to-destination")
+    if to == nil || len(to.Values) != 1 {
+        return ""
+    }
+
+    address := to.Values[0]
+    if strings.HasPrefix(address, "[") {
+        end := strings.Index(address, "]")
+        if end == -1 {
+            return ""
+        }
+        address = address[1:end]
+    } else if strings.Count(address, ":") == 1 {
+        address = address[:strings.Index(address, ":")]
+    }
+
+    if net.ParseIP(address) == nil {
+        return ""
+    }
+    return address
+}
+
+// conntrackFilters works out which tracked flows the change from current to desired affects.
+// If currentIpsets is nil, changes to ipset members are ignored.
+func (s *IptablesManager) conntrackFilters(current *IptablesState, desired *IptablesState, currentIpsets *IpsetState, desiredIpsets *IpsetState) []*ConntrackFilter {
+    p := &conntrackPlanner{ipv6: s.Ipv6, seen: make(map[string]bool)}
+
+    members := func(state *IpsetState, name string) map[string]bool {
+        if state == nil {
+            return make(map[string]bool)
+        }
+        return ipsetAddresses(state.Ipsets[name], s.Ipv6)
+    }
+
+    // addMembers adds a filter for each address in a but not in b
+    addMembers := func(rule *IptablesRule, a map[string]bool, b map[string]bool, reason string) {
+        addresses := []string{}
+        for address, _ := range a {
+            if !b[address] {
+                addresses = append(addresses, address)
+            }
+        }
+        sort.Strings(addresses)
+
+        for _, address := range addresses {
+            args, ok := conntrackRuleArgs(rule, address, false)
+            if ok {
+                p.add(args, reason+" ("+address+")")
+            }
+        }
+    }
+
+    for _, tableName := range desired.tableNames() {
+        desiredTable := desired.Tables[tableName]
+        currentTable := current.Tables[tableName]
+        if currentTable == nil {
+            currentTable = &IptablesTable{Name: tableName, Chains: make(map[string]*IptablesChain)}
+        }
+
+        for _, chainName := range desiredTable.chainNames() {
+            desiredChain := desiredTable.Chains[chainName]
+            currentChain := currentTable.Chains[chainName]
+
+            // In chain scope, the rules of chains we don't own aren't ours to remove
+            removed := []*IptablesRule{}
+            if s.runtime.Config.IptablesScope != IptablesScopeChains || s.ownsChain(desiredTable, chainName) {
+                removed = rulesMissing(currentChain, desiredChain)
+            }
+            added := rulesMissing(desiredChain, currentChain)
+
+            for _, rule := range removed {
+                switch {
+                case tableName == "nat" && rule.Target == "DNAT":
+                    // An equivalent forward that remains keeps its flows
+                    backend := targetOption(rule, "--to-destination")
+                    forwards := func(r *IptablesRule) bool {
+                        to := targetOption(r, "--to-destination")
+                        return r.Target == "DNAT" && to != nil && backend != nil && stringSliceEquals(to.Values, backend.Values)
+                    }
+                    if stillCovered(currentTable, desiredTable, chainName, rule, forwards) {
+                        continue
+                    }
+
+                    args, ok := conntrackRuleArgs(rule, "", true)
+                    if !ok {
+                        continue
+                    }
+                    if backend := dnatBackend(rule); backend != "" {
+                        args = append(args, "--reply-src", backend)
+                    }
+                    p.add(args, "removed "+describeConntrackRule(tableName, chainName, rule))
+
+                case tableName == "filter" && rule.Target == "ACCEPT":
+                    accepts := func(r *IptablesRule) bool {
+                        return r.Target == "ACCEPT"
+                    }
+                    if stillCovered(currentTable, desiredTable, chainName, rule, accepts) {
+                        continue
+                    }
+
+                    reason := "removed " + describeConntrackRule(tableName, chainName, rule)
+                    if set := ruleIpset(rule); set != "" {
+                        if currentIpsets != nil {
+                            addMembers(rule, members(currentIpsets, set), nil, reason)
+                        }
+                        continue
+                    }
+
+                    args, ok := conntrackRuleArgs(rule, "", false)
+                    if ok {
+                        p.add(args, reason)
+                    }
+                }
+            }
+
+            if tableName != "filter" {
+                continue
+            }
+
+            for _, rule := range added {
+                if !isBlockTarget(rule.Target) {
+                    continue
+                }
+
+                reason := "added " + describeConntrackRule(tableName, chainName, rule)
+                if set := ruleIpset(rule); set != "" {
+                    addMembers(rule, members(desiredIpsets, set), nil, reason)
+                    continue
+                }
+
+                args, ok := conntrackRuleArgs(rule, "", false)
+                if ok {
+                    p.add(args, reason)
+                }
+            }
+
+            if currentIpsets == nil {
+                continue
+            }
+
+            // Rules that stay, but whose ipset changes
+            isAdded := make(map[*IptablesRule]bool)
+            for _, rule := range added {
+                isAdded[rule] = true
+            }
+
+            for _, rule := range desiredChain.Rules {
+                set := ruleIpset(rule)
+                if set == "" || isAdded[rule] {
+                    continue
+                }
+
+                switch {
+                case isBlockTarget(rule.Target):
+                    addMembers(rule, members(desiredIpsets, set), members(currentIpsets, set), "ipset "+set+" members added, blocked by "+describeConntrackRule(tableName, chainName, rule))
+                case rule.Target == "ACCEPT":
+                    addMembers(rule, members(currentIpsets, set), members(desiredIpsets, set), "ipset "+set+" members removed, allowed by "+describeConntrackRule(tableName, chainName, rule))
+                }
+            }
+        }
+    }
+
+    return p.filters
+}
+
+// planConntrack plans deleting the tracked flows the firewall change affects; it runs after the firewall is applied
+func (s *FirewallManager) planConntrack(basedir string) (*Plan, error) {
+    plan := &Plan{}
+
+    if !s.runtime.Config.ConntrackCleanup {
+        return plan, nil
+    }
+
+    desiredIpsets, err := s.ipsets.readDesired(basedir + "/ipset")
+    if err != nil {
+        return nil, err
+    }
+
+    currentIpsets, err := ipsetSave(s.runtime, nil)
+    if err != nil {
+        log.Printf("conntrack: Unable to read ipsets; ignoring ipset changes: %v", err)
+        currentIpsets = nil
+    }
+
+    filters := []*ConntrackFilter{}
+
+    for _, iptables := range []*IptablesManager{s.ip4tables, s.ip6tables} {
+        dir := basedir + "/" + iptables.command()
+
+        found, err := iptables.hasConfiguration(dir)
+        if err != nil {
+            return nil, err
+        }
+        if !found {
+            continue
+        }
+
+        desired, err := iptables.readDesired(dir)
+        if err != nil {
+            return nil, err
+        }
+        if desired == nil {
+            continue
+        }
+
+        current, err := iptablesSave(s.runtime, iptables.Ipv6)
+        if err != nil {
+            return nil, err
+        }
+
+        filters = append(filters, iptables.conntrackFilters(current, desired, currentIpsets, desiredIpsets)...)
+    }
+
+    for _, filter := range filters {
+        filter := filter
+
+        entries, err := conntrackList(s.runtime, filter)
+        if err != nil {
+            log.Printf("conntrack: Unable to list flows; skipping cleanup: %v", err)
+            return &Plan{}, nil
+        }
+
+        if len(entries) == 0 {
+            continue
+        }
+
+        listing := entries
+        if len(listing) > conntrackListLimit {
+            listing = append(listing[:conntrackListLimit:conntrackListLimit], fmt.Sprintf("... and %d more", len(entries)-conntrackListLimit))
+        }
+
+        change := &Change{}
+        change.Manager = "conntrack"
+        change.Key = filter.String() + " (" + filter.Reason + ")"
+        change.Action = ActionRemove
+        change.Current = strings.Join(listing, "\n")
+        plan.add(change)
+
+        plan.addAction(func() error {
+            log.Printf("conntrack: Deleting flows matching %s, as %s", filter, filter.Reason)
+            return conntrackDelete(s.runtime, filter)
+        })
+    }
+
+    return plan, nil
+}
@@ -0,0 +1,399 @@
+package applyd
+
+import (
+    "bytes"
+    "fmt"
+    "github.com/fathomdb/gommons"
+    "net"
+    "path"
+    "strings"
+)
+
+// Dual-stack firewall files live in apply.d/firewall, in iptables-save format.
+// Each rule is compiled to both iptables and ip6tables, unless its addresses or ipsets tie it to one family.
+// ICMP protocol, types and REJECT codes are translated for IPv6.
+
+const (
+    familyAny  = ""
+    familyIpv4 = "ipv4"
+    familyIpv6 = "ipv6"
+)
+
+var dualStackIcmpv6Types = map[string]string{
+    "0":  "129",
+    "3":  "1",
+    "8":  "128",
+    "11": "3",
+    "12": "4",
+
+    "echo-reply":              "echo-reply",
+    "echo-request":            "echo-request",
+    "destination-unreachable": "destination-unreachable",
+    "time-exceeded":           "time-exceeded",
+    "parameter-problem":       "parameter-problem",
+}
+
+var dualStackRejectWith = map[string]string{
+    "icmp-net-unreachable":  "icmp6-no-route",
+    "icmp-host-unreachable": "icmp6-addr-unreachable",
+    "icmp-port-unreachable": "icmp6-port-unreachable",
+    "icmp-net-prohibited":   "icmp6-adm-prohibited",
+    "icmp-host-prohibited":  "icmp6-adm-prohibited",
+    "icmp-admin-prohibited": "icmp6-adm-prohibited",
+    "tcp-reset":             "tcp-reset",
+}
+
+// dualStackDir returns the dual-stack directory for an iptables or ip6tables directory; they are siblings
+func dualStackDir(basedir string) string {
+    return path.Dir(basedir) + "/firewall"
+}
+
+func addressFamily(addr string) string {
+    ip := addr
+    if strings.Contains(ip, "/") {
+        ip = ip[:strings.Index(ip, "/")]
+    }
+
+    parsed := net.ParseIP(ip)
+    if parsed == nil {
+        // A hostname; it could resolve to either
+        return familyAny
+    }
+    if parsed.To4() != nil {
+        return familyIpv4
+    }
+    return familyIpv6
+}
+
+func ipsetFamily(spec string) string {
+    fields := strings.Fields(spec)
+    if len(fields) == 0 {
+        return familyAny
+    }
+
+    ipType := strings.HasPrefix(fields[0], "hash:ip") || strings.HasPrefix(fields[0], "hash:net") || fields[0] == "bitmap:ip"
+    if !ipType {
+        return familyAny
+    }
+
+    i := indexOf(fields, "family")
+    if i != -1 && (i+1) < len(fields) && fields[i+1] == "inet6" {
+        return familyIpv6
+    }
+    return familyIpv4
+}
+
+// ipsetFamilies returns the family of each ipset in the kernel or in the ipset directory
+func (s *IptablesManager) ipsetFamilies(ipsetDir string) (map[string]string, error) {
+    families := make(map[string]string)
+
+    state, err := ipsetSave(s.runtime, nil)
+    if err != nil {
+        return nil, err
+    }
+
+    for name, ipset := range state.Ipsets {
+        families[name] = ipsetFamily(ipset.Spec)
+    }
+
+    isdir, err := gommons.IsDirectory(ipsetDir)
+    if err != nil {
+        return nil, err
+    }
+
+    if isdir {
+        files, err := gommons.ListDirectoryNames(ipsetDir)
+        if err != nil {
+            return nil, err
+        }
+
+        for _, file := range files {
+            ipset, err := readIpsetFile(file, ipsetDir+"/"+file)
+            if err != nil {
+                return nil, err
+            }
+            families[file] = ipsetFamily(ipset.Spec)
+        }
+    }
+
+    return families, nil
+}
+
+// targetAddressHost returns the first address of a target's address, without the port or the end of a range:
+// 10.0.0.5-10.0.0.9:80-90, [2001:db8::1]:80, 2001:db8::1-2001:db8::5
+func targetAddressHost(value string) string {
+    if strings.HasPrefix(value, "[") {
+        end := strings.Index(value, "]")
+        if end == -1 {
+            return value
+        }
+        value = value[1:end]
+    } else if strings.Count(value, ":") == 1 {
+        value = value[:strings.Index(value, ":")]
+    }
+
+    if strings.Contains(value, "-") {
+        value = value[:strings.Index(value, "-")]
+    }
+    return value
+}
+
+func renderIptablesTokens(tokens []iptablesToken) string {
+    var buffer bytes.Buffer
+    for i, t := range tokens {
+        if i != 0 {
+            buffer.WriteString(" ")
+        }
+        if t.quoted {
+            buffer.WriteString(quoteIptablesValue(t.text))
+        } else {
+            buffer.WriteString(t.text)
+        }
+    }
+    return buffer.String()
+}
+
+// compileDualStackRule returns the rule for one family, or false if the rule doesn't apply to that family
+func compileDualStackRule(spec string, ipv6 bool, ipsets map[string]string) (string, bool, error) {
+    tokens, err := tokenizeIptablesRule(spec)
+    if err != nil {
+        return "", false, err
+    }
+
+    family := familyAny
+    require := func(f string, reason string) error {
+        if f == familyAny {
+            return nil
+        }
+        if family != familyAny && family != f {
+            return fmt.Errorf("Rule mixes IPv4 and IPv6 (%s): %s", reason, spec)
+        }
+        family = f
+        return nil
+    }
+
+    for i := 0; (i + 1) < len(tokens); i++ {
+        name := tokens[i].text
+        if iptablesAliases[name] != "" {
+            name = iptablesAliases[name]
+        }
+
+        value := tokens[i+1].text
+        if value == "!" && (i+2) < len(tokens) {
+            value = tokens[i+2].text
+        }
+
+        switch name {
+        case "-p":
+            switch strings.ToLower(value) {
+            case "ipv6-icmp", "icmpv6", "58":
+                err = require(familyIpv6, "protocol "+value)
+                if err != nil {
+                    return "", false, err
+                }
+            }
+
+        case "-s", "-d":
+            for _, addr := range strings.Split(value, ",") {
+                err = require(addressFamily(addr), addr)
+                if err != nil {
+                    return "", false, err
+                }
+            }
+
+        case "--match-set", "--add-set", "--del-set":
+            f, found := ipsets[value]
+            if !found {
+                return "", false, fmt.Errorf("Ipset not found: %s", value)
+            }
+            err = require(f, "ipset "+value)
+            if err != nil {
+                return "", false, err
+            }
+
+        case "--icmp-type":
+            if dualStackIcmpv6Types[value] == "" {
+                // No IPv6 equivalent
+                err = require(familyIpv4, "icmp type "+value)
+                if err != nil {
+                    return "", false, err
+                }
+            }
+
+        case "--reject-with":
+            if dualStackRejectWith[value] == "" && !strings.HasPrefix(value, "icmp6-") {
+                err = require(familyIpv4, "reject with "+value)
+                if err != nil {
+                    return "", false, err
+                }
+            }
+            if strings.HasPrefix(value, "icmp6-") {
+                err = require(familyIpv6, "reject with "+value)
+                if err != nil {
+                    return "", false, err
+                }
+            }
+
+        case "--icmpv6-type":
+            err = require(familyIpv6, "icmpv6 type")
+            if err != nil {
+                return "", false, err
+            }
+
+        case "--to-destination", "--to-source", "--to", "--gateway":
+            host := targetAddressHost(value)
+            err = require(addressFamily(host), name+" "+value)
+            if err != nil {
+                return "", false, err
+            }
+        }
+    }
+
+    if (family == familyIpv4 && ipv6) || (family == familyIpv6 && !ipv6) {
+        return "", false, nil
+    }
+
+    if !ipv6 {
+        return spec, true, nil
+    }
+
+    // Translate ICMP for IPv6
+    translated := []iptablesToken{}
+    for i := 0; i < len(tokens); i++ {
+        t := tokens[i]
+        translated = append(translated, t)
+
+        if t.quoted || (i+1) >= len(tokens) {
+            continue
+        }
+
+        name := t.text
+        if iptablesAliases[name] != "" {
+            name = iptablesAliases[name]
+        }
+
+        // The old form puts the negation after the option: --icmp-type ! 8
+        skip := 1
+        next := tokens[i+1]
+        negation := []iptablesToken{}
+        if !next.quoted && next.text == "!" && (i+2) < len(tokens) {
+            skip = 2
+            next = tokens[i+2]
+            negation = append(negation, iptablesToken{"!", false})
+        }
+
+        switch name {
+        case "-p":
+            if next.text == "icmp" || next.text == "1" {
+                translated = append(append(translated, negation...), iptablesToken{"ipv6-icmp", false})
+                i += skip
+            }
+
+        case "-m":
+            if next.text == "icmp" {
+                translated = append(translated, iptablesToken{"icmp6", false})
+                i++
+            }
+
+        case "--icmp-type":
+            translated[len(translated)-1] = iptablesToken{"--icmpv6-type", false}
+            translated = append(append(translated, negation...), iptablesToken{dualStackIcmpv6Types[next.text], false})
+            i += skip
+
+        case "--reject-with":
+            if dualStackRejectWith[next.text] != "" {
+                translated = append(translated, iptablesToken{dualStackRejectWith[next.text], false})
+                i++
+            }
+        }
+    }
+
+    return renderIptablesTokens(translated), true, nil
+}
+
+// compileDualStack returns the file for one family.  Rules for the other family become blank lines,
+// so that line numbers in errors still refer to the source file.
+func compileDualStack(text string, ipv6 bool, ipsets map[string]string) (string, error) {
+    var buffer bytes.Buffer
+
+    for i, line := range strings.Split(text, "\n") {
+        if i != 0 {
+            buffer.WriteString("\n")
+        }
+
+        if !strings.HasPrefix(line, "-A ") {
+            buffer.WriteString(line)
+            continue
+        }
+
+        chain, spec := splitRuleLine(line)
+        if chain == "" {
+            return "", parseErrorf(i+1, "Error parsing line: %s", line)
+        }
+
+        compiled, include, err := compileDualStackRule(spec, ipv6, ipsets)
+        if err != nil {
+            return "", parseErrorf(i+1, "%v", err)
+        }
+
+        if include {
+            buffer.WriteString("-A " + chain + " " + compiled)
+        }
+    }
+
+    return buffer.String(), nil
+}
+
+// readDualStack compiles the dual-stack files for this manager's family, returning nil if there are none
+func (s *IptablesManager) readDualStack(basedir string) (*IptablesState, error) {
+    dir := dualStackDir(basedir)
+
+    isdir, err := gommons.IsDirectory(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    if !isdir {
+        return nil, nil
+    }
+
+    ipsets, err := s.ipsetFamilies(path.Dir(basedir) + "/ipset")
+    if err != nil {
+        return nil, err
+    }
+
+    sources, err := listIptablesSources(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    var desired *IptablesState
+
+    for _, source := range sources {
+        text, err := gommons.TryReadTextFile(source.Path, "")
+        if err != nil {
+            return nil, err
+        }
+
+        compiled, err := compileDualStack(text, s.Ipv6, ipsets)
+        if err != nil {
+            return nil, fileError(source.Path, 0, err)
+        }
+
+        state, err := source.parse(s.Ipv6, compiled)
+        if err != nil {
+            return nil, err
+        }
+
+        if desired == nil {
+            desired = state
+        } else {
+            err = desired.merge(state, s.runtime.Config.Strict)
+            if err != nil {
+                return nil, err
+            }
+        }
+    }
+
+    return desired, nil
+}
@@ -4,7 +4,6 @@ import (
     "bytes"
     "fmt"
     "github.com/fathomdb/gommons"
-    "io/ioutil"
     "log"
     "math/rand"
     "os"
@@ -14,6 +13,7 @@ import (
 )
 
 type IpsetManager struct {
+    runtime *Runtime
 }
 
 type IpsetState struct {
@@ -32,6 +32,7 @@ type IpsetMember struct {
 
 func NewIpsetManager(firewall *FirewallManager) *IpsetManager {
     p := &IpsetManager{}
+    p.runtime = firewall.runtime
     return p
 }
 
@@ -57,13 +58,15 @@ func (s *Ipset) buildConf(changeName *string) string {
     return buffer.String()
 }
 
-func ipsetSave(ruleset *string) (*IpsetState, error) {
+func ipsetSave(runtime *Runtime, ruleset *string) (*IpsetState, error) {
+    key := "ipset-save"
     cmd := exec.Command("/usr/sbin/ipset", "save")
     if ruleset != nil {
+        key += " " + *ruleset
         cmd.Args = append(cmd.Args, *ruleset)
     }
 
-    output, err := Execute(cmd)
+    output, err := runtime.query(key, cmd)
     if err != nil {
         return nil, err
     }
@@ -105,7 +108,7 @@ func parseIpset(spec string) (*IpsetState, error) {
     state := &IpsetState{}
     state.Ipsets = make(map[string]*Ipset)
 
-    for _, line := range strings.Split(spec, "\n") {
+    for i, line := range strings.Split(spec, "\n") {
         if line == "" {
             continue
         }
@@ -113,7 +116,7 @@ func parseIpset(spec string) (*IpsetState, error) {
         if strings.HasPrefix(line, "create ") {
             fields := strings.Fields(line)
             if len(fields) < 2 {
-                return nil, fmt.Errorf("Error parsing line: %s", line)
+                return nil, parseErrorf(i+1, "Error parsing line: %s", line)
             }
 
             name := fields[1]
@@ -125,23 +128,23 @@ func parseIpset(spec string) (*IpsetState, error) {
 
                 state.Ipsets[name] = ipset
             } else {
-                return nil, fmt.Errorf("Duplicate ipset: %s", name)
+                return nil, parseErrorf(i+1, "Duplicate ipset: %s", name)
             }
         } else if strings.HasPrefix(line, "add ") {
             fields := strings.Fields(line)
             if len(fields) < 2 {
-                return nil, fmt.Errorf("Error parsing line: %s", line)
+                return nil, parseErrorf(i+1, "Error parsing line: %s", line)
             }
 
             name := fields[1]
             ipset := state.Ipsets[name]
             if ipset == nil {
-                return nil, fmt.Errorf("Ipset not found: %s", name)
+                return nil, parseErrorf(i+1, "Ipset not found: %s", name)
             }
 
             ipset.Members = append(ipset.Members, strings.Join(fields[2:], " "))
         } else {
-            return nil, fmt.Errorf("Error parsing line: %s", line)
+            return nil, parseErrorf(i+1, "Error parsing line: %s", line)
         }
     }
 
@@ -152,7 +155,7 @@ func parseIpset(spec string) (*IpsetState, error) {
     return state, nil
 }
 
-func ipsetRestore(conf string, merge bool) (err error) {
+func ipsetRestore(runtime *Runtime, conf string, merge bool) (err error) {
     cmd := exec.Command("/usr/sbin/ipset", "restore")
     if merge {
         cmd.Args = append(cmd.Args, "-exist")
@@ -165,7 +168,7 @@ func ipsetRestore(conf string, merge bool) (err error) {
     //	defer f.Close()
     cmd.Stdin = bytes.NewBufferString(conf)
 
-    _, err = Execute(cmd)
+    _, err = Execute(cmd, runtime.retryPolicy())
     if err != nil {
         return err
     }
@@ -173,10 +176,10 @@ func ipsetRestore(conf string, merge bool) (err error) {
     return nil
 }
 
-func ipsetSwap(a, b string) (err error) {
+func ipsetSwap(runtime *Runtime, a, b string) (err error) {
     cmd := exec.Command("/usr/sbin/ipset", "swap", a, b)
 
-    _, err = Execute(cmd)
+    _, err = Execute(cmd, runtime.retryPolicy())
     if err != nil {
         return err
     }
@@ -184,10 +187,10 @@ func ipsetSwap(a, b string) (err error) {
     return nil
 }
 
-func ipsetDestroy(name string) (err error) {
+func ipsetDestroy(runtime *Runtime, name string) (err error) {
     cmd := exec.Command("/usr/sbin/ipset", "destroy", name)
 
-    _, err = Execute(cmd)
+    _, err = Execute(cmd, runtime.retryPolicy())
     if err != nil {
         return err
     }
@@ -195,22 +198,23 @@ func ipsetDestroy(name string) (err error) {
     return nil
 }
 
+func (s *IpsetState) names() []string {
+    names := []string{}
+    for name, _ := range s.Ipsets {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
 func (*IpsetManager) createFiles(state *IpsetState, basedir string) error {
-    for name, ipset := range state.Ipsets {
+    for _, name := range state.names() {
+        ipset := state.Ipsets[name]
         path := basedir + "/" + name
 
         conf := ipset.buildConf(nil)
 
-        f, err := gommons.TryReadTextFile(path, "")
-        if err != nil {
-            return err
-        }
-
-        if f == conf {
-            continue
-        }
-
-        err = ioutil.WriteFile(path, []byte(conf), 0700)
+        err := writeTextFile(path, conf)
         if err != nil {
             return err
         }
@@ -227,7 +231,7 @@ func readIpsetFile(name string, path string) (state *Ipset, err error) {
 
     ipsetState, err := parseIpset(text)
     if err != nil {
-        return nil, err
+        return nil, fileError(path, 0, err)
     }
 
     if len(ipsetState.Ipsets) > 1 {
@@ -242,7 +246,7 @@ func readIpsetFile(name string, path string) (state *Ipset, err error) {
     return ipset, nil
 }
 
-func (s *Ipset) apply(usetemp bool) (err error) {
+func (s *Ipset) apply(runtime *Runtime, usetemp bool) (err error) {
     // We can't merge; otherwise we can't delete entries
     // We can't delete in case it is in use
 
@@ -255,24 +259,24 @@ func (s *Ipset) apply(usetemp bool) (err error) {
 
         conf := s.buildConf(&tmpname)
 
-        err = ipsetRestore(conf, false)
+        err = ipsetRestore(runtime, conf, false)
         if err != nil {
             return err
         }
 
-        err = ipsetSwap(tmpname, s.Name)
+        err = ipsetSwap(runtime, tmpname, s.Name)
         if err != nil {
             return err
         }
 
-        err = ipsetDestroy(tmpname)
+        err = ipsetDestroy(runtime, tmpname)
         if err != nil {
             return err
         }
     } else {
         conf := s.buildConf(nil)
 
-        err = ipsetRestore(conf, false)
+        err = ipsetRestore(runtime, conf, false)
         if err != nil {
             return err
         }
@@ -281,13 +285,15 @@ func (s *Ipset) apply(usetemp bool) (err error) {
     return nil
 }
 
-func (s *IpsetManager) ipsetApply(state *IpsetState, basedir string) error {
+func (s *IpsetManager) plan(state *IpsetState, basedir string) (*Plan, error) {
     files, err := gommons.ListDirectoryNames(basedir)
     if err != nil {
         log.Printf("ipset: Error listing files in dir %s: %v", basedir, err)
-        return err
+        return nil, err
     }
 
+    plan := &Plan{}
+
     existingIpsets := make(map[string]*Ipset)
 
     for k, v := range state.Ipsets {
@@ -299,9 +305,15 @@ func (s *IpsetManager) ipsetApply(state *IpsetState, basedir string) error {
 
         fileIpset, err := readIpsetFile(key, path)
         if err != nil {
-            return err
+            return nil, err
         }
 
+        change := &Change{}
+        change.Manager = "ipset"
+        change.Key = key
+        change.Action = ActionAdd
+        change.Desired = fileIpset.buildConf(nil)
+
         existingIpset := existingIpsets[key]
         if existingIpset != nil {
             delete(existingIpsets, key)
@@ -310,13 +322,46 @@ func (s *IpsetManager) ipsetApply(state *IpsetState, basedir string) error {
                 log.Printf("Configuration match: %s", key)
                 continue
             }
+
+            change.Action = ActionChange
+            change.Current = existingIpset.buildConf(nil)
         }
 
-        // Configuration needs to be applied
-        log.Printf("ipset: Applying changed configuration from disk: %s", key)
+        plan.add(change)
+
+        if existingIpset == nil {
+            // Nothing can reference a new set yet, so creating it changes no traffic.
+            // We create it before the firewall preflight, so iptables-restore --test can see it,
+            // and destroy it again if any preflight fails.
+            created := false
+            plan.addPreflight(func() error {
+                log.Printf("ipset: Creating %s", fileIpset.Name)
+
+                err := fileIpset.apply(s.runtime, false)
+                if err != nil {
+                    return err
+                }
+                created = true
+                return nil
+            })
+            plan.addCleanup(func() error {
+                if !created {
+                    return nil
+                }
+
+                log.Printf("ipset: Destroying %s, created for the failed preflight", fileIpset.Name)
+
+                return ipsetDestroy(s.runtime, fileIpset.Name)
+            })
+            continue
+        }
 
-        usetemp := existingIpset != nil
-        fileIpset.apply(usetemp)
+        plan.addAction(func() error {
+            // Configuration needs to be applied
+            log.Printf("ipset: Applying changed configuration from disk: %s", fileIpset.Name)
+
+            return fileIpset.apply(s.runtime, true)
+        })
     }
 
     for k, _ := range existingIpsets {
@@ -324,11 +369,11 @@ func (s *IpsetManager) ipsetApply(state *IpsetState, basedir string) error {
         log.Printf("ipset: Ignoring %s", k)
     }
 
-    return nil
+    return plan, nil
 }
 
 func (s *IpsetManager) Save(basedir string) (err error) {
-    ipsetState, err := ipsetSave(nil)
+    ipsetState, err := ipsetSave(s.runtime, nil)
     if err != nil {
         return err
     }
@@ -346,27 +391,93 @@ func (s *IpsetManager) Save(basedir string) (err error) {
     return nil
 }
 
-func (s *IpsetManager) Apply(basedir string) (err error) {
+func (s *IpsetManager) Plan(basedir string) (*Plan, error) {
     isdir, err := gommons.IsDirectory(basedir)
 
     if err != nil {
-        return err
+        return nil, err
     }
 
     if !isdir {
         log.Printf("ipset: Directory not found; skipping %s", basedir)
-        return nil
+        return &Plan{}, nil
     }
 
-    ipsetState, err := ipsetSave(nil)
+    ipsetState, err := ipsetSave(s.runtime, nil)
     if err != nil {
-        return err
+        return nil, err
     }
 
-    err = s.ipsetApply(ipsetState, basedir)
+    return s.plan(ipsetState, basedir)
+}
+
+// readDesired reads the ipsets declared in basedir, without looking at the kernel
+func (s *IpsetManager) readDesired(basedir string) (*IpsetState, error) {
+    state := &IpsetState{}
+    state.Ipsets = make(map[string]*Ipset)
+
+    isdir, err := gommons.IsDirectory(basedir)
+    if err != nil {
+        return nil, err
+    }
+
+    if !isdir {
+        return state, nil
+    }
+
+    files, err := gommons.ListDirectoryNames(basedir)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, file := range files {
+        ipset, err := readIpsetFile(file, basedir+"/"+file)
+        if err != nil {
+            return nil, err
+        }
+        state.Ipsets[file] = ipset
+    }
+
+    return state, nil
+}
+
+// names returns the ipsets that exist, or that will once basedir is applied
+func (s *IpsetManager) names(basedir string) (map[string]bool, error) {
+    names := make(map[string]bool)
+
+    state, err := ipsetSave(s.runtime, nil)
+    if err != nil {
+        return nil, err
+    }
+
+    for name, _ := range state.Ipsets {
+        names[name] = true
+    }
+
+    isdir, err := gommons.IsDirectory(basedir)
+    if err != nil {
+        return nil, err
+    }
+
+    if isdir {
+        files, err := gommons.ListDirectoryNames(basedir)
+        if err != nil {
+            return nil, err
+        }
+
+        for _, file := range files {
+            names[file] = true
+        }
+    }
+
+    return names, nil
+}
+
+func (s *IpsetManager) Apply(basedir string) (err error) {
+    plan, err := s.Plan(basedir)
     if err != nil {
         return err
     }
 
-    return nil
+    return plan.Apply()
 }
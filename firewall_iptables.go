@@ -5,14 +5,18 @@ import (
     "fmt"
     "github.com/fathomdb/gommons"
     "io"
-    "io/ioutil"
     "log"
     "os"
     "os/exec"
+    "regexp"
+    "sort"
+    "strconv"
     "strings"
 )
 
 type IptablesManager struct {
+    runtime *Runtime
+
     Ipv6 bool
 }
 
@@ -30,14 +34,17 @@ type IptablesChain struct {
     Name    string
     Default string
     Rules   []*IptablesRule
-}
 
-type IptablesRule struct {
-    Spec string
+    // Where the default was declared, for chains read from apply.d
+    DefaultSource string
+
+    // The policy counters; only builtin chains have them
+    Counters IptablesCounters
 }
 
 func NewIptablesManager(firewall *FirewallManager, ipv6 bool) *IptablesManager {
     p := &IptablesManager{}
+    p.runtime = firewall.runtime
     p.Ipv6 = ipv6
     return p
 }
@@ -63,10 +70,6 @@ func (s *IptablesChain) normalize(ipv6 bool) (err error) {
         s.Default = "-"
     }
 
-    for _, rule := range s.Rules {
-        rule.normalize(ipv6)
-    }
-
     return nil
 }
 
@@ -79,122 +82,59 @@ func indexOf(haystack []string, needle string) (position int) {
     return -1
 }
 
-func (s *IptablesRule) normalize(ipv6 bool) (err error) {
-    fields := strings.Fields(s.Spec)
-
-    sortkeys := []string{"-p", "-m", "-i", "-o", "-d", "--dport", "-s", "-j"}
-    sortmap := make(map[string]string)
-
-    i := 0
-    negated := false
-    for i < len(fields) {
-        f := fields[i]
-
-        if f == "!" {
-            negated = true
-            fields[i] = ""
-            continue
-        }
-
-        if indexOf(sortkeys, f) != -1 {
-            if (i + 1) < len(fields) {
-                if negated {
-                    sortmap[f] = "! " + fields[i+1]
-                    negated = false
-                } else {
-                    sortmap[f] = fields[i+1]
-                }
-
-                fields[i] = ""
-                fields[i+1] = ""
-
-                i++
-            }
-        }
+// Built-in tables and chains are written in kernel (hook priority) order, then user chains by name,
+// so that saved files and plans are stable from run to run
+var iptablesTableOrder = []string{"raw", "mangle", "nat", "filter", "security"}
+var iptablesChainOrder = []string{"PREROUTING", "INPUT", "FORWARD", "OUTPUT", "POSTROUTING"}
 
-        if negated {
-            return fmt.Errorf("Cannot parse rule: %s", s.Spec)
+// canonicalNames returns the names without duplicates, the built-in names first in their order and then the rest by name
+func canonicalNames(names []string, builtin []string) []string {
+    seen := make(map[string]bool)
+    unique := []string{}
+    for _, name := range names {
+        if !seen[name] {
+            seen[name] = true
+            unique = append(unique, name)
         }
-
-        i++
-    }
-
-    // Normalize protocol
-    protocol := sortmap["-p"]
-    if protocol == "icmpv6" {
-        sortmap["-p"] = "ipv6-icmp"
     }
+    names = unique
 
-    // Normalize addresses
-    for _, addrkey := range []string{"-d", "-s"} {
-        addr := sortmap[addrkey]
-        if addr == "" {
-            continue
+    sort.Slice(names, func(i, j int) bool {
+        a := indexOf(builtin, names[i])
+        b := indexOf(builtin, names[j])
+        if a == -1 {
+            a = len(builtin)
         }
-
-        if !strings.Contains(addr, "/") {
-            if ipv6 {
-                addr = addr + "/128"
-            } else {
-                addr = addr + "/32"
-            }
-        }
-
-        ignore := false
-        if addr == "0.0.0.0/0" {
-            ignore = true
-        }
-
-        if addr == "::/0" {
-            ignore = true
-        }
-
-        if ignore {
-            delete(sortmap, addrkey)
-        } else {
-            sortmap[addrkey] = addr
-        }
-    }
-
-    // Remove any empty strings
-    f2 := make([]string, len(fields))
-    i = 0
-    for _, f := range fields {
-        if f == "" {
-            continue
+        if b == -1 {
+            b = len(builtin)
         }
-        f2[i] = f
-        i++
-    }
-
-    spec := ""
-
-    // Add the keys in order
-    for _, key := range sortkeys {
-        v := sortmap[key]
-        if v == "" {
-            continue
+        if a != b {
+            return a < b
         }
+        return names[i] < names[j]
+    })
+    return names
+}
 
-        spec = spec + " " + key + " " + v
-        delete(sortmap, key)
+func (s *IptablesState) tableNames() []string {
+    names := []string{}
+    for name, _ := range s.Tables {
+        names = append(names, name)
     }
+    return canonicalNames(names, iptablesTableOrder)
+}
 
-    // Add any negated keys
-    for key, v := range sortmap {
-        spec = spec + " " + key + " " + v
+func (s *IptablesTable) chainNames() []string {
+    names := []string{}
+    for name, _ := range s.Chains {
+        names = append(names, name)
     }
-
-    spec = spec + " " + strings.Join(f2[0:i], " ")
-    s.Spec = strings.Trim(spec, " ")
-
-    //fmt.Println(s.Spec)
-
-    return nil
+    return canonicalNames(names, iptablesChainOrder)
 }
 
 func (s *IptablesState) writeConf(w io.Writer) (err error) {
-    for _, table := range s.Tables {
+    for _, name := range s.tableNames() {
+        table := s.Tables[name]
         err = table.writeConf(w)
         if err != nil {
             return err
@@ -222,15 +162,17 @@ func (s *IptablesTable) writeConf(w io.Writer) (err error) {
         return err
     }
 
-    for _, chain := range s.Chains {
-        err = chain.writeConfDefault(w)
+    names := s.chainNames()
+
+    for _, name := range names {
+        err = s.Chains[name].writeConfDefault(w)
         if err != nil {
             return err
         }
     }
 
-    for _, chain := range s.Chains {
-        err = chain.writeConfRules(w)
+    for _, name := range names {
+        err = s.Chains[name].writeConfRules(w)
         if err != nil {
             return err
         }
@@ -277,15 +219,31 @@ func (s *IptablesRule) writeConf(chain string, w io.Writer) (err error) {
     return nil
 }
 
-func iptablesSave(ipv6 bool) (*IptablesState, error) {
-    name := "/sbin/iptables-save"
+// splitRuleLine splits an -A line into the chain and the rule, returning "" if there is no chain.
+// The rule is everything after the chain's token, however the line is spaced.
+func splitRuleLine(line string) (string, string) {
+    rest := strings.TrimSpace(strings.TrimPrefix(line, "-A"))
+    fields := strings.Fields(rest)
+    if len(fields) < 1 {
+        return "", ""
+    }
+    return fields[0], strings.TrimSpace(rest[len(fields[0]):])
+}
+
+func iptablesSave(runtime *Runtime, ipv6 bool) (*IptablesState, error) {
+    name, err := runtime.iptablesCommand(ipv6, "save")
+    if err != nil {
+        return nil, err
+    }
+
+    key := "iptables-save"
     if ipv6 {
-        name = "/sbin/ip6tables-save"
+        key = "ip6tables-save"
     }
 
-    cmd := exec.Command(name)
+    cmd := exec.Command(name, "-c")
 
-    output, err := Execute(cmd)
+    output, err := runtime.query(key, cmd)
     if err != nil {
         return nil, err
     }
@@ -300,16 +258,30 @@ func parseIptablesSave(ipv6 bool, spec string) (*IptablesState, error) {
 
     var currentTable *IptablesTable
 
-    for _, line := range strings.Split(spec, "\n") {
+    ordering := &iptablesOrderParser{}
+
+    for i, line := range strings.Split(spec, "\n") {
         if line == "" {
             continue
         }
 
         if strings.HasPrefix(line, "#") {
+            _, err := ordering.directive(line)
+            if err != nil {
+                return nil, parseErrorf(i+1, "%v", err)
+            }
             continue
         }
 
+        // iptables-save -c prefixes each rule with its counters
+        counters, line, err := splitIptablesCounters(line)
+        if err != nil {
+            return nil, parseErrorf(i+1, "%v", err)
+        }
+
         if strings.HasPrefix(line, "*") {
+            ordering.reset()
+
             name := line[1:]
 
             table := state.Tables[name]
@@ -322,18 +294,18 @@ func parseIptablesSave(ipv6 bool, spec string) (*IptablesState, error) {
 
                 currentTable = table
             } else {
-                return nil, fmt.Errorf("Duplicate table: %s", name)
+                return nil, parseErrorf(i+1, "Duplicate table: %s", name)
             }
         } else if strings.HasPrefix(line, ":") {
             fields := strings.Fields(line[1:])
             if len(fields) < 2 {
-                return nil, fmt.Errorf("Error parsing line: %s", line)
+                return nil, parseErrorf(i+1, "Error parsing line: %s", line)
             }
 
             name := fields[0]
 
             if currentTable == nil {
-                return nil, fmt.Errorf("No current table at line: %s", line)
+                return nil, parseErrorf(i+1, "No current table at line: %s", line)
             }
 
             chain := currentTable.Chains[name]
@@ -342,20 +314,26 @@ func parseIptablesSave(ipv6 bool, spec string) (*IptablesState, error) {
                 chain.Name = name
                 chain.Default = fields[1]
 
+                if len(fields) >= 3 {
+                    policy, err := parseIptablesCounters(fields[2])
+                    if err != nil {
+                        return nil, parseErrorf(i+1, "%v", err)
+                    }
+                    chain.Counters = policy
+                }
+
                 currentTable.Chains[name] = chain
             } else {
-                return nil, fmt.Errorf("Duplicate chain: %s", name)
+                return nil, parseErrorf(i+1, "Duplicate chain: %s", name)
             }
         } else if strings.HasPrefix(line, "-A ") {
-            fields := strings.Fields(line[3:])
-            if len(fields) < 1 {
-                return nil, fmt.Errorf("Error parsing line: %s", line)
+            name, spec := splitRuleLine(line)
+            if name == "" {
+                return nil, parseErrorf(i+1, "Error parsing line: %s", line)
             }
 
-            name := fields[0]
-
             if currentTable == nil {
-                return nil, fmt.Errorf("No current table at line: %s", line)
+                return nil, parseErrorf(i+1, "No current table at line: %s", line)
             }
 
             chain := currentTable.Chains[name]
@@ -366,17 +344,28 @@ func parseIptablesSave(ipv6 bool, spec string) (*IptablesState, error) {
                 currentTable.Chains[name] = chain
             }
 
-            rule := &IptablesRule{}
-            rule.Spec = strings.Join(fields[1:], " ")
+            rules, err := parseIptablesRule(ipv6, spec)
+            if err != nil {
+                return nil, parseErrorf(i+1, "%v", err)
+            }
+
+            order := ordering.rule()
+            for _, rule := range rules {
+                rule.Line = i + 1
+                rule.Order = order
+                rule.Counters = counters
+            }
 
-            chain.Rules = append(chain.Rules, rule)
+            chain.Rules = append(chain.Rules, rules...)
         } else if line == "COMMIT" {
+            ordering.reset()
+
             if currentTable == nil {
-                return nil, fmt.Errorf("Unexpected COMMIT found")
+                return nil, parseErrorf(i+1, "Unexpected COMMIT found")
             }
             currentTable = nil
         } else {
-            return nil, fmt.Errorf("Error parsing line: %s", line)
+            return nil, parseErrorf(i+1, "Error parsing line: %s", line)
         }
     }
 
@@ -388,16 +377,17 @@ func parseIptablesSave(ipv6 bool, spec string) (*IptablesState, error) {
     return state, nil
 }
 
-func iptablesRestore(ipv6 bool, conf string) (err error) {
-    name := "/sbin/iptables-restore"
-    if ipv6 {
-        name = "/sbin/ip6tables-restore"
+func iptablesRestore(runtime *Runtime, ipv6 bool, conf string, args ...string) (err error) {
+    name, err := runtime.iptablesCommand(ipv6, "restore")
+    if err != nil {
+        return err
     }
-    cmd := exec.Command(name)
+
+    cmd := exec.Command(name, append(runtime.xtablesWaitArgs(), args...)...)
 
     cmd.Stdin = bytes.NewBufferString(conf)
 
-    _, err = Execute(cmd)
+    _, err = Execute(cmd, runtime.retryPolicy())
     if err != nil {
         return err
     }
@@ -405,68 +395,115 @@ func iptablesRestore(ipv6 bool, conf string) (err error) {
     return nil
 }
 
-func (s *IptablesManager) Save(basedir string) (err error) {
-    state, err := iptablesSave(s.Ipv6)
+var iptablesRestoreFailedLine = regexp.MustCompile(`line:? (\d+)`)
+
+// preflight runs the configuration through iptables-restore --test, so that a bad rule fails before anything changes.
+// If iptables-restore reports the line, we report the file the rule came from.
+func (s *IptablesManager) preflight(desired *IptablesState, conf string, args ...string) error {
+    name, err := s.runtime.iptablesCommand(s.Ipv6, "restore")
     if err != nil {
         return err
     }
 
-    err = os.MkdirAll(basedir, 0700)
-    if err != nil {
-        return err
+    cmd := exec.Command(name, append(append([]string{"--test"}, s.runtime.xtablesWaitArgs()...), args...)...)
+    cmd.Stdin = bytes.NewBufferString(conf)
+
+    output, err := Execute(cmd, s.runtime.retryPolicy())
+    if err == nil {
+        return nil
     }
 
-    err = s.createFiles(state, basedir)
-    if err != nil {
-        return err
+    message := strings.TrimSpace(string(output))
+    if message == "" {
+        message = err.Error()
     }
 
-    return nil
+    match := iptablesRestoreFailedLine.FindStringSubmatch(message)
+    if match != nil {
+        n, _ := strconv.Atoi(match[1])
+        rule := desired.findRule(conf, n)
+        if rule != nil && rule.Source != "" {
+            return fileError(rule.Source, rule.Line, fmt.Errorf("Rule rejected by %s --test: %s", s.command(), message))
+        }
+    }
+
+    return fmt.Errorf("Configuration rejected by %s --test: %s", s.command(), message)
 }
 
-func (s *IptablesManager) Apply(basedir string) (err error) {
-    isdir, err := gommons.IsDirectory(basedir)
-    if err != nil {
-        return err
+// findRule returns the rule rendered at line n (1-based) of conf
+func (s *IptablesState) findRule(conf string, n int) *IptablesRule {
+    lines := strings.Split(conf, "\n")
+    if n < 1 || n > len(lines) {
+        return nil
     }
 
-    if !isdir {
-        log.Printf("iptables: Directory not found; skipping %s", basedir)
+    _, line, err := splitIptablesCounters(lines[n-1])
+    if err != nil || !strings.HasPrefix(line, "-A ") {
         return nil
     }
 
-    current, err := iptablesSave(s.Ipv6)
-    if err != nil {
-        return err
+    name, spec := splitRuleLine(line)
+    if name == "" {
+        return nil
     }
 
-    err = s.apply(current, basedir)
-    if err != nil {
-        return err
+    for _, table := range s.Tables {
+        chain := table.Chains[name]
+        if chain == nil {
+            continue
+        }
+        for _, rule := range chain.Rules {
+            if rule.Spec == spec {
+                return rule
+            }
+        }
     }
 
     return nil
 }
 
-func (*IptablesManager) createFiles(state *IptablesState, basedir string) error {
-    var path string
-    path = basedir + "/10-saved"
+// checkIpsets verifies that every ipset the rules reference is known
+func (s *IptablesState) checkIpsets(ipsets map[string]bool) error {
+    for _, table := range s.Tables {
+        for _, chain := range table.Chains {
+            for _, rule := range chain.Rules {
+                for _, name := range rule.ipsets() {
+                    if ipsets[name] {
+                        continue
+                    }
+
+                    err := fmt.Errorf("Ipset not found: %s", name)
+                    if rule.Source != "" {
+                        err = fileError(rule.Source, rule.Line, err)
+                    }
+                    return err
+                }
+            }
+        }
+    }
 
-    conf, err := state.conf()
+    return nil
+}
+
+func (s *IptablesManager) Save(basedir string) (err error) {
+    state, err := iptablesSave(s.runtime, s.Ipv6)
     if err != nil {
         return err
     }
 
-    f, err := gommons.TryReadTextFile(path, "")
+    // Provenance refers to the files the rules came from, which the saved files replace
+    state.stripSourceTags()
+
+    err = os.MkdirAll(basedir, 0700)
     if err != nil {
         return err
     }
 
-    if f == conf {
-        return nil
+    if s.runtime.Config.IptablesSaveLayout == IptablesLayoutSplit {
+        err = s.createSplitFiles(state, basedir)
+    } else {
+        err = s.createFiles(state, basedir)
     }
-
-    err = ioutil.WriteFile(path, []byte(conf), 0700)
     if err != nil {
         return err
     }
@@ -474,78 +511,57 @@ func (*IptablesManager) createFiles(state *IptablesState, basedir string) error
     return nil
 }
 
-func readIptablesFile(ipv6 bool, path string) (state *IptablesState, err error) {
-    text, err := gommons.TryReadTextFile(path, "")
+func (s *IptablesManager) Plan(basedir string) (*Plan, error) {
+    found, err := s.hasConfiguration(basedir)
     if err != nil {
         return nil, err
     }
 
-    state, err = parseIptablesSave(ipv6, text)
+    if !found {
+        log.Printf("%s: Directory not found; skipping %s", s.command(), basedir)
+        return &Plan{}, nil
+    }
+
+    current, err := iptablesSave(s.runtime, s.Ipv6)
     if err != nil {
         return nil, err
     }
 
-    return state, nil
+    return s.plan(current, basedir)
 }
 
-func (s *IptablesState) apply() (err error) {
-    conf, err := s.conf()
-    if err != nil {
-        return err
-    }
-
-    err = iptablesRestore(s.Ipv6, conf)
+func (s *IptablesManager) Apply(basedir string) (err error) {
+    plan, err := s.Plan(basedir)
     if err != nil {
         return err
     }
 
-    return nil
+    return plan.Apply()
 }
 
-func (a *IptablesState) matches(b *IptablesState) bool {
-    if a.Ipv6 != b.Ipv6 {
-        return false
-    }
-
-    if len(a.Tables) != len(b.Tables) {
-        return false
-    }
-
-    for k, av := range a.Tables {
-        bv, exists := b.Tables[k]
-        if !exists {
-            return false
-        }
+func (*IptablesManager) createFiles(state *IptablesState, basedir string) error {
+    var path string
+    path = basedir + "/10-saved"
 
-        if !av.matches(bv) {
-            return false
-        }
+    conf, err := state.conf()
+    if err != nil {
+        return err
     }
 
-    return true
+    return writeTextFile(path, conf)
 }
 
-func (a *IptablesTable) matches(b *IptablesTable) bool {
-    if a.Name != b.Name {
-        return false
-    }
-
-    if len(a.Chains) != len(b.Chains) {
-        return false
-    }
-
-    for k, av := range a.Chains {
-        bv, exists := b.Chains[k]
-        if !exists {
-            return false
-        }
-
-        if !av.matches(bv) {
-            return false
+func (s *IptablesState) setSource(path string) {
+    for _, table := range s.Tables {
+        for _, chain := range table.Chains {
+            if chain.Default != "-" {
+                chain.DefaultSource = path
+            }
+            for _, rule := range chain.Rules {
+                rule.Source = path
+            }
         }
     }
-
-    return true
 }
 
 func (a *IptablesChain) matches(b *IptablesChain) bool {
@@ -580,7 +596,64 @@ func (a *IptablesRule) matches(b *IptablesRule) bool {
     return true
 }
 
-func (a *IptablesState) merge(b *IptablesState) error {
+// diff returns a change for every chain that differs between the two states, in the tables desired declares.
+// iptables-restore only replaces the tables it is given, so tables only in the kernel are left alone.
+func (desired *IptablesState) diff(current *IptablesState) []*Change {
+    changes := []*Change{}
+
+    for _, k := range desired.tableNames() {
+        dv := desired.Tables[k]
+        cv := current.Tables[k]
+        if cv == nil {
+            cv = &IptablesTable{Name: k}
+        }
+        changes = append(changes, dv.diff(cv)...)
+    }
+
+    return changes
+}
+
+func (desired *IptablesTable) diff(current *IptablesTable) []*Change {
+    changes := []*Change{}
+
+    for _, k := range canonicalNames(append(desired.chainNames(), current.chainNames()...), iptablesChainOrder) {
+        dv := desired.Chains[k]
+        cv := current.Chains[k]
+
+        change := &Change{}
+        change.Key = desired.Name + "/" + k
+
+        if dv == nil {
+            change.Action = ActionRemove
+            change.Current = cv.describeAgainst(nil, "removed")
+        } else if cv == nil {
+            change.Action = ActionAdd
+            change.Desired = dv.describeAgainst(nil, "added")
+        } else if !dv.matches(cv) {
+            change.Action = ActionChange
+            change.Current = cv.describeAgainst(dv, "removed")
+            change.Desired = dv.describeAgainst(cv, "added")
+        } else {
+            continue
+        }
+
+        changes = append(changes, change)
+    }
+
+    return changes
+}
+
+func (s *IptablesChain) describe() string {
+    var buffer bytes.Buffer
+
+    s.writeConfDefault(&buffer)
+    s.writeConfRules(&buffer)
+
+    return buffer.String()
+}
+
+// merge adds b to a; in strict mode, conflicting chain defaults are an error
+func (a *IptablesState) merge(b *IptablesState, strict bool) error {
     if a.Ipv6 != b.Ipv6 {
         return fmt.Errorf("Cannot merge IPv4 & IPv6 tables")
     }
@@ -590,7 +663,7 @@ func (a *IptablesState) merge(b *IptablesState) error {
         if av == nil {
             a.Tables[k] = bv
         } else {
-            err := av.merge(bv)
+            err := av.merge(bv, strict)
             if err != nil {
                 return err
             }
@@ -600,7 +673,7 @@ func (a *IptablesState) merge(b *IptablesState) error {
     return nil
 }
 
-func (a *IptablesTable) merge(b *IptablesTable) error {
+func (a *IptablesTable) merge(b *IptablesTable, strict bool) error {
     if a.Name != b.Name {
         return fmt.Errorf("Mismatch in merge")
     }
@@ -610,7 +683,7 @@ func (a *IptablesTable) merge(b *IptablesTable) error {
         if av == nil {
             a.Chains[k] = bv
         } else {
-            err := av.merge(bv)
+            err := av.merge(bv, strict)
             if err != nil {
                 return err
             }
@@ -620,7 +693,7 @@ func (a *IptablesTable) merge(b *IptablesTable) error {
     return nil
 }
 
-func (a *IptablesChain) merge(b *IptablesChain) error {
+func (a *IptablesChain) merge(b *IptablesChain, strict bool) error {
     if a.Name != b.Name {
         return fmt.Errorf("Mismatch in merge")
     }
@@ -628,14 +701,17 @@ func (a *IptablesChain) merge(b *IptablesChain) error {
     if a.Default != b.Default {
         if a.Default == "" || a.Default == "-" {
             a.Default = b.Default
+            a.DefaultSource = b.DefaultSource
         } else if b.Default == "" || b.Default == "-" {
             // Keep what we've got
+        } else if strict {
+            return fmt.Errorf("Conflicting defaults for chain %s: %s (%s) vs %s (%s)", a.Name, a.Default, a.DefaultSource, b.Default, b.DefaultSource)
         } else {
-            // TODO: Not entirely clear what we should do here
             log.Printf("Merging different defaults for chain: %s (%s vs %s)", a.Name, a.Default, b.Default)
 
-            // We just allow overwriting
+            // The later file wins
             a.Default = b.Default
+            a.DefaultSource = b.DefaultSource
         }
     }
 
@@ -655,57 +731,168 @@ func (s *IptablesManager) command() string {
     return "iptables"
 }
 
-func (s *IptablesManager) apply(current *IptablesState, basedir string) error {
-    files, err := gommons.ListDirectoryNames(basedir)
+// hasConfiguration returns true if there is a directory for this family, or a dual-stack, policy or nat directory
+func (s *IptablesManager) hasConfiguration(basedir string) (bool, error) {
+    for _, dir := range []string{basedir, dualStackDir(basedir), policyDir(basedir), natDir(basedir)} {
+        isdir, err := gommons.IsDirectory(dir)
+        if err != nil {
+            return false, err
+        }
+        if isdir {
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+func (s *IptablesManager) readDesired(basedir string) (*IptablesState, error) {
+    desired, err := s.readDualStack(basedir)
     if err != nil {
-        log.Printf("Error listing files in dir %s: %v", basedir, err)
-        return err
+        return nil, err
     }
 
-    var desired *IptablesState
+    policy, err := s.readPolicy(basedir)
+    if err != nil {
+        return nil, err
+    }
 
-    for _, file := range files {
-        path := basedir + "/" + file
+    nat, err := s.readNat(basedir)
+    if err != nil {
+        return nil, err
+    }
 
-        state, err := readIptablesFile(current.Ipv6, path)
-        if err != nil {
-            return err
+    for _, state := range []*IptablesState{policy, nat} {
+        if state == nil {
+            continue
         }
 
-        //		c, _ := state.conf()
-        //		log.Printf("Loaded %s; %v", path, c)
+        if desired == nil {
+            desired = state
+        } else {
+            err = desired.merge(state, s.runtime.Config.Strict)
+            if err != nil {
+                return nil, err
+            }
+        }
+    }
+
+    isdir, err := gommons.IsDirectory(basedir)
+    if err != nil {
+        return nil, err
+    }
+
+    if !isdir {
+        return desired, nil
+    }
+
+    sources, err := listIptablesSources(basedir)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, source := range sources {
+        state, err := source.read(s.Ipv6)
+        if err != nil {
+            return nil, err
+        }
 
         if desired == nil {
             desired = state
         } else {
-            desired.merge(state)
+            err = desired.merge(state, s.runtime.Config.Strict)
+            if err != nil {
+                return nil, err
+            }
         }
+    }
 
-        //		c, _ = desired.conf()
-        //		log.Printf("merged %v", c)
+    if desired != nil {
+        err = desired.order()
+        if err != nil {
+            return nil, err
+        }
     }
 
-    if desired == nil {
-        log.Printf("%s: No configuration found", s.command())
+    if desired != nil && s.runtime.Config.IptablesCommentSource {
+        desired.tagSources()
+    }
+
+    if desired != nil && s.runtime.Config.IptablesScope == IptablesScopeChains {
+        s.tagOwnedRules(desired)
+    }
+
+    return desired, nil
+}
+
+func (s *IptablesManager) checkIpsets(basedir string, ipsets map[string]bool) error {
+    found, err := s.hasConfiguration(basedir)
+    if err != nil {
+        return err
+    }
+
+    if !found {
         return nil
     }
 
-    if desired.matches(current) {
-        //log.Printf("%s: Configuration matches", s.command())
+    desired, err := s.readDesired(basedir)
+    if err != nil {
+        return err
+    }
+
+    if desired == nil {
         return nil
     }
 
-    {
-        c, _ := current.conf()
-        log.Printf("Old configuration %s", c)
+    return desired.checkIpsets(ipsets)
+}
+
+func (s *IptablesManager) plan(current *IptablesState, basedir string) (*Plan, error) {
+    plan := &Plan{}
+
+    desired, err := s.readDesired(basedir)
+    if err != nil {
+        return nil, err
+    }
+
+    if desired == nil {
+        log.Printf("%s: No configuration found", s.command())
+        return plan, nil
+    }
+
+    if s.runtime.Config.IptablesScope == IptablesScopeChains {
+        return s.planScoped(current, desired)
     }
 
-    {
-        c, _ := desired.conf()
-        log.Printf("New configuration %s", c)
+    // The restore runs only if there is a change to show for it
+    for _, change := range desired.diff(current) {
+        change.Manager = s.command()
+        plan.add(change)
     }
 
-    log.Printf("%s: Applying new configuration", s.command())
+    if plan.IsEmpty() {
+        return plan, nil
+    }
+
+    // Rules that are unchanged keep their counters
+    desired.copyCounters(current)
+    conf := desired.restoreConf()
+
+    plan.addPreflight(func() error {
+        return s.preflight(desired, conf, "--counters")
+    })
+
+    plan.addAction(func() error {
+        {
+            c, _ := current.conf()
+            log.Printf("Old configuration %s", c)
+        }
+
+        log.Printf("New configuration %s", conf)
+
+        log.Printf("%s: Applying new configuration", s.command())
+
+        return iptablesRestore(s.runtime, s.Ipv6, conf, "--counters")
+    })
 
-    return desired.apply()
+    return plan, nil
 }
@@ -0,0 +1,245 @@
+package applyd
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "os/exec"
+    "strconv"
+    "strings"
+)
+
+// Since iptables 1.8 there are two backends: legacy (the x_tables kernel interface) and nft (iptables rules stored
+// as nftables).  Each has its own tools, iptables-legacy-save and iptables-nft-save, and the plain iptables-save is
+// whichever the distribution selected.  Rules in the backend we don't use still filter packets, but we'd never see them.
+// So we look at which backends hold rules: in auto mode we manage the populated one, and we warn if both are.
+// iptables-backend in the config pins one.
+
+const (
+    IptablesBackendAuto   = "auto"
+    IptablesBackendLegacy = "legacy"
+    IptablesBackendNft    = "nft"
+)
+
+var iptablesBackends = []string{IptablesBackendLegacy, IptablesBackendNft}
+
+type IptablesBackendStatus struct {
+    // The backend of the plain iptables tools, or "" if we couldn't tell
+    Default string
+    // The backends whose own tools are installed
+    Available []string
+    // The backends holding rules, in either family
+    Populated []string
+    // The backend we manage, or "" to use the plain tools
+    Selected string
+    Pinned   bool
+    Warnings []string
+}
+
+// hasCommand returns true if the tool is installed; against a snapshot we find out when we look for its output
+func (s *Runtime) hasCommand(path string) bool {
+    if s.snapshot != nil {
+        return true
+    }
+    _, err := os.Stat(path)
+    return err == nil
+}
+
+// iptablesTool returns the path of an iptables tool (save or restore) for the backend, or the plain tool if backend is ""
+func iptablesTool(backend string, ipv6 bool, tool string) string {
+    name := "iptables"
+    if ipv6 {
+        name = "ip6tables"
+    }
+    if backend != "" {
+        name += "-" + backend
+    }
+    return "/sbin/" + name + "-" + tool
+}
+
+// parseIptablesVersion returns the backend from iptables-save --version, e.g. "iptables-save v1.8.7 (nf_tables)"
+func parseIptablesVersion(output string) string {
+    switch {
+    case strings.Contains(output, "(nf_tables)"):
+        return IptablesBackendNft
+    case strings.Contains(output, "(legacy)"):
+        return IptablesBackendLegacy
+    case strings.Contains(output, " v1."):
+        // Before 1.8 there was only the one
+        return IptablesBackendLegacy
+    }
+    return ""
+}
+
+// isPopulated returns true if the state has any rule, or a built-in chain that doesn't accept
+func (s *IptablesState) isPopulated() bool {
+    for _, table := range s.Tables {
+        for _, chain := range table.Chains {
+            if len(chain.Rules) != 0 {
+                return true
+            }
+            if isBuiltinChain(chain.Name) && chain.Default != "ACCEPT" {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func (s *IptablesBackendStatus) String() string {
+    text := "iptables backend: "
+    if s.Selected == "" {
+        text += "default tools"
+    } else {
+        text += s.Selected
+    }
+
+    if s.Pinned {
+        text += " (pinned)"
+    } else {
+        text += " (detected)"
+    }
+
+    populated := "none"
+    if len(s.Populated) != 0 {
+        populated = strings.Join(s.Populated, ", ")
+    }
+    text += "; rules in: " + populated
+
+    if s.Default != "" {
+        text += "; default tools use " + s.Default
+    }
+
+    return text
+}
+
+func (s *FirewallManager) detectIptablesBackend() (*IptablesBackendStatus, error) {
+    status := &IptablesBackendStatus{}
+
+    configured := s.runtime.Config.IptablesBackend
+
+    plain := iptablesTool("", false, "save")
+    if s.runtime.hasCommand(plain) {
+        output, err := s.runtime.query("iptables-version", exec.Command(plain, "--version"))
+        if err == nil {
+            status.Default = parseIptablesVersion(string(output))
+        }
+    }
+
+    for _, backend := range iptablesBackends {
+        ipv4 := iptablesTool(backend, false, "save")
+
+        available := s.runtime.hasCommand(ipv4)
+        if !available && backend != status.Default {
+            continue
+        }
+        if !available {
+            // The plain tools are this backend
+            ipv4 = plain
+        }
+
+        populated := false
+        for _, ipv6 := range []bool{false, true} {
+            key := "iptables-save " + backend
+            name := ipv4
+            if ipv6 {
+                key = "ip6tables-save " + backend
+                name = iptablesTool(backend, true, "save")
+                if !available {
+                    name = iptablesTool("", true, "save")
+                }
+            }
+
+            output, err := s.runtime.query(key, exec.Command(name, "-c"))
+            if err != nil {
+                log.Printf("iptables: Unable to read the %s backend: %v", backend, err)
+                continue
+            }
+
+            state, err := parseIptablesSave(ipv6, string(output))
+            if err != nil {
+                return nil, err
+            }
+            if state.isPopulated() {
+                populated = true
+            }
+        }
+
+        if available {
+            status.Available = append(status.Available, backend)
+        }
+        if populated {
+            status.Populated = append(status.Populated, backend)
+        }
+    }
+
+    if configured == IptablesBackendLegacy || configured == IptablesBackendNft {
+        status.Pinned = true
+        status.Selected = configured
+
+        if !containsString(status.Available, configured) && status.Default != configured {
+            return nil, fmt.Errorf("iptables-backend is %s, but %s is not installed", configured, iptablesTool(configured, false, "save"))
+        }
+
+        for _, backend := range status.Populated {
+            if backend != configured {
+                status.Warnings = append(status.Warnings, fmt.Sprintf("The %s backend also has rules, which applyd does not manage", backend))
+            }
+        }
+    } else {
+        switch len(status.Populated) {
+        case 0:
+            status.Selected = status.Default
+        case 1:
+            status.Selected = status.Populated[0]
+        default:
+            status.Selected = status.Default
+            if status.Selected == "" {
+                status.Selected = IptablesBackendNft
+            }
+            status.Warnings = append(status.Warnings, fmt.Sprintf("Both the legacy and nft backends have rules; managing %s (set iptables-backend to choose)", status.Selected))
+        }
+    }
+
+    for _, warning := range status.Warnings {
+        log.Printf("iptables: %s", warning)
+    }
+
+    return status, nil
+}
+
+// IptablesBackend returns the backend we manage, detecting it on first use
+func (s *FirewallManager) IptablesBackend() (*IptablesBackendStatus, error) {
+    if s.iptablesBackend == nil {
+        status, err := s.detectIptablesBackend()
+        if err != nil {
+            return nil, err
+        }
+        s.iptablesBackend = status
+    }
+    return s.iptablesBackend, nil
+}
+
+// xtablesWaitArgs makes iptables wait for the xtables lock, rather than failing while another process holds it
+func (s *Runtime) xtablesWaitArgs() []string {
+    if s.Config.XtablesWait == 0 {
+        return nil
+    }
+    return []string{"-w", strconv.Itoa(s.Config.XtablesWait)}
+}
+
+// iptablesCommand returns the path of the save or restore tool of the backend we manage
+func (s *Runtime) iptablesCommand(ipv6 bool, tool string) (string, error) {
+    status, err := s.Firewall.IptablesBackend()
+    if err != nil {
+        return "", err
+    }
+
+    backend := status.Selected
+    if !containsString(status.Available, backend) {
+        // Only the plain tools, which are the selected backend (or we couldn't tell)
+        backend = ""
+    }
+
+    return iptablesTool(backend, ipv6, tool), nil
+}
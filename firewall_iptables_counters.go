@@ -0,0 +1,149 @@
+package applyd
+
+import (
+    "bytes"
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// Packet and byte counters are read with iptables-save -c and restored with iptables-restore --counters,
+// so that rules which didn't change keep their counts when a chain is rewritten.
+// Counters are state, not configuration: they are never compared, and never written to apply.d.
+
+type IptablesCounters struct {
+    Packets uint64
+    Bytes   uint64
+}
+
+func (s *IptablesCounters) String() string {
+    return fmt.Sprintf("[%d:%d]", s.Packets, s.Bytes)
+}
+
+func parseIptablesCounters(s string) (IptablesCounters, error) {
+    counters := IptablesCounters{}
+
+    if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+        return counters, fmt.Errorf("Error parsing counters: %s", s)
+    }
+
+    fields := strings.Split(s[1:len(s)-1], ":")
+    if len(fields) != 2 {
+        return counters, fmt.Errorf("Error parsing counters: %s", s)
+    }
+
+    var err error
+    counters.Packets, err = strconv.ParseUint(fields[0], 10, 64)
+    if err != nil {
+        return counters, fmt.Errorf("Error parsing counters: %s", s)
+    }
+    counters.Bytes, err = strconv.ParseUint(fields[1], 10, 64)
+    if err != nil {
+        return counters, fmt.Errorf("Error parsing counters: %s", s)
+    }
+
+    return counters, nil
+}
+
+// splitIptablesCounters splits the counters from the start of a rule line, as written by iptables-save -c
+func splitIptablesCounters(line string) (IptablesCounters, string, error) {
+    if !strings.HasPrefix(line, "[") {
+        return IptablesCounters{}, line, nil
+    }
+
+    end := strings.Index(line, "]")
+    if end == -1 {
+        return IptablesCounters{}, line, fmt.Errorf("Error parsing counters: %s", line)
+    }
+
+    counters, err := parseIptablesCounters(line[:end+1])
+    if err != nil {
+        return counters, line, err
+    }
+
+    return counters, strings.TrimSpace(line[end+1:]), nil
+}
+
+// copyCounters takes the counters for the desired rules from the matching rules in current
+func (desired *IptablesState) copyCounters(current *IptablesState) {
+    for name, table := range desired.Tables {
+        currentTable := current.Tables[name]
+
+        for chainName, chain := range table.Chains {
+            var currentChain *IptablesChain
+            if currentTable != nil {
+                currentChain = currentTable.Chains[chainName]
+            }
+
+            chain.copyCounters(currentChain)
+        }
+    }
+}
+
+func (s *IptablesChain) copyCounters(current *IptablesChain) {
+    s.Counters = IptablesCounters{}
+    for _, rule := range s.Rules {
+        rule.Counters = IptablesCounters{}
+    }
+
+    if current == nil {
+        return
+    }
+
+    if current.Default == s.Default {
+        s.Counters = current.Counters
+    }
+
+    // Rules can repeat, so we pair them up in order
+    unmatched := make(map[string][]*IptablesRule)
+    for _, rule := range current.Rules {
+        unmatched[rule.Spec] = append(unmatched[rule.Spec], rule)
+    }
+
+    for _, rule := range s.Rules {
+        candidates := unmatched[rule.Spec]
+        if len(candidates) == 0 {
+            continue
+        }
+
+        rule.Counters = candidates[0].Counters
+        unmatched[rule.Spec] = candidates[1:]
+    }
+}
+
+// restoreConf renders the state for iptables-restore --counters
+func (s *IptablesState) restoreConf() string {
+    var buffer bytes.Buffer
+
+    for _, tableName := range s.tableNames() {
+        table := s.Tables[tableName]
+
+        buffer.WriteString("*" + tableName + "\n")
+
+        names := table.chainNames()
+        for _, name := range names {
+            table.Chains[name].writeRestoreDefault(&buffer)
+        }
+        for _, name := range names {
+            table.Chains[name].writeRestoreRules(&buffer)
+        }
+
+        buffer.WriteString("COMMIT\n")
+    }
+
+    return buffer.String()
+}
+
+func (s *IptablesChain) writeRestoreDefault(buffer *bytes.Buffer) {
+    action := s.Default
+    if action == "" {
+        action = "-"
+    }
+    buffer.WriteString(":" + s.Name + " " + action + " " + s.Counters.String() + "\n")
+}
+
+func (s *IptablesChain) writeRestoreRules(buffer *bytes.Buffer) {
+    for _, rule := range s.Rules {
+        buffer.WriteString(rule.Counters.String() + " -A " + s.Name + " " + rule.Spec + "\n")
+    }
+}
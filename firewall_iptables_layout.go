@@ -0,0 +1,302 @@
+package applyd
+
+import (
+    "github.com/fathomdb/gommons"
+    "log"
+    "os"
+    "strings"
+)
+
+// An iptables directory can hold whole iptables-save files, and (in the split layout) a directory per table,
+// holding a file per chain, e.g. filter/INPUT.  A chain can instead be a directory of fragments, merged in name order,
+// so that different teams can own the rules they add to a shared chain.
+
+const (
+    IptablesLayoutSingle = "single"
+    IptablesLayoutSplit  = "split"
+)
+
+type iptablesSource struct {
+    Path string
+
+    // Set for chain files; a whole iptables-save file has neither
+    Table string
+    Chain string
+}
+
+// listIptablesSources returns the files under basedir, in the order they are merged
+func listIptablesSources(basedir string) ([]*iptablesSource, error) {
+    names, err := gommons.ListDirectoryNames(basedir)
+    if err != nil {
+        log.Printf("Error listing files in dir %s: %v", basedir, err)
+        return nil, err
+    }
+
+    sources := []*iptablesSource{}
+
+    for _, name := range names {
+        path := basedir + "/" + name
+
+        isdir, err := gommons.IsDirectory(path)
+        if err != nil {
+            return nil, err
+        }
+
+        if !isdir {
+            sources = append(sources, &iptablesSource{Path: path})
+            continue
+        }
+
+        // A table
+        chains, err := gommons.ListDirectoryNames(path)
+        if err != nil {
+            return nil, err
+        }
+
+        for _, chain := range chains {
+            chainPath := path + "/" + chain
+
+            isdir, err := gommons.IsDirectory(chainPath)
+            if err != nil {
+                return nil, err
+            }
+
+            if !isdir {
+                sources = append(sources, &iptablesSource{Path: chainPath, Table: name, Chain: chain})
+                continue
+            }
+
+            fragments, err := gommons.ListDirectoryNames(chainPath)
+            if err != nil {
+                return nil, err
+            }
+
+            for _, fragment := range fragments {
+                sources = append(sources, &iptablesSource{Path: chainPath + "/" + fragment, Table: name, Chain: chain})
+            }
+        }
+    }
+
+    return sources, nil
+}
+
+// parseIptablesChainFile parses a chain file: an optional ":CHAIN POLICY" line, and "-A CHAIN" rules
+func parseIptablesChainFile(ipv6 bool, tableName string, chainName string, text string) (*IptablesState, error) {
+    state := &IptablesState{}
+    state.Ipv6 = ipv6
+    state.Tables = make(map[string]*IptablesTable)
+
+    table := &IptablesTable{}
+    table.Name = tableName
+    table.Chains = make(map[string]*IptablesChain)
+    state.Tables[tableName] = table
+
+    chain := &IptablesChain{}
+    chain.Name = chainName
+    table.Chains[chainName] = chain
+
+    ordering := &iptablesOrderParser{}
+
+    for i, line := range strings.Split(text, "\n") {
+        if strings.TrimSpace(line) == "" {
+            continue
+        }
+
+        if strings.HasPrefix(line, "#") {
+            _, err := ordering.directive(line)
+            if err != nil {
+                return nil, parseErrorf(i+1, "%v", err)
+            }
+            continue
+        }
+
+        if strings.HasPrefix(line, ":") {
+            fields := strings.Fields(line[1:])
+            if len(fields) < 2 {
+                return nil, parseErrorf(i+1, "Error parsing line: %s", line)
+            }
+
+            if fields[0] != chainName {
+                return nil, parseErrorf(i+1, "Chain %s declared in the file for %s", fields[0], chainName)
+            }
+
+            chain.Default = fields[1]
+        } else if strings.HasPrefix(line, "-A ") {
+            name, spec := splitRuleLine(line)
+            if name == "" {
+                return nil, parseErrorf(i+1, "Error parsing line: %s", line)
+            }
+
+            if name != chainName {
+                return nil, parseErrorf(i+1, "Rule for chain %s in the file for %s", name, chainName)
+            }
+
+            rules, err := parseIptablesRule(ipv6, spec)
+            if err != nil {
+                return nil, parseErrorf(i+1, "%v", err)
+            }
+
+            order := ordering.rule()
+            for _, rule := range rules {
+                rule.Line = i + 1
+                rule.Order = order
+            }
+
+            chain.Rules = append(chain.Rules, rules...)
+        } else {
+            return nil, parseErrorf(i+1, "Error parsing line: %s", line)
+        }
+    }
+
+    err := state.normalize()
+    if err != nil {
+        return nil, err
+    }
+
+    return state, nil
+}
+
+func (s *iptablesSource) parse(ipv6 bool, text string) (*IptablesState, error) {
+    var state *IptablesState
+    var err error
+
+    if s.Chain != "" {
+        state, err = parseIptablesChainFile(ipv6, s.Table, s.Chain, text)
+    } else {
+        state, err = parseIptablesSave(ipv6, text)
+    }
+    if err != nil {
+        return nil, fileError(s.Path, 0, err)
+    }
+
+    state.setSource(s.Path)
+
+    return state, nil
+}
+
+func (s *iptablesSource) read(ipv6 bool) (*IptablesState, error) {
+    text, err := gommons.TryReadTextFile(s.Path, "")
+    if err != nil {
+        return nil, err
+    }
+
+    return s.parse(ipv6, text)
+}
+
+// createSplitFiles writes a file per chain, removing the single-file save and chain files for chains that no longer exist.
+// Chains kept as a directory of fragments are maintained by hand, so we leave them alone.
+func (*IptablesManager) createSplitFiles(state *IptablesState, basedir string) error {
+    err := os.Remove(basedir + "/10-saved")
+    if err == nil {
+        log.Printf("Removed %s/10-saved, replaced by per-chain files", basedir)
+    } else if !os.IsNotExist(err) {
+        return err
+    }
+
+    for _, tableName := range state.tableNames() {
+        table := state.Tables[tableName]
+        dir := basedir + "/" + tableName
+
+        err = os.MkdirAll(dir, 0700)
+        if err != nil {
+            return err
+        }
+
+        for _, chainName := range table.chainNames() {
+            path := dir + "/" + chainName
+
+            isdir, err := gommons.IsDirectory(path)
+            if err != nil {
+                return err
+            }
+            if isdir {
+                log.Printf("Not saving %s; the chain is kept as fragments", path)
+                continue
+            }
+
+            err = writeTextFile(path, table.Chains[chainName].describe())
+            if err != nil {
+                return err
+            }
+        }
+
+        err = removeStaleChainFiles(dir, table)
+        if err != nil {
+            return err
+        }
+    }
+
+    // Tables that no longer exist
+    names, err := gommons.ListDirectoryNames(basedir)
+    if err != nil {
+        return err
+    }
+
+    for _, name := range names {
+        if state.Tables[name] != nil {
+            continue
+        }
+
+        dir := basedir + "/" + name
+
+        isdir, err := gommons.IsDirectory(dir)
+        if err != nil {
+            return err
+        }
+        if !isdir {
+            continue
+        }
+
+        err = removeStaleChainFiles(dir, nil)
+        if err != nil {
+            return err
+        }
+
+        remaining, err := gommons.ListDirectoryNames(dir)
+        if err != nil {
+            return err
+        }
+        if len(remaining) == 0 {
+            log.Printf("Removing %s; table no longer exists", dir)
+            err = os.Remove(dir)
+            if err != nil {
+                return err
+            }
+        }
+    }
+
+    return nil
+}
+
+// removeStaleChainFiles removes the files in a table directory for chains the table (which may be nil) doesn't have
+func removeStaleChainFiles(dir string, table *IptablesTable) error {
+    existing, err := gommons.ListDirectoryNames(dir)
+    if err != nil {
+        return err
+    }
+
+    for _, name := range existing {
+        if table != nil && table.Chains[name] != nil {
+            continue
+        }
+
+        path := dir + "/" + name
+
+        // Directories of fragments are maintained by hand
+        isdir, err := gommons.IsDirectory(path)
+        if err != nil {
+            return err
+        }
+        if isdir {
+            continue
+        }
+
+        log.Printf("Removing %s; chain no longer exists", path)
+        err = os.Remove(path)
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
@@ -0,0 +1,225 @@
+package applyd
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Rules from several files are merged into a chain in file order, unless they declare otherwise.
+// Directives are comments, so the files remain valid iptables-save input:
+//
+//   #@priority 100     rules in this block sort by priority (lower first; the default is 0)
+//   #@name ssh         names the block, so other blocks can be placed relative to it
+//   #@before ssh       the block must come before the named block
+//   #@after ssh        the block must come after the named block
+//   #@end              ends the block; following rules have no directives
+//
+// A block is the rules following a group of directives, up to the next directive or the end of the table.
+
+type IptablesRuleOrder struct {
+    Priority int
+    Name     string
+    Before   []string
+    After    []string
+}
+
+type iptablesOrderParser struct {
+    current  *IptablesRuleOrder
+    inHeader bool
+}
+
+// directive handles a directive line, returning false if the line isn't one
+func (p *iptablesOrderParser) directive(line string) (bool, error) {
+    if !strings.HasPrefix(line, "#@") {
+        return false, nil
+    }
+
+    fields := strings.Fields(line[2:])
+    if len(fields) == 0 {
+        return true, fmt.Errorf("Error parsing directive: %s", line)
+    }
+
+    if fields[0] == "end" {
+        p.current = nil
+        p.inHeader = false
+        return true, nil
+    }
+
+    if len(fields) != 2 {
+        return true, fmt.Errorf("Error parsing directive: %s", line)
+    }
+
+    // Consecutive directives describe the same block
+    if !p.inHeader {
+        p.current = &IptablesRuleOrder{}
+        p.inHeader = true
+    }
+
+    switch fields[0] {
+    case "priority":
+        priority, err := strconv.Atoi(fields[1])
+        if err != nil {
+            return true, fmt.Errorf("Error parsing priority: %s", line)
+        }
+        p.current.Priority = priority
+
+    case "name":
+        p.current.Name = fields[1]
+
+    case "before":
+        p.current.Before = append(p.current.Before, fields[1])
+
+    case "after":
+        p.current.After = append(p.current.After, fields[1])
+
+    default:
+        return true, fmt.Errorf("Unknown directive: %s", line)
+    }
+
+    return true, nil
+}
+
+func (p *iptablesOrderParser) rule() *IptablesRuleOrder {
+    p.inHeader = false
+    return p.current
+}
+
+func (p *iptablesOrderParser) reset() {
+    p.current = nil
+    p.inHeader = false
+}
+
+type iptablesRuleBlock struct {
+    order *IptablesRuleOrder
+    rules []*IptablesRule
+}
+
+func (s *iptablesRuleBlock) priority() int {
+    if s.order == nil {
+        return 0
+    }
+    return s.order.Priority
+}
+
+func (s *iptablesRuleBlock) describe() string {
+    if s.order != nil && s.order.Name != "" {
+        return s.order.Name
+    }
+    return s.rules[0].location()
+}
+
+// order sorts the rules of every chain by their directives
+func (s *IptablesState) order() error {
+    for _, table := range s.Tables {
+        for _, chain := range table.Chains {
+            err := chain.order()
+            if err != nil {
+                return fmt.Errorf("Error ordering %s/%s: %v", table.Name, chain.Name, err)
+            }
+        }
+    }
+    return nil
+}
+
+func (s *IptablesChain) order() error {
+    blocks := []*iptablesRuleBlock{}
+
+    var last *iptablesRuleBlock
+    for _, rule := range s.Rules {
+        if last != nil && last.order == rule.Order && (rule.Order != nil || last.rules[0].Source == rule.Source) {
+            last.rules = append(last.rules, rule)
+            continue
+        }
+
+        last = &iptablesRuleBlock{order: rule.Order, rules: []*IptablesRule{rule}}
+        blocks = append(blocks, last)
+    }
+
+    // Priority first, then merge order
+    sort.SliceStable(blocks, func(i, j int) bool {
+        return blocks[i].priority() < blocks[j].priority()
+    })
+
+    named := make(map[string][]int)
+    for i, block := range blocks {
+        if block.order != nil && block.order.Name != "" {
+            named[block.order.Name] = append(named[block.order.Name], i)
+        }
+    }
+
+    // Anchors are constraints on that order; we take the earliest block whose constraints are satisfied
+    predecessors := make([]map[int]bool, len(blocks))
+    for i := range blocks {
+        predecessors[i] = make(map[int]bool)
+    }
+
+    for i, block := range blocks {
+        if block.order == nil {
+            continue
+        }
+
+        for _, name := range block.order.After {
+            targets, found := named[name]
+            if !found {
+                return fmt.Errorf("%s is after %s, which is not declared", block.describe(), name)
+            }
+            for _, j := range targets {
+                predecessors[i][j] = true
+            }
+        }
+
+        for _, name := range block.order.Before {
+            targets, found := named[name]
+            if !found {
+                return fmt.Errorf("%s is before %s, which is not declared", block.describe(), name)
+            }
+            for _, j := range targets {
+                predecessors[j][i] = true
+            }
+        }
+    }
+
+    placed := make([]bool, len(blocks))
+    rules := []*IptablesRule{}
+
+    for len(rules) < len(s.Rules) {
+        next := -1
+        for i := range blocks {
+            if placed[i] {
+                continue
+            }
+
+            ready := true
+            for j, _ := range predecessors[i] {
+                if !placed[j] {
+                    ready = false
+                    break
+                }
+            }
+
+            if ready {
+                next = i
+                break
+            }
+        }
+
+        if next == -1 {
+            cycle := []string{}
+            for i, block := range blocks {
+                if !placed[i] {
+                    cycle = append(cycle, block.describe())
+                }
+            }
+            return fmt.Errorf("Cycle in before/after ordering between %s", strings.Join(cycle, ", "))
+        }
+
+        placed[next] = true
+        rules = append(rules, blocks[next].rules...)
+    }
+
+    s.Rules = rules
+
+    return nil
+}
@@ -0,0 +1,224 @@
+package applyd
+
+import (
+    "bytes"
+    "fmt"
+    "strings"
+)
+
+// Every rule read from apply.d remembers the file and line it came from.  Optionally (iptables-comment-source)
+// the rule is also tagged with a comment naming the file, so that the provenance can be read back from the kernel.
+// The tag leaves out the line: it is part of the rule, and editing a file shouldn't change the rules below the edit.
+// In chain scope, the rules we add to chains we don't own are tagged too (with just "applyd" if they have no
+// provenance), so that we know which of them are ours to remove.
+
+const iptablesOwnerTag = "applyd"
+const iptablesSourceTagPrefix = iptablesOwnerTag + " "
+
+func isApplydComment(value string) bool {
+    return value == iptablesOwnerTag || strings.HasPrefix(value, iptablesSourceTagPrefix)
+}
+
+// location returns the file and line the rule was declared at, or "" if it wasn't read from apply.d
+func (s *IptablesRule) location() string {
+    if s.Source == "" {
+        return ""
+    }
+    return fmt.Sprintf("%s:%d", s.Source, s.Line)
+}
+
+// sourceTag returns the file from the rule's comment tag, or "" if it has none
+func (s *IptablesRule) sourceTag() string {
+    for _, m := range s.Matches {
+        if m.Module != "comment" {
+            continue
+        }
+        for _, o := range m.Options {
+            if o.Name == "--comment" && len(o.Values) == 1 && strings.HasPrefix(o.Values[0], iptablesSourceTagPrefix) {
+                return strings.TrimPrefix(o.Values[0], iptablesSourceTagPrefix)
+            }
+        }
+    }
+    return ""
+}
+
+// origin is where the rule came from, as best we know
+func (s *IptablesRule) origin() string {
+    location := s.location()
+    if location == "" {
+        location = s.sourceTag()
+    }
+    return location
+}
+
+func (s *IptablesMatch) isApplydTag() bool {
+    return s.Module == "comment" && len(s.Options) == 1 && s.Options[0].Name == "--comment" && len(s.Options[0].Values) == 1 && isApplydComment(s.Options[0].Values[0])
+}
+
+// hasApplydTag returns true if the rule is tagged as ours
+func (s *IptablesRule) hasApplydTag() bool {
+    for _, m := range s.Matches {
+        if m.isApplydTag() {
+            return true
+        }
+    }
+    return false
+}
+
+func (s *IptablesRule) removeSourceTag() {
+    matches := []*IptablesMatch{}
+    for _, m := range s.Matches {
+        if m.isApplydTag() {
+            continue
+        }
+        matches = append(matches, m)
+    }
+    s.Matches = matches
+    s.Spec = s.render()
+}
+
+// untaggedSpec returns the spec without our tag, which is the same rule however it is tagged
+func (s *IptablesRule) untaggedSpec() string {
+    if !s.hasApplydTag() {
+        return s.Spec
+    }
+    rule := *s
+    rule.removeSourceTag()
+    return rule.Spec
+}
+
+// addOwnerTag tags the rule as ours, if it isn't already
+func (s *IptablesRule) addOwnerTag() {
+    if s.hasApplydTag() {
+        return
+    }
+
+    option := &IptablesOption{Name: "--comment", Values: []string{iptablesOwnerTag}}
+    s.Matches = append(s.Matches, &IptablesMatch{Module: "comment", Options: []*IptablesOption{option}})
+    s.Spec = s.render()
+}
+
+func (s *IptablesRule) addSourceTag() {
+    s.removeSourceTag()
+
+    if s.Source == "" {
+        return
+    }
+
+    option := &IptablesOption{Name: "--comment", Values: []string{iptablesSourceTagPrefix + s.Source}}
+    s.Matches = append(s.Matches, &IptablesMatch{Module: "comment", Options: []*IptablesOption{option}})
+    s.Spec = s.render()
+}
+
+func (s *IptablesState) rules() []*IptablesRule {
+    rules := []*IptablesRule{}
+    for _, table := range s.Tables {
+        for _, chain := range table.Chains {
+            rules = append(rules, chain.Rules...)
+        }
+    }
+    return rules
+}
+
+func (s *IptablesState) tagSources() {
+    for _, rule := range s.rules() {
+        rule.addSourceTag()
+    }
+}
+
+// stripSourceTags removes the tags from rules read from the kernel, so they aren't saved into apply.d
+func (s *IptablesState) stripSourceTags() {
+    for _, rule := range s.rules() {
+        rule.removeSourceTag()
+    }
+}
+
+// describeAgainst describes the chain, noting the origin of each rule that isn't in other
+func (s *IptablesChain) describeAgainst(other *IptablesChain, note string) string {
+    var buffer bytes.Buffer
+
+    s.writeConfDefault(&buffer)
+
+    for _, rule := range s.Rules {
+        if other == nil || !other.hasRule(rule) {
+            buffer.WriteString(rule.describe(s.Name, note) + "\n")
+        } else {
+            buffer.WriteString("-A " + s.Name + " " + rule.Spec + "\n")
+        }
+    }
+
+    return buffer.String()
+}
+
+// describe returns the rule with a note of its origin
+func (s *IptablesRule) describe(chain string, note string) string {
+    text := "-A " + chain + " " + s.Spec + "  # " + note
+    origin := s.origin()
+    if origin != "" {
+        text += " " + origin
+    }
+    return text
+}
+
+// explain describes rule n (counting from 1, as iptables --line-numbers does) of a chain, and where it came from
+func (s *IptablesManager) explain(basedir string, tableName string, chainName string, n int) (string, error) {
+    var buffer bytes.Buffer
+
+    desired, err := s.readDesired(basedir)
+    if err != nil {
+        return "", err
+    }
+
+    var rule *IptablesRule
+    if desired != nil && desired.Tables[tableName] != nil {
+        chain := desired.Tables[tableName].Chains[chainName]
+        if chain != nil && n >= 1 && n <= len(chain.Rules) {
+            rule = chain.Rules[n-1]
+        }
+    }
+
+    key := fmt.Sprintf("%s %s/%s %d", s.command(), tableName, chainName, n)
+
+    if rule == nil {
+        buffer.WriteString(key + ": not declared in apply.d\n")
+    } else {
+        buffer.WriteString(key + ": -A " + chainName + " " + rule.Spec + "\n")
+        buffer.WriteString("  declared at " + rule.location() + "\n")
+    }
+
+    current, err := iptablesSave(s.runtime, s.Ipv6)
+    if err != nil {
+        buffer.WriteString(fmt.Sprintf("  kernel: unavailable (%v)\n", err))
+        return buffer.String(), nil
+    }
+
+    var currentRule *IptablesRule
+    if current.Tables[tableName] != nil {
+        chain := current.Tables[tableName].Chains[chainName]
+        if chain != nil && n >= 1 && n <= len(chain.Rules) {
+            currentRule = chain.Rules[n-1]
+        }
+    }
+
+    if currentRule == nil {
+        buffer.WriteString("  kernel: no such rule\n")
+    } else if rule != nil && currentRule.Spec == rule.Spec {
+        buffer.WriteString("  kernel: matches\n")
+    } else {
+        buffer.WriteString("  kernel: -A " + chainName + " " + currentRule.Spec + "\n")
+        tag := currentRule.sourceTag()
+        if tag != "" {
+            buffer.WriteString("  kernel rule was declared in " + tag + "\n")
+        }
+    }
+
+    return buffer.String(), nil
+}
+
+// ExplainIptables reports where rule n of an iptables (or ip6tables) chain came from
+func (s *Runtime) ExplainIptables(basedir string, ipv6 bool, table string, chain string, n int) (string, error) {
+    if ipv6 {
+        return s.Firewall.ip6tables.explain(basedir+"/ip6tables", table, chain, n)
+    }
+    return s.Firewall.ip4tables.explain(basedir+"/iptables", table, chain, n)
+}
@@ -0,0 +1,631 @@
+package applyd
+
+import (
+    "bytes"
+    "fmt"
+    "net"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Rules are parsed into their matches and target, canonicalized, and rendered back in the order
+// iptables-save prints them.  A rule from apply.d then compares equal to the same rule read from the kernel,
+// however it was written.
+
+type IptablesRule struct {
+    // The canonical form, as iptables-save would print it
+    Spec string
+
+    // -s, -d, -i, -o, -p, -f
+    Options []*IptablesOption
+    Matches []*IptablesMatch
+
+    // -j or -g
+    Jump          string
+    Target        string
+    TargetOptions []*IptablesOption
+
+    // Where the rule was declared, for rules read from apply.d
+    Source string
+    Line   int
+
+    // The ordering directives of the block the rule is in, if any
+    Order *IptablesRuleOrder
+
+    // For rules read from the kernel, or carried over to the desired state
+    Counters IptablesCounters
+}
+
+type IptablesMatch struct {
+    Module  string
+    Options []*IptablesOption
+}
+
+type IptablesOption struct {
+    Negated bool
+    Name    string
+    Values  []string
+}
+
+var iptablesAliases = map[string]string{
+    "--source":            "-s",
+    "--src":               "-s",
+    "--destination":       "-d",
+    "--dst":               "-d",
+    "--in-interface":      "-i",
+    "--out-interface":     "-o",
+    "--protocol":          "-p",
+    "--fragment":          "-f",
+    "--match":             "-m",
+    "--jump":              "-j",
+    "--goto":              "-g",
+    "--source-port":       "--sport",
+    "--destination-port":  "--dport",
+    "--source-ports":      "--sports",
+    "--destination-ports": "--dports",
+}
+
+// The order iptables-save prints the rule options
+var iptablesRuleOptions = []string{"-s", "-d", "-i", "-o", "-p", "-f"}
+
+// The order iptables-save prints the options of each match module (and target).
+// Options we don't know are kept in the order given, after the ones we do.
+var iptablesModuleOptions = map[string][]string{
+    "tcp":       {"--sport", "--dport", "--tcp-option", "--tcp-flags"},
+    "udp":       {"--sport", "--dport"},
+    "sctp":      {"--sport", "--dport", "--chunk-types"},
+    "icmp":      {"--icmp-type"},
+    "icmp6":     {"--icmpv6-type"},
+    "multiport": {"--sports", "--dports", "--ports"},
+    "conntrack": {"--ctstate", "--ctproto", "--ctorigsrc", "--ctorigdst", "--ctreplsrc", "--ctrepldst", "--ctorigsrcport", "--ctorigdstport", "--ctreplsrcport", "--ctrepldstport", "--ctstatus", "--ctexpire", "--ctdir"},
+    "state":     {"--state"},
+    "comment":   {"--comment"},
+    "limit":     {"--limit", "--limit-burst"},
+    "set":       {"--match-set"},
+    "mac":       {"--mac-source"},
+    "addrtype":  {"--src-type", "--dst-type", "--limit-iface-in", "--limit-iface-out"},
+    "iprange":   {"--src-range", "--dst-range"},
+
+    "LOG":    {"--log-prefix", "--log-level", "--log-tcp-sequence", "--log-tcp-options", "--log-ip-options", "--log-uid"},
+    "REJECT": {"--reject-with"},
+}
+
+// The match module that -p loads implicitly
+var iptablesProtocolModules = map[string]string{
+    "tcp":       "tcp",
+    "udp":       "udp",
+    "sctp":      "sctp",
+    "icmp":      "icmp",
+    "ipv6-icmp": "icmp6",
+}
+
+var iptablesProtocolNumbers = map[string]string{
+    "1":      "icmp",
+    "6":      "tcp",
+    "17":     "udp",
+    "58":     "ipv6-icmp",
+    "132":    "sctp",
+    "icmpv6": "ipv6-icmp",
+}
+
+var iptablesCtstates = []string{"INVALID", "NEW", "RELATED", "ESTABLISHED", "UNTRACKED", "SNAT", "DNAT"}
+
+var iptablesTcpFlags = []string{"FIN", "SYN", "RST", "PSH", "ACK", "URG"}
+
+var iptablesLogLevels = map[string]string{
+    "emerg":  "0",
+    "alert":  "1",
+    "crit":   "2",
+    "error":  "3",
+    "warning": "4",
+    "notice": "5",
+    "info":   "6",
+    "debug":  "7",
+}
+
+var iptablesIcmpTypes = map[string]string{
+    "echo-reply":             "0",
+    "destination-unreachable": "3",
+    "redirect":               "5",
+    "echo-request":           "8",
+    "time-exceeded":          "11",
+    "parameter-problem":      "12",
+}
+
+var iptablesIcmpv6Types = map[string]string{
+    "destination-unreachable": "1",
+    "packet-too-big":          "2",
+    "time-exceeded":           "3",
+    "parameter-problem":       "4",
+    "echo-request":            "128",
+    "echo-reply":              "129",
+    "router-solicitation":     "133",
+    "router-advertisement":    "134",
+    "neighbour-solicitation":  "135",
+    "neighbor-solicitation":   "135",
+    "neighbour-advertisement": "136",
+    "neighbor-advertisement":  "136",
+    "redirect":                "137",
+}
+
+type iptablesToken struct {
+    text   string
+    quoted bool
+}
+
+func tokenizeIptablesRule(spec string) ([]iptablesToken, error) {
+    tokens := []iptablesToken{}
+
+    for i := 0; i < len(spec); i++ {
+        c := spec[i]
+        if c == ' ' || c == '\t' {
+            continue
+        }
+
+        if c == '"' {
+            var buffer bytes.Buffer
+            closed := false
+            for i++; i < len(spec); i++ {
+                if spec[i] == '\\' && (i+1) < len(spec) {
+                    i++
+                    buffer.WriteByte(spec[i])
+                } else if spec[i] == '"' {
+                    closed = true
+                    break
+                } else {
+                    buffer.WriteByte(spec[i])
+                }
+            }
+            if !closed {
+                return nil, fmt.Errorf("Unterminated string in rule: %s", spec)
+            }
+            tokens = append(tokens, iptablesToken{buffer.String(), true})
+            continue
+        }
+
+        end := strings.IndexAny(spec[i:], " \t")
+        if end == -1 {
+            end = len(spec) - i
+        }
+        tokens = append(tokens, iptablesToken{spec[i : i+end], false})
+        i += end
+    }
+
+    return tokens, nil
+}
+
+func isIptablesOption(token iptablesToken) bool {
+    return !token.quoted && (token.text == "!" || strings.HasPrefix(token.text, "-"))
+}
+
+func containsString(values []string, s string) bool {
+    return indexOf(values, s) != -1
+}
+
+// parseIptablesRule parses the part of an -A line after the chain name.
+// A rule with address lists (-s a,b) is expanded to one rule per address, as iptables does.
+func parseIptablesRule(ipv6 bool, spec string) ([]*IptablesRule, error) {
+    tokens, err := tokenizeIptablesRule(spec)
+    if err != nil {
+        return nil, err
+    }
+
+    rule := &IptablesRule{}
+
+    var match *IptablesMatch
+    negated := false
+
+    for i := 0; i < len(tokens); i++ {
+        token := tokens[i]
+
+        if !token.quoted && token.text == "!" {
+            if negated {
+                return nil, fmt.Errorf("Double negation in rule: %s", spec)
+            }
+            negated = true
+            continue
+        }
+
+        if !isIptablesOption(token) {
+            return nil, fmt.Errorf("Unexpected %q in rule: %s", token.text, spec)
+        }
+
+        name := token.text
+        if iptablesAliases[name] != "" {
+            name = iptablesAliases[name]
+        }
+
+        // The old form puts the negation after the option: -s ! 10.0.0.1
+        if (i+2) < len(tokens) && !tokens[i+1].quoted && tokens[i+1].text == "!" && !isIptablesOption(tokens[i+2]) && !negated {
+            negated = true
+            i++
+        }
+
+        values := []string{}
+        for (i+1) < len(tokens) && !isIptablesOption(tokens[i+1]) {
+            i++
+            values = append(values, tokens[i].text)
+        }
+
+        option := &IptablesOption{Negated: negated, Name: name, Values: values}
+        negated = false
+
+        switch name {
+        case "-m":
+            if option.Negated || len(values) != 1 {
+                return nil, fmt.Errorf("Error parsing match in rule: %s", spec)
+            }
+            match = &IptablesMatch{Module: values[0]}
+            rule.Matches = append(rule.Matches, match)
+
+        case "-j", "-g":
+            if option.Negated || len(values) != 1 || rule.Target != "" {
+                return nil, fmt.Errorf("Error parsing target in rule: %s", spec)
+            }
+            rule.Jump = name
+            rule.Target = values[0]
+
+        case "-s", "-d", "-i", "-o", "-p", "-f":
+            expected := 1
+            if name == "-f" {
+                expected = 0
+            }
+            if len(values) != expected {
+                return nil, fmt.Errorf("Error parsing %s in rule: %s", name, spec)
+            }
+            rule.Options = append(rule.Options, option)
+
+        default:
+            if rule.Target != "" {
+                rule.TargetOptions = append(rule.TargetOptions, option)
+                continue
+            }
+
+            m := rule.matchFor(match, name)
+            if m == nil {
+                return nil, fmt.Errorf("Option %s without a match module in rule: %s", name, spec)
+            }
+            m.Options = append(m.Options, option)
+        }
+    }
+
+    if negated {
+        return nil, fmt.Errorf("Trailing negation in rule: %s", spec)
+    }
+
+    rules := []*IptablesRule{}
+    for _, r := range rule.expand() {
+        err = r.canonicalize(ipv6)
+        if err != nil {
+            return nil, fmt.Errorf("%v in rule: %s", err, spec)
+        }
+        r.Spec = r.render()
+        rules = append(rules, r)
+    }
+
+    return rules, nil
+}
+
+func (s *IptablesRule) option(name string) *IptablesOption {
+    for _, o := range s.Options {
+        if o.Name == name {
+            return o
+        }
+    }
+    return nil
+}
+
+// matchFor returns the match an option belongs to: the current -m module, or the module implicitly loaded by -p
+func (s *IptablesRule) matchFor(current *IptablesMatch, name string) *IptablesMatch {
+    if current != nil {
+        known := iptablesModuleOptions[current.Module]
+        if known == nil || containsString(known, name) {
+            return current
+        }
+    }
+
+    protocol := s.option("-p")
+    if protocol != nil {
+        module := iptablesProtocolModules[canonicalIptablesProtocol(protocol.Values[0])]
+        if module != "" && (containsString(iptablesModuleOptions[module], name) || name == "--syn") {
+            for _, m := range s.Matches {
+                if m.Module == module {
+                    return m
+                }
+            }
+
+            // iptables loads the module where the option appears
+            m := &IptablesMatch{Module: module}
+            s.Matches = append(s.Matches, m)
+            return m
+        }
+    }
+
+    return current
+}
+
+func (s *IptablesRule) expand() []*IptablesRule {
+    rules := []*IptablesRule{s}
+
+    for _, name := range []string{"-s", "-d"} {
+        expanded := []*IptablesRule{}
+
+        for _, rule := range rules {
+            o := rule.option(name)
+            if o == nil || !strings.Contains(o.Values[0], ",") {
+                expanded = append(expanded, rule)
+                continue
+            }
+
+            for _, addr := range strings.Split(o.Values[0], ",") {
+                r := *rule
+                r.Options = []*IptablesOption{}
+                for _, ro := range rule.Options {
+                    if ro == o {
+                        ro = &IptablesOption{Negated: o.Negated, Name: o.Name, Values: []string{addr}}
+                    }
+                    r.Options = append(r.Options, ro)
+                }
+                expanded = append(expanded, &r)
+            }
+        }
+
+        rules = expanded
+    }
+
+    return rules
+}
+
+func canonicalIptablesProtocol(protocol string) string {
+    protocol = strings.ToLower(protocol)
+    if iptablesProtocolNumbers[protocol] != "" {
+        protocol = iptablesProtocolNumbers[protocol]
+    }
+    return protocol
+}
+
+// canonicalIptablesAddress returns the address as iptables-save prints it, or "" if it matches everything
+func canonicalIptablesAddress(addr string, ipv6 bool) (string, error) {
+    if !strings.Contains(addr, "/") {
+        if ipv6 {
+            addr = addr + "/128"
+        } else {
+            addr = addr + "/32"
+        }
+    }
+
+    _, network, err := net.ParseCIDR(addr)
+    if err != nil {
+        // Probably a hostname; iptables resolves those, so we can't canonicalize them
+        return addr, nil
+    }
+
+    ones, _ := network.Mask.Size()
+    if ones == 0 {
+        return "", nil
+    }
+
+    if (network.IP.To4() == nil) != ipv6 {
+        return "", fmt.Errorf("Wrong address family for %s", addr)
+    }
+
+    return network.String(), nil
+}
+
+func canonicalIptablesPorts(ports string) string {
+    canonical := []string{}
+    for _, port := range strings.Split(ports, ",") {
+        rangeParts := []string{}
+        for _, p := range strings.Split(port, ":") {
+            if p != "" {
+                _, err := strconv.Atoi(p)
+                if err != nil {
+                    n, err := net.LookupPort("tcp", p)
+                    if err == nil {
+                        p = strconv.Itoa(n)
+                    }
+                }
+            }
+            rangeParts = append(rangeParts, p)
+        }
+        canonical = append(canonical, strings.Join(rangeParts, ":"))
+    }
+    return strings.Join(canonical, ",")
+}
+
+func canonicalIptablesList(value string, order []string) string {
+    items := strings.Split(strings.ToUpper(value), ",")
+    sort.SliceStable(items, func(i, j int) bool {
+        a := indexOf(order, items[i])
+        b := indexOf(order, items[j])
+        if a == -1 {
+            a = len(order)
+        }
+        if b == -1 {
+            b = len(order)
+        }
+        return a < b
+    })
+    return strings.Join(items, ",")
+}
+
+func canonicalIptablesTcpFlags(flags string) string {
+    switch strings.ToUpper(flags) {
+    case "ALL":
+        return strings.Join(iptablesTcpFlags, ",")
+    case "NONE":
+        return "NONE"
+    }
+    return canonicalIptablesList(flags, iptablesTcpFlags)
+}
+
+func (s *IptablesRule) canonicalize(ipv6 bool) error {
+    options := []*IptablesOption{}
+    for _, o := range s.Options {
+        switch o.Name {
+        case "-s", "-d":
+            addr, err := canonicalIptablesAddress(o.Values[0], ipv6)
+            if err != nil {
+                return err
+            }
+            if addr == "" {
+                if !o.Negated {
+                    continue
+                }
+                addr = "0.0.0.0/0"
+                if ipv6 {
+                    addr = "::/0"
+                }
+            }
+            o.Values = []string{addr}
+
+        case "-p":
+            o.Values = []string{canonicalIptablesProtocol(o.Values[0])}
+        }
+        options = append(options, o)
+    }
+    s.Options = options
+    sortIptablesOptions(s.Options, iptablesRuleOptions)
+
+    for _, m := range s.Matches {
+        for _, o := range m.Options {
+            switch o.Name {
+            case "--sport", "--dport", "--sports", "--dports", "--ports":
+                if len(o.Values) == 1 {
+                    o.Values = []string{canonicalIptablesPorts(o.Values[0])}
+                }
+
+            case "--ctstate", "--state":
+                if len(o.Values) == 1 {
+                    o.Values = []string{canonicalIptablesList(o.Values[0], iptablesCtstates)}
+                }
+
+            case "--syn":
+                o.Name = "--tcp-flags"
+                o.Values = []string{"FIN,SYN,RST,ACK", "SYN"}
+
+            case "--tcp-flags":
+                if len(o.Values) == 2 {
+                    o.Values = []string{canonicalIptablesTcpFlags(o.Values[0]), canonicalIptablesTcpFlags(o.Values[1])}
+                }
+
+            case "--icmp-type":
+                if len(o.Values) == 1 && iptablesIcmpTypes[o.Values[0]] != "" {
+                    o.Values = []string{iptablesIcmpTypes[o.Values[0]]}
+                }
+
+            case "--icmpv6-type":
+                if len(o.Values) == 1 && iptablesIcmpv6Types[o.Values[0]] != "" {
+                    o.Values = []string{iptablesIcmpv6Types[o.Values[0]]}
+                }
+            }
+        }
+        sortIptablesOptions(m.Options, iptablesModuleOptions[m.Module])
+    }
+
+    targetOptions := []*IptablesOption{}
+    for _, o := range s.TargetOptions {
+        if o.Name == "--log-level" && len(o.Values) == 1 {
+            level := o.Values[0]
+            if iptablesLogLevels[level] != "" {
+                level = iptablesLogLevels[level]
+            }
+            if level == "4" {
+                // The default, which iptables-save omits
+                continue
+            }
+            o.Values = []string{level}
+        }
+        targetOptions = append(targetOptions, o)
+    }
+    s.TargetOptions = targetOptions
+
+    if s.Target == "REJECT" && len(s.TargetOptions) == 0 {
+        rejectWith := "icmp-port-unreachable"
+        if ipv6 {
+            rejectWith = "icmp6-port-unreachable"
+        }
+        s.TargetOptions = append(s.TargetOptions, &IptablesOption{Name: "--reject-with", Values: []string{rejectWith}})
+    }
+    sortIptablesOptions(s.TargetOptions, iptablesModuleOptions[s.Target])
+
+    return nil
+}
+
+func sortIptablesOptions(options []*IptablesOption, order []string) {
+    position := func(o *IptablesOption) int {
+        i := indexOf(order, o.Name)
+        if i == -1 {
+            return len(order)
+        }
+        return i
+    }
+
+    sort.SliceStable(options, func(i, j int) bool {
+        return position(options[i]) < position(options[j])
+    })
+}
+
+func quoteIptablesValue(s string) string {
+    s = strings.Replace(s, "\\", "\\\\", -1)
+    s = strings.Replace(s, "\"", "\\\"", -1)
+    return "\"" + s + "\""
+}
+
+func (s *IptablesOption) render(buffer *bytes.Buffer) {
+    if s.Negated {
+        buffer.WriteString(" !")
+    }
+    buffer.WriteString(" " + s.Name)
+
+    for _, v := range s.Values {
+        // iptables-save always quotes free text
+        if s.Name == "--comment" || s.Name == "--log-prefix" || v == "" || strings.ContainsAny(v, " \t\"") {
+            v = quoteIptablesValue(v)
+        }
+        buffer.WriteString(" " + v)
+    }
+}
+
+// ipsets returns the names of the ipsets the rule references
+func (s *IptablesRule) ipsets() []string {
+    names := []string{}
+    for _, m := range s.Matches {
+        for _, o := range m.Options {
+            if o.Name == "--match-set" && len(o.Values) != 0 {
+                names = append(names, o.Values[0])
+            }
+        }
+    }
+    for _, o := range s.TargetOptions {
+        if (o.Name == "--add-set" || o.Name == "--del-set") && len(o.Values) != 0 {
+            names = append(names, o.Values[0])
+        }
+    }
+    return names
+}
+
+func (s *IptablesRule) render() string {
+    var buffer bytes.Buffer
+
+    for _, o := range s.Options {
+        o.render(&buffer)
+    }
+
+    for _, m := range s.Matches {
+        buffer.WriteString(" -m " + m.Module)
+        for _, o := range m.Options {
+            o.render(&buffer)
+        }
+    }
+
+    if s.Target != "" {
+        buffer.WriteString(" " + s.Jump + " " + s.Target)
+        for _, o := range s.TargetOptions {
+            o.render(&buffer)
+        }
+    }
+
+    return strings.TrimPrefix(buffer.String(), " ")
+}
@@ -0,0 +1,310 @@
+package applyd
+
+import (
+    "bytes"
+    "log"
+    "strconv"
+    "strings"
+)
+
+// In chain scope, applyd coexists with other tools (docker, kube-proxy, fail2ban) that manage their own chains.
+// We own the user chains declared in apply.d (and any with the configured prefix); we replace those wholesale.
+// Rules declared in built-in or foreign chains are tagged as ours, and inserted at their declared position
+// if missing; tagged rules and jumps into our chains that are no longer declared are removed.  Other rules
+// in those chains are left alone.  Everything is applied with iptables-restore --noflush.
+
+func isBuiltinChain(name string) bool {
+    switch name {
+    case "PREROUTING", "INPUT", "FORWARD", "OUTPUT", "POSTROUTING":
+        return true
+    }
+    return false
+}
+
+func (s *IptablesChain) hasRule(rule *IptablesRule) bool {
+    for _, r := range s.Rules {
+        if r.Spec == rule.Spec {
+            return true
+        }
+    }
+    return false
+}
+
+type iptablesScopedTable struct {
+    name   string
+    owned  map[string]bool
+    header bytes.Buffer
+    body   bytes.Buffer
+    tail   bytes.Buffer
+}
+
+func (s *IptablesManager) ownsChain(desired *IptablesTable, name string) bool {
+    if isBuiltinChain(name) {
+        return false
+    }
+
+    if desired != nil && desired.Chains[name] != nil {
+        return true
+    }
+
+    prefix := s.runtime.Config.IptablesChainPrefix
+    return prefix != "" && strings.HasPrefix(name, prefix)
+}
+
+// tagOwnedRules tags the rules declared in chains we don't own, so that we can tell them apart in the kernel
+func (s *IptablesManager) tagOwnedRules(desired *IptablesState) {
+    for _, table := range desired.Tables {
+        for name, chain := range table.Chains {
+            if s.ownsChain(table, name) {
+                continue
+            }
+            for _, rule := range chain.Rules {
+                rule.addOwnerTag()
+            }
+        }
+    }
+}
+
+// isOurs returns true if a rule in a chain we don't own was put there by us
+func (s *iptablesScopedTable) isOurs(rule *IptablesRule) bool {
+    return rule.hasApplydTag() || s.owned[rule.Target]
+}
+
+func indexOfSpec(specs []string, spec string) int {
+    for i, s := range specs {
+        if s == spec {
+            return i
+        }
+    }
+    return -1
+}
+
+// insertPosition returns where (counting from 0) desired rule i should go in the chain, given the specs of the
+// rules the chain will have; it goes after the declared rule before it, or before the declared rule after it
+func insertPosition(specs []string, desired []*IptablesRule, i int) int {
+    for j := i - 1; j >= 0; j-- {
+        k := indexOfSpec(specs, desired[j].Spec)
+        if k != -1 {
+            return k + 1
+        }
+    }
+    for j := i + 1; j < len(desired); j++ {
+        k := indexOfSpec(specs, desired[j].Spec)
+        if k != -1 {
+            return k
+        }
+    }
+    return len(specs)
+}
+
+func (s *IptablesManager) planScoped(current *IptablesState, desired *IptablesState) (*Plan, error) {
+    plan := &Plan{}
+
+    var conf bytes.Buffer
+
+    for _, name := range desired.tableNames() {
+        desiredTable := desired.Tables[name]
+        currentTable := current.Tables[name]
+        if currentTable == nil {
+            currentTable = &IptablesTable{Name: name, Chains: make(map[string]*IptablesChain)}
+        }
+
+        t := s.planScopedTable(plan, currentTable, desiredTable)
+        if t == nil {
+            continue
+        }
+
+        conf.WriteString("*" + name + "\n")
+        conf.Write(t.header.Bytes())
+        conf.Write(t.body.Bytes())
+        conf.Write(t.tail.Bytes())
+        conf.WriteString("COMMIT\n")
+    }
+
+    if plan.IsEmpty() {
+        return plan, nil
+    }
+
+    restore := conf.String()
+
+    plan.addPreflight(func() error {
+        return s.preflight(desired, restore, "--noflush", "--counters")
+    })
+
+    plan.addAction(func() error {
+        log.Printf("%s: Applying scoped configuration %s", s.command(), restore)
+
+        return iptablesRestore(s.runtime, s.Ipv6, restore, "--noflush", "--counters")
+    })
+
+    return plan, nil
+}
+
+// planScopedTable adds the changes needed for the table to the plan, returning nil if there are none
+func (s *IptablesManager) planScopedTable(plan *Plan, current *IptablesTable, desired *IptablesTable) *iptablesScopedTable {
+    t := &iptablesScopedTable{}
+    t.name = desired.Name
+    t.owned = make(map[string]bool)
+
+    changed := false
+
+    addChange := func(key string, action string, currentText string, desiredText string) {
+        change := &Change{}
+        change.Manager = s.command()
+        change.Key = t.name + "/" + key
+        change.Action = action
+        change.Current = currentText
+        change.Desired = desiredText
+        plan.add(change)
+
+        changed = true
+    }
+
+    for name, _ := range desired.Chains {
+        if s.ownsChain(desired, name) {
+            t.owned[name] = true
+        }
+    }
+    for name, _ := range current.Chains {
+        if s.ownsChain(desired, name) {
+            t.owned[name] = true
+        }
+    }
+
+    // Our chains are replaced wholesale; a chain declaration flushes the chain with --noflush
+    owned := []string{}
+    for name, _ := range t.owned {
+        owned = append(owned, name)
+    }
+
+    for _, name := range canonicalNames(owned, iptablesChainOrder) {
+        desiredChain := desired.Chains[name]
+        currentChain := current.Chains[name]
+
+        if desiredChain == nil {
+            // Ours by prefix, but no longer declared
+            addChange(name, ActionRemove, currentChain.describe(), "")
+
+            t.tail.WriteString("-F " + name + "\n")
+            t.tail.WriteString("-X " + name + "\n")
+            continue
+        }
+
+        if currentChain != nil && desiredChain.matches(currentChain) {
+            continue
+        }
+
+        if currentChain == nil {
+            addChange(name, ActionAdd, "", desiredChain.describe())
+        } else {
+            addChange(name, ActionChange, currentChain.describe(), desiredChain.describe())
+        }
+
+        // Rules that are unchanged keep their counters
+        desiredChain.copyCounters(currentChain)
+
+        t.header.WriteString(":" + name + " - [0:0]\n")
+        desiredChain.writeRestoreRules(&t.body)
+    }
+
+    // Everything else: built-in and foreign chains
+    names := canonicalNames(append(current.chainNames(), desired.chainNames()...), iptablesChainOrder)
+    for _, name := range names {
+        if t.owned[name] {
+            continue
+        }
+
+        currentChain := current.Chains[name]
+        desiredChain := desired.Chains[name]
+
+        // The specs of the rules in the chain as the restore goes: after the deletions, and each insertion
+        specs := []string{}
+
+        // Our rules, declared before we tagged them, are replaced in place by the tagged rule
+        replaced := []int{}
+
+        if currentChain != nil {
+            declared := map[string]bool{}
+            untagged := map[string]*IptablesRule{}
+            if desiredChain != nil {
+                for _, rule := range desiredChain.Rules {
+                    declared[rule.Spec] = true
+                    untagged[rule.untaggedSpec()] = rule
+                }
+            }
+
+            for _, rule := range currentChain.Rules {
+                if declared[rule.Spec] {
+                    specs = append(specs, rule.Spec)
+                    continue
+                }
+
+                tagged := untagged[rule.Spec]
+                if tagged != nil && !rule.hasApplydTag() && indexOfSpec(specs, tagged.Spec) == -1 {
+                    addChange(name, ActionChange, rule.describe(name, "untagged"), tagged.describe(name, "tagged"))
+
+                    replaced = append(replaced, len(specs))
+                    specs = append(specs, tagged.Spec)
+                    continue
+                }
+
+                if !t.isOurs(rule) {
+                    specs = append(specs, rule.Spec)
+                    continue
+                }
+
+                addChange(name, ActionRemove, rule.describe(name, "removed"), "")
+
+                // Deletions go first, so that removed chains are no longer referenced
+                t.header.WriteString("-D " + name + " " + rule.Spec + "\n")
+            }
+        }
+
+        for _, i := range replaced {
+            t.body.WriteString("-R " + name + " " + strconv.Itoa(i+1) + " " + specs[i] + "\n")
+        }
+
+        if desiredChain == nil {
+            continue
+        }
+
+        if desiredChain.Default != "-" && isBuiltinChain(name) {
+            currentDefault := ""
+            counters := IptablesCounters{}
+            if currentChain != nil {
+                currentDefault = currentChain.Default
+                counters = currentChain.Counters
+            }
+
+            if currentDefault != desiredChain.Default {
+                addChange(name, ActionChange, ":"+name+" "+currentDefault, ":"+name+" "+desiredChain.Default)
+
+                // Changing the policy doesn't reset what it has counted
+                t.header.WriteString(":" + name + " " + desiredChain.Default + " " + counters.String() + "\n")
+            }
+        }
+
+        for i, rule := range desiredChain.Rules {
+            if indexOfSpec(specs, rule.Spec) != -1 {
+                continue
+            }
+
+            addChange(name, ActionAdd, "", rule.describe(name, "added"))
+
+            position := insertPosition(specs, desiredChain.Rules, i)
+            if position == len(specs) {
+                rule.writeConf(name, &t.body)
+            } else {
+                t.body.WriteString("-I " + name + " " + strconv.Itoa(position+1) + " " + rule.Spec + "\n")
+            }
+
+            specs = append(specs[:position], append([]string{rule.Spec}, specs[position:]...)...)
+        }
+    }
+
+    if !changed {
+        return nil
+    }
+
+    return t
+}
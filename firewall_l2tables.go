@@ -0,0 +1,559 @@
+package applyd
+
+import (
+    "bytes"
+    "fmt"
+    "github.com/fathomdb/gommons"
+    "io"
+    "log"
+    "os"
+    "os/exec"
+    "strings"
+)
+
+// ebtables and arptables filter bridged frames and ARP, which iptables can't see.  They are managed like iptables
+// in the full scope: apply.d/ebtables and apply.d/arptables hold files in the -save format, merged in name order,
+// and every table they declare is replaced with -restore.  Rules are compared as the -save tool prints them
+// (apart from whitespace), so rules are best written in that form; 'applyd save' writes them that way.
+
+type L2tablesManager struct {
+    runtime *Runtime
+
+    // ebtables or arptables
+    Command string
+
+    // IptablesBackendNft or IptablesBackendLegacy, once we've looked at the installed tools
+    variant string
+}
+
+type L2tablesState struct {
+    Tables map[string]*L2tablesTable
+}
+
+type L2tablesTable struct {
+    Name   string
+    Chains map[string]*L2tablesChain
+}
+
+type L2tablesChain struct {
+    Name    string
+    Default string
+    Rules   []*L2tablesRule
+
+    // Where the default was declared, for chains read from apply.d
+    DefaultSource string
+}
+
+type L2tablesRule struct {
+    Spec string
+
+    // Where the rule was declared, for rules read from apply.d
+    Source string
+    Line   int
+}
+
+var l2tablesTableOrder = []string{"broute", "nat", "filter"}
+var l2tablesChainOrder = []string{"BROUTING", "PREROUTING", "INPUT", "FORWARD", "OUTPUT", "POSTROUTING"}
+
+var l2tablesBuiltinChains = map[string][]string{
+    "filter": {"INPUT", "FORWARD", "OUTPUT"},
+    "nat":    {"PREROUTING", "OUTPUT", "POSTROUTING"},
+    "broute": {"BROUTING"},
+}
+
+func NewL2tablesManager(firewall *FirewallManager, command string) *L2tablesManager {
+    p := &L2tablesManager{}
+    p.runtime = firewall.runtime
+    p.Command = command
+    return p
+}
+
+func (s *L2tablesState) tableNames() []string {
+    names := []string{}
+    for name, _ := range s.Tables {
+        names = append(names, name)
+    }
+    return canonicalNames(names, l2tablesTableOrder)
+}
+
+func (s *L2tablesTable) chainNames() []string {
+    names := []string{}
+    for name, _ := range s.Chains {
+        names = append(names, name)
+    }
+    return canonicalNames(names, l2tablesChainOrder)
+}
+
+func isL2tablesBuiltinChain(name string) bool {
+    return indexOf(l2tablesChainOrder, name) != -1
+}
+
+// defaultPolicy is the policy of a chain that doesn't declare one: built-in chains accept, and
+// ebtables user chains return (arptables user chains have no policy)
+func (s *L2tablesManager) defaultPolicy(chain string) string {
+    if isL2tablesBuiltinChain(chain) {
+        return "ACCEPT"
+    }
+    if s.Command == "ebtables" {
+        return "RETURN"
+    }
+    return "-"
+}
+
+func (s *L2tablesManager) normalize(state *L2tablesState) {
+    for _, table := range state.Tables {
+        // A restored table always has its built-in chains; those not declared get the default policy
+        for _, name := range l2tablesBuiltinChains[table.Name] {
+            if table.Chains[name] == nil {
+                table.Chains[name] = &L2tablesChain{Name: name}
+            }
+        }
+
+        for _, chain := range table.Chains {
+            if chain.Default == "" {
+                chain.Default = s.defaultPolicy(chain.Name)
+            }
+        }
+    }
+}
+
+// writeConf writes the -save format; only the nft variants of the tools accept COMMIT
+func (s *L2tablesState) writeConf(w io.Writer, commit bool) (err error) {
+    for _, name := range s.tableNames() {
+        err = s.Tables[name].writeConf(w, commit)
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func (s *L2tablesState) conf(commit bool) (string, error) {
+    var buffer bytes.Buffer
+
+    err := s.writeConf(&buffer, commit)
+    if err != nil {
+        return "", err
+    }
+
+    return buffer.String(), nil
+}
+
+func (s *L2tablesTable) writeConf(w io.Writer, commit bool) (err error) {
+    _, err = io.WriteString(w, "*"+s.Name+"\n")
+    if err != nil {
+        return err
+    }
+
+    names := s.chainNames()
+
+    for _, name := range names {
+        _, err = io.WriteString(w, ":"+name+" "+s.Chains[name].Default+"\n")
+        if err != nil {
+            return err
+        }
+    }
+
+    for _, name := range names {
+        err = s.Chains[name].writeConfRules(w)
+        if err != nil {
+            return err
+        }
+    }
+
+    if !commit {
+        return nil
+    }
+
+    _, err = io.WriteString(w, "COMMIT\n")
+    if err != nil {
+        return err
+    }
+    return nil
+}
+
+func (s *L2tablesChain) writeConfRules(w io.Writer) (err error) {
+    for _, rule := range s.Rules {
+        _, err = io.WriteString(w, "-A "+s.Name+" "+rule.Spec+"\n")
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func (s *L2tablesChain) describe() string {
+    var buffer bytes.Buffer
+
+    buffer.WriteString(":" + s.Name + " " + s.Default + "\n")
+    s.writeConfRules(&buffer)
+
+    return buffer.String()
+}
+
+func (s *L2tablesManager) saveCommand() string {
+    return "/sbin/" + s.Command + "-save"
+}
+
+func (s *L2tablesManager) restoreCommand() string {
+    return "/sbin/" + s.Command + "-restore"
+}
+
+// usesNft returns true if the installed tools are the nft variant (e.g. "ebtables 1.8.7 (nf_tables)"), looking on first use
+func (s *L2tablesManager) usesNft() bool {
+    if s.variant == "" {
+        s.variant = IptablesBackendLegacy
+
+        output, err := s.runtime.query(s.Command+"-version", exec.Command("/sbin/"+s.Command, "--version"))
+        if err != nil {
+            log.Printf("%s: Unable to read the version; assuming the legacy tools: %v", s.Command, err)
+        } else if strings.Contains(string(output), "(nf_tables)") {
+            s.variant = IptablesBackendNft
+        }
+    }
+    return s.variant == IptablesBackendNft
+}
+
+// conf renders the state in the format the installed tools restore
+func (s *L2tablesManager) conf(state *L2tablesState) (string, error) {
+    return state.conf(s.usesNft())
+}
+
+func l2tablesSave(runtime *Runtime, manager *L2tablesManager) (*L2tablesState, error) {
+    cmd := exec.Command(manager.saveCommand())
+
+    output, err := runtime.query(manager.Command+"-save", cmd)
+    if err != nil {
+        return nil, err
+    }
+
+    state, err := parseL2tablesSave(string(output))
+    if err != nil {
+        return nil, err
+    }
+
+    manager.normalize(state)
+    return state, nil
+}
+
+// parseL2tablesSave parses the -save format.  The legacy tools don't write COMMIT, so a table also ends at the next one.
+func parseL2tablesSave(spec string) (*L2tablesState, error) {
+    state := &L2tablesState{}
+    state.Tables = make(map[string]*L2tablesTable)
+
+    var currentTable *L2tablesTable
+
+    for i, line := range strings.Split(spec, "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+
+        if strings.HasPrefix(line, "*") {
+            name := line[1:]
+
+            if state.Tables[name] != nil {
+                return nil, parseErrorf(i+1, "Duplicate table: %s", name)
+            }
+
+            currentTable = &L2tablesTable{}
+            currentTable.Name = name
+            currentTable.Chains = make(map[string]*L2tablesChain)
+            state.Tables[name] = currentTable
+        } else if strings.HasPrefix(line, ":") {
+            fields := strings.Fields(line[1:])
+            if len(fields) < 2 {
+                return nil, parseErrorf(i+1, "Error parsing line: %s", line)
+            }
+
+            if currentTable == nil {
+                return nil, parseErrorf(i+1, "No current table at line: %s", line)
+            }
+
+            name := fields[0]
+            if currentTable.Chains[name] != nil {
+                return nil, parseErrorf(i+1, "Duplicate chain: %s", name)
+            }
+
+            chain := &L2tablesChain{}
+            chain.Name = name
+            chain.Default = fields[1]
+            currentTable.Chains[name] = chain
+        } else if strings.HasPrefix(line, "-A ") {
+            name, spec := splitRuleLine(line)
+            if name == "" || spec == "" {
+                return nil, parseErrorf(i+1, "Error parsing line: %s", line)
+            }
+
+            if currentTable == nil {
+                return nil, parseErrorf(i+1, "No current table at line: %s", line)
+            }
+
+            chain := currentTable.Chains[name]
+            if chain == nil {
+                chain = &L2tablesChain{}
+                chain.Name = name
+                currentTable.Chains[name] = chain
+            }
+
+            rule := &L2tablesRule{}
+            // Quoted values (--log-prefix "a  b") keep their spacing; elsewhere whitespace doesn't matter
+            tokens, err := tokenizeIptablesRule(spec)
+            if err != nil {
+                return nil, parseErrorf(i+1, "%v", err)
+            }
+            rule.Spec = renderIptablesTokens(tokens)
+            rule.Line = i + 1
+            chain.Rules = append(chain.Rules, rule)
+        } else if line == "COMMIT" {
+            if currentTable == nil {
+                return nil, parseErrorf(i+1, "Unexpected COMMIT found")
+            }
+            currentTable = nil
+        } else {
+            return nil, parseErrorf(i+1, "Error parsing line: %s", line)
+        }
+    }
+
+    return state, nil
+}
+
+func (s *L2tablesState) setSource(path string) {
+    for _, table := range s.Tables {
+        for _, chain := range table.Chains {
+            if chain.Default != "" {
+                chain.DefaultSource = path
+            }
+            for _, rule := range chain.Rules {
+                rule.Source = path
+            }
+        }
+    }
+}
+
+// merge adds b to a; in strict mode, conflicting chain defaults are an error
+func (a *L2tablesState) merge(b *L2tablesState, strict bool) error {
+    for k, bt := range b.Tables {
+        at := a.Tables[k]
+        if at == nil {
+            a.Tables[k] = bt
+            continue
+        }
+
+        for name, bc := range bt.Chains {
+            ac := at.Chains[name]
+            if ac == nil {
+                at.Chains[name] = bc
+                continue
+            }
+
+            if ac.Default != bc.Default {
+                if ac.Default == "" {
+                    ac.Default = bc.Default
+                    ac.DefaultSource = bc.DefaultSource
+                } else if bc.Default == "" {
+                    // Keep what we've got
+                } else if strict {
+                    return fmt.Errorf("Conflicting defaults for chain %s: %s (%s) vs %s (%s)", name, ac.Default, ac.DefaultSource, bc.Default, bc.DefaultSource)
+                } else {
+                    log.Printf("Merging different defaults for chain: %s (%s vs %s)", name, ac.Default, bc.Default)
+
+                    // The later file wins
+                    ac.Default = bc.Default
+                    ac.DefaultSource = bc.DefaultSource
+                }
+            }
+
+            ac.Rules = append(ac.Rules, bc.Rules...)
+        }
+    }
+
+    return nil
+}
+
+func (a *L2tablesChain) matches(b *L2tablesChain) bool {
+    if a.Default != b.Default || len(a.Rules) != len(b.Rules) {
+        return false
+    }
+
+    for i, rule := range a.Rules {
+        if rule.Spec != b.Rules[i].Spec {
+            return false
+        }
+    }
+
+    return true
+}
+
+// diff returns a change for every chain that differs, in the tables desired declares
+func (desired *L2tablesState) diff(current *L2tablesState) []*Change {
+    changes := []*Change{}
+
+    for _, tableName := range desired.tableNames() {
+        dt := desired.Tables[tableName]
+        ct := current.Tables[tableName]
+        if ct == nil {
+            ct = &L2tablesTable{Name: tableName, Chains: make(map[string]*L2tablesChain)}
+        }
+
+        for _, k := range canonicalNames(append(dt.chainNames(), ct.chainNames()...), l2tablesChainOrder) {
+            dv := dt.Chains[k]
+            cv := ct.Chains[k]
+
+            change := &Change{}
+            change.Key = tableName + "/" + k
+
+            if dv == nil {
+                change.Action = ActionRemove
+                change.Current = cv.describe()
+            } else if cv == nil {
+                change.Action = ActionAdd
+                change.Desired = dv.describe()
+            } else if !dv.matches(cv) {
+                change.Action = ActionChange
+                change.Current = cv.describe()
+                change.Desired = dv.describe()
+            } else {
+                continue
+            }
+
+            changes = append(changes, change)
+        }
+    }
+
+    return changes
+}
+
+func (s *L2tablesManager) readDesired(basedir string) (*L2tablesState, error) {
+    isdir, err := gommons.IsDirectory(basedir)
+    if err != nil {
+        return nil, err
+    }
+
+    if !isdir {
+        return nil, nil
+    }
+
+    files, err := gommons.ListDirectoryNames(basedir)
+    if err != nil {
+        return nil, err
+    }
+
+    var desired *L2tablesState
+
+    for _, file := range files {
+        path := basedir + "/" + file
+
+        text, err := gommons.TryReadTextFile(path, "")
+        if err != nil {
+            return nil, err
+        }
+
+        state, err := parseL2tablesSave(text)
+        if err != nil {
+            return nil, fileError(path, 0, err)
+        }
+        state.setSource(path)
+
+        if desired == nil {
+            desired = state
+        } else {
+            err = desired.merge(state, s.runtime.Config.Strict)
+            if err != nil {
+                return nil, err
+            }
+        }
+    }
+
+    if desired != nil {
+        s.normalize(desired)
+    }
+
+    return desired, nil
+}
+
+func (s *L2tablesManager) Save(basedir string) (err error) {
+    // Unlike iptables, these are often not installed
+    _, err = os.Stat(s.saveCommand())
+    if os.IsNotExist(err) {
+        log.Printf("%s: Not installed; skipping", s.Command)
+        return nil
+    }
+
+    state, err := l2tablesSave(s.runtime, s)
+    if err != nil {
+        return err
+    }
+
+    err = os.MkdirAll(basedir, 0700)
+    if err != nil {
+        return err
+    }
+
+    conf, err := s.conf(state)
+    if err != nil {
+        return err
+    }
+
+    return writeTextFile(basedir+"/10-saved", conf)
+}
+
+func (s *L2tablesManager) Plan(basedir string) (*Plan, error) {
+    plan := &Plan{}
+
+    desired, err := s.readDesired(basedir)
+    if err != nil {
+        return nil, err
+    }
+
+    if desired == nil {
+        log.Printf("%s: Directory not found; skipping %s", s.Command, basedir)
+        return plan, nil
+    }
+
+    current, err := l2tablesSave(s.runtime, s)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, change := range desired.diff(current) {
+        change.Manager = s.Command
+        plan.add(change)
+    }
+
+    if plan.IsEmpty() {
+        return plan, nil
+    }
+
+    conf, err := s.conf(desired)
+    if err != nil {
+        return nil, err
+    }
+
+    plan.addAction(func() error {
+        log.Printf("%s: Applying new configuration %s", s.Command, conf)
+
+        return s.restore(conf)
+    })
+
+    return plan, nil
+}
+
+func (s *L2tablesManager) restore(conf string) error {
+    cmd := exec.Command(s.restoreCommand())
+    cmd.Stdin = bytes.NewBufferString(conf)
+
+    _, err := Execute(cmd, s.runtime.retryPolicy())
+    return err
+}
+
+func (s *L2tablesManager) Apply(basedir string) (err error) {
+    plan, err := s.Plan(basedir)
+    if err != nil {
+        return err
+    }
+
+    return plan.Apply()
+}
@@ -0,0 +1,347 @@
+package applyd
+
+import (
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+)
+
+// Lint looks for rules in the merged chains that can't do anything: rules that an earlier rule always decides first
+// (shadowed), repeated rules, user chains that nothing jumps to, and jumps to chains that don't exist.
+// Shadowing is judged on what we can compare statically; a rule is only reported if every match of the earlier rule
+// is at least as wide as the corresponding match of the later one.
+
+// Targets that are extensions rather than chains
+var iptablesTargetExtensions = []string{
+    "ACCEPT", "DROP", "REJECT", "RETURN", "QUEUE", "NFQUEUE",
+    "LOG", "NFLOG", "ULOG", "AUDIT", "TRACE",
+    "MARK", "CONNMARK", "SECMARK", "CONNSECMARK", "CLASSIFY", "TOS", "DSCP", "TTL", "HL", "TCPMSS", "TCPOPTSTRIP", "CHECKSUM",
+    "CT", "NOTRACK", "SET", "TEE", "TPROXY", "SYNPROXY", "HMARK", "IDLETIMER", "LED", "RATEEST", "CLUSTERIP",
+    "DNAT", "SNAT", "MASQUERADE", "REDIRECT", "NETMAP",
+}
+
+// Targets after which no later rule in the chain sees the packet
+var iptablesTerminalTargets = []string{"ACCEPT", "DROP", "REJECT", "RETURN", "QUEUE", "NFQUEUE", "DNAT", "SNAT", "MASQUERADE", "REDIRECT", "NETMAP"}
+
+// An iptablesCondition is one match of a rule, keyed so the same match in another rule can be found
+type iptablesCondition struct {
+    key     string
+    negated bool
+    values  []string
+}
+
+func (s *IptablesRule) conditions() []*iptablesCondition {
+    conditions := []*iptablesCondition{}
+
+    for _, o := range s.Options {
+        if o.Name == "-p" && !o.Negated && o.Values[0] == "all" {
+            continue
+        }
+        conditions = append(conditions, &iptablesCondition{key: o.Name, negated: o.Negated, values: o.Values})
+    }
+
+    for _, m := range s.Matches {
+        for _, o := range m.Options {
+            key := m.Module + " " + o.Name
+
+            switch {
+            case o.Name == "--sport" || o.Name == "--sports":
+                key = "sport"
+            case o.Name == "--dport" || o.Name == "--dports":
+                key = "dport"
+            case o.Name == "--ctstate" || (m.Module == "state" && o.Name == "--state"):
+                key = "ctstate"
+            case m.Module == "comment":
+                // Doesn't affect what the rule matches
+                continue
+            }
+
+            conditions = append(conditions, &iptablesCondition{key: key, negated: o.Negated, values: o.Values})
+        }
+    }
+
+    return conditions
+}
+
+// covers returns true if every packet matched by b is also matched by a
+func (a *IptablesRule) covers(b *IptablesRule) bool {
+    bConditions := b.conditions()
+
+    for _, ca := range a.conditions() {
+        // A rate limit means the rule doesn't always match
+        if strings.HasPrefix(ca.key, "limit ") || strings.HasPrefix(ca.key, "hashlimit ") || strings.HasPrefix(ca.key, "statistic ") {
+            return false
+        }
+
+        found := false
+        for _, cb := range bConditions {
+            if cb.key == ca.key && ca.wider(cb) {
+                found = true
+                break
+            }
+        }
+
+        if !found {
+            return false
+        }
+    }
+
+    return true
+}
+
+// wider returns true if the condition matches everything that b matches
+func (a *iptablesCondition) wider(b *iptablesCondition) bool {
+    if a.negated || b.negated {
+        return a.negated == b.negated && stringSliceEquals(a.values, b.values)
+    }
+
+    if len(a.values) != 1 || len(b.values) != 1 {
+        return stringSliceEquals(a.values, b.values)
+    }
+
+    av := a.values[0]
+    bv := b.values[0]
+
+    switch a.key {
+    case "-s", "-d":
+        _, an, err := net.ParseCIDR(av)
+        if err != nil {
+            return av == bv
+        }
+        _, bn, err := net.ParseCIDR(bv)
+        if err != nil {
+            return false
+        }
+        aOnes, _ := an.Mask.Size()
+        bOnes, _ := bn.Mask.Size()
+        return aOnes <= bOnes && an.Contains(bn.IP)
+
+    case "-i", "-o":
+        if strings.HasSuffix(av, "+") {
+            return strings.HasPrefix(strings.TrimSuffix(bv, "+"), strings.TrimSuffix(av, "+"))
+        }
+        return av == bv
+
+    case "sport", "dport":
+        return portRangesCover(av, bv)
+
+    case "ctstate":
+        states := strings.Split(av, ",")
+        for _, state := range strings.Split(bv, ",") {
+            if !containsString(states, state) {
+                return false
+            }
+        }
+        return true
+    }
+
+    return av == bv
+}
+
+func parsePortRanges(ports string) ([][2]int, bool) {
+    ranges := [][2]int{}
+    for _, item := range strings.Split(ports, ",") {
+        bounds := strings.SplitN(item, ":", 2)
+
+        low, high := 0, 65535
+        var err error
+        if bounds[0] != "" {
+            low, err = strconv.Atoi(bounds[0])
+            if err != nil {
+                return nil, false
+            }
+        }
+        if len(bounds) == 1 {
+            high = low
+        } else if bounds[1] != "" {
+            high, err = strconv.Atoi(bounds[1])
+            if err != nil {
+                return nil, false
+            }
+        }
+        ranges = append(ranges, [2]int{low, high})
+    }
+    return ranges, true
+}
+
+// portRangesCover returns true if every port in b is in a
+func portRangesCover(a string, b string) bool {
+    aRanges, ok := parsePortRanges(a)
+    if !ok {
+        return a == b
+    }
+    bRanges, ok := parsePortRanges(b)
+    if !ok {
+        return false
+    }
+
+    for _, br := range bRanges {
+        // Walk the range, skipping through the ranges of a that cover it
+        next := br[0]
+        for next <= br[1] {
+            advanced := false
+            for _, ar := range aRanges {
+                if ar[0] <= next && next <= ar[1] {
+                    next = ar[1] + 1
+                    advanced = true
+                }
+            }
+            if !advanced {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+func (s *IptablesRule) isTerminal() bool {
+    return s.Jump == "-g" || containsString(iptablesTerminalTargets, s.Target)
+}
+
+// isChainTarget returns true if the target must be a chain, rather than an extension
+func (s *IptablesRule) isChainTarget() bool {
+    if s.Target == "" {
+        return false
+    }
+    if s.Jump == "-g" {
+        return true
+    }
+    return !containsString(iptablesTargetExtensions, s.Target) && len(s.TargetOptions) == 0
+}
+
+type iptablesLinter struct {
+    command     string
+    diagnostics []*Diagnostic
+}
+
+func (l *iptablesLinter) report(rule *IptablesRule, chain *IptablesChain, severity string, format string, args ...interface{}) {
+    d := &Diagnostic{}
+    d.Severity = severity
+    d.Message = l.command + " " + fmt.Sprintf(format, args...)
+
+    if rule != nil {
+        d.Path = rule.Source
+        d.Line = rule.Line
+    } else if chain != nil {
+        d.Path = chain.DefaultSource
+        if len(chain.Rules) != 0 && d.Path == "" {
+            d.Path = chain.Rules[0].Source
+            d.Line = chain.Rules[0].Line
+        }
+    }
+
+    l.diagnostics = append(l.diagnostics, d)
+}
+
+func describeLintRule(table string, chain string, n int, rule *IptablesRule) string {
+    text := fmt.Sprintf("%s/%s rule %d (-A %s %s)", table, chain, n, chain, rule.Spec)
+    if rule.location() != "" {
+        text += " at " + rule.location()
+    }
+    return text
+}
+
+func (l *iptablesLinter) lintChain(table *IptablesTable, chain *IptablesChain) {
+    for i, rule := range chain.Rules {
+        if rule.isChainTarget() && table.Chains[rule.Target] == nil {
+            l.report(rule, chain, SeverityError, "%s/%s rule %d jumps to chain %s, which does not exist in table %s", table.Name, chain.Name, i+1, rule.Target, table.Name)
+        }
+
+        for j := 0; j < i; j++ {
+            earlier := chain.Rules[j]
+
+            if earlier.Spec == rule.Spec {
+                l.report(rule, chain, SeverityWarning, "%s/%s rule %d duplicates %s", table.Name, chain.Name, i+1, describeLintRule(table.Name, chain.Name, j+1, earlier))
+                break
+            }
+
+            if earlier.isTerminal() && earlier.covers(rule) {
+                l.report(rule, chain, SeverityWarning, "%s/%s rule %d can never match; it is shadowed by %s", table.Name, chain.Name, i+1, describeLintRule(table.Name, chain.Name, j+1, earlier))
+                break
+            }
+        }
+    }
+}
+
+// lintReachability reports user chains that no rule reachable from a built-in chain jumps to
+func (l *iptablesLinter) lintReachability(table *IptablesTable) {
+    reachable := make(map[string]bool)
+
+    queue := []string{}
+    for name, _ := range table.Chains {
+        if isBuiltinChain(name) {
+            reachable[name] = true
+            queue = append(queue, name)
+        }
+    }
+
+    for len(queue) != 0 {
+        name := queue[0]
+        queue = queue[1:]
+
+        for _, rule := range table.Chains[name].Rules {
+            target := rule.Target
+            if table.Chains[target] == nil || reachable[target] {
+                continue
+            }
+            reachable[target] = true
+            queue = append(queue, target)
+        }
+    }
+
+    for _, name := range table.chainNames() {
+        if reachable[name] {
+            continue
+        }
+        l.report(nil, table.Chains[name], SeverityWarning, "%s/%s is unreachable; no rule reachable from a built-in chain jumps to it", table.Name, name)
+    }
+}
+
+func (s *IptablesManager) lint(basedir string) ([]*Diagnostic, error) {
+    desired, err := s.readDesired(basedir)
+    if err != nil {
+        return nil, err
+    }
+
+    l := &iptablesLinter{command: s.command()}
+
+    if desired == nil {
+        return l.diagnostics, nil
+    }
+
+    for _, tableName := range desired.tableNames() {
+        table := desired.Tables[tableName]
+
+        for _, chainName := range table.chainNames() {
+            l.lintChain(table, table.Chains[chainName])
+        }
+
+        l.lintReachability(table)
+    }
+
+    return l.diagnostics, nil
+}
+
+func (s *FirewallManager) lint(basedir string) ([]*Diagnostic, error) {
+    if s.useNftables() {
+        return nil, fmt.Errorf("Linting is only supported with the iptables backend")
+    }
+
+    diagnostics := []*Diagnostic{}
+
+    for _, iptables := range []*IptablesManager{s.ip4tables, s.ip6tables} {
+        d, err := iptables.lint(basedir + "/" + iptables.command())
+        if err != nil {
+            return nil, err
+        }
+        diagnostics = append(diagnostics, d...)
+    }
+
+    return diagnostics, nil
+}
+
+// LintFirewall analyzes the chains declared in basedir for rules that can never match, and for broken jumps
+func (s *Runtime) LintFirewall(basedir string) ([]*Diagnostic, error) {
+    return s.Firewall.lint(basedir)
+}
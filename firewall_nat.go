@@ -0,0 +1,456 @@
+package applyd
+
+import (
+    "fmt"
+    "github.com/fathomdb/gommons"
+    "log"
+    "net"
+    "path"
+    "strings"
+)
+
+// NAT files live in apply.d/nat, and declare port forwards and source NAT:
+//
+//   forward tcp 203.0.113.10:443 -> 10.0.0.5:8443
+//   forward udp 203.0.113.10:5000-5010 -> 10.0.0.6 in eth0
+//   forward tcp 203.0.113.11:80 -> 10.0.0.7:8080 vip
+//   snat 10.0.0.0/24 out eth0 to 203.0.113.10
+//   masquerade 10.0.0.0/24 out eth0
+//
+// A forward becomes a DNAT rule in nat PREROUTING, and a rule in filter FORWARD accepting the DNATed connections.
+// A forward marked vip follows the vip of its public address in apply.d/vips: it only matches on the vip's
+// interface, and is dropped while the vip isn't assigned.  Every forward target must be routable.
+
+type NatForward struct {
+    Protocol string
+    Public   net.IP
+    // In iptables form, e.g. 80 or 5000:5010
+    Ports        string
+    Backend      net.IP
+    BackendPorts string
+    Interface    string
+    Vip          bool
+
+    Source string
+    Line   int
+}
+
+type NatSource struct {
+    Masquerade bool
+    Network    string
+    Interface  string
+    To         string
+
+    Source string
+    Line   int
+}
+
+type NatDeclarations struct {
+    Forwards []*NatForward
+    Sources  []*NatSource
+}
+
+func natDir(basedir string) string {
+    return path.Dir(basedir) + "/nat"
+}
+
+// parseNatEndpoint parses address[:ports], or [address]:ports for IPv6
+func parseNatEndpoint(s string) (net.IP, string, error) {
+    host, ports := s, ""
+
+    if strings.HasPrefix(s, "[") {
+        end := strings.Index(s, "]")
+        if end == -1 {
+            return nil, "", fmt.Errorf("Error parsing address: %s", s)
+        }
+        host = s[1:end]
+        ports = strings.TrimPrefix(s[end+1:], ":")
+    } else if strings.Count(s, ":") == 1 {
+        parts := strings.SplitN(s, ":", 2)
+        host, ports = parts[0], parts[1]
+    }
+
+    ip := net.ParseIP(host)
+    if ip == nil {
+        return nil, "", fmt.Errorf("Error parsing address: %s", s)
+    }
+
+    if ports != "" {
+        ports = strings.Replace(ports, "-", ":", 1)
+        _, ok := parsePortRanges(ports)
+        if !ok || strings.Contains(ports, ",") {
+            return nil, "", fmt.Errorf("Error parsing ports: %s", s)
+        }
+    }
+
+    return ip, ports, nil
+}
+
+// readNatDeclarations reads the files in dir, returning nil if there are none
+func readNatDeclarations(dir string) (*NatDeclarations, error) {
+    isdir, err := gommons.IsDirectory(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    if !isdir {
+        return nil, nil
+    }
+
+    names, err := gommons.ListDirectoryNames(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    nat := &NatDeclarations{}
+
+    for _, name := range names {
+        p := dir + "/" + name
+
+        text, err := gommons.TryReadTextFile(p, "")
+        if err != nil {
+            return nil, err
+        }
+
+        err = nat.parse(p, text)
+        if err != nil {
+            return nil, fileError(p, 0, err)
+        }
+    }
+
+    return nat, nil
+}
+
+func (s *NatDeclarations) parse(source string, text string) error {
+    for i, line := range strings.Split(text, "\n") {
+        if strings.Contains(line, "#") {
+            line = line[:strings.Index(line, "#")]
+        }
+
+        fields := strings.Fields(line)
+        if len(fields) == 0 {
+            continue
+        }
+
+        switch fields[0] {
+        case "forward":
+            if len(fields) < 5 || fields[3] != "->" {
+                return parseErrorf(i+1, "Expected forward <protocol> <address>:<ports> -> <address>[:<ports>]: %s", line)
+            }
+
+            f := &NatForward{}
+            f.Protocol = canonicalIptablesProtocol(fields[1])
+            f.Source = source
+            f.Line = i + 1
+
+            if f.Protocol != "tcp" && f.Protocol != "udp" && f.Protocol != "sctp" {
+                return parseErrorf(i+1, "Forwards need a protocol with ports: %s", fields[1])
+            }
+
+            var err error
+            f.Public, f.Ports, err = parseNatEndpoint(fields[2])
+            if err != nil {
+                return parseErrorf(i+1, "%v", err)
+            }
+            if f.Ports == "" {
+                return parseErrorf(i+1, "Forward needs a port: %s", fields[2])
+            }
+
+            f.Backend, f.BackendPorts, err = parseNatEndpoint(fields[4])
+            if err != nil {
+                return parseErrorf(i+1, "%v", err)
+            }
+
+            if (f.Public.To4() == nil) != (f.Backend.To4() == nil) {
+                return parseErrorf(i+1, "Forward between address families: %s", line)
+            }
+
+            options := fields[5:]
+            for j := 0; j < len(options); j++ {
+                switch options[j] {
+                case "vip":
+                    f.Vip = true
+                case "in":
+                    if (j + 1) >= len(options) {
+                        return parseErrorf(i+1, "Expected an interface after in: %s", line)
+                    }
+                    j++
+                    f.Interface = options[j]
+                default:
+                    return parseErrorf(i+1, "Unknown forward option: %s", options[j])
+                }
+            }
+
+            s.Forwards = append(s.Forwards, f)
+
+        case "snat", "masquerade":
+            n := &NatSource{}
+            n.Masquerade = fields[0] == "masquerade"
+            n.Source = source
+            n.Line = i + 1
+
+            if n.Masquerade && (len(fields) != 4 || fields[2] != "out") {
+                return parseErrorf(i+1, "Expected masquerade <network> out <interface>: %s", line)
+            }
+            if !n.Masquerade && (len(fields) != 6 || fields[2] != "out" || fields[4] != "to") {
+                return parseErrorf(i+1, "Expected snat <network> out <interface> to <address>: %s", line)
+            }
+
+            n.Network = fields[1]
+            n.Interface = fields[3]
+            if addressFamily(n.Network) == familyAny {
+                return parseErrorf(i+1, "Invalid network: %s", n.Network)
+            }
+
+            if !n.Masquerade {
+                n.To = fields[5]
+                if addressFamily(n.To) != addressFamily(n.Network) {
+                    return parseErrorf(i+1, "Invalid address for %s: %s", n.Network, n.To)
+                }
+            }
+
+            s.Sources = append(s.Sources, n)
+
+        default:
+            return parseErrorf(i+1, "Unknown nat statement: %s", fields[0])
+        }
+    }
+
+    return nil
+}
+
+// destination renders the DNAT target
+func (s *NatForward) destination() string {
+    text := s.Backend.String()
+    if s.BackendPorts == "" {
+        return text
+    }
+
+    if s.Backend.To4() == nil {
+        text = "[" + text + "]"
+    }
+    return text + ":" + strings.Replace(s.BackendPorts, ":", "-", 1)
+}
+
+// compile builds the nat and filter rules for one family
+func (s *NatDeclarations) compile(ipv6 bool, vips map[string]*Vip) (*IptablesState, error) {
+    state := &IptablesState{}
+    state.Ipv6 = ipv6
+    state.Tables = make(map[string]*IptablesTable)
+
+    addRule := func(tableName string, chainName string, spec string, source string, line int) error {
+        table := state.Tables[tableName]
+        if table == nil {
+            table = &IptablesTable{Name: tableName, Chains: make(map[string]*IptablesChain)}
+            state.Tables[tableName] = table
+        }
+
+        chain := table.Chains[chainName]
+        if chain == nil {
+            chain = &IptablesChain{Name: chainName, Default: "-"}
+            table.Chains[chainName] = chain
+        }
+
+        rules, err := parseIptablesRule(ipv6, spec)
+        if err != nil {
+            return fileError(source, line, err)
+        }
+        for _, rule := range rules {
+            rule.Source = source
+            rule.Line = line
+        }
+        chain.Rules = append(chain.Rules, rules...)
+        return nil
+    }
+
+    for _, f := range s.Forwards {
+        if (f.Public.To4() == nil) != ipv6 {
+            continue
+        }
+
+        iface := f.Interface
+        if f.Vip {
+            vip := vips[f.Public.String()]
+            if vip == nil {
+                return nil, fileError(f.Source, f.Line, fmt.Errorf("Forward is tied to vip %s, which is not declared", f.Public))
+            }
+            if vip.Interface == "" {
+                log.Printf("nat: Vip %s is not assigned; skipping forward at %s:%d", f.Public, f.Source, f.Line)
+                continue
+            }
+            if iface == "" {
+                iface = vip.Interface
+            }
+        }
+
+        in := ""
+        if iface != "" {
+            in = " -i " + iface
+        }
+
+        backendPorts := f.BackendPorts
+        if backendPorts == "" {
+            backendPorts = f.Ports
+        }
+
+        spec := fmt.Sprintf("-d %s%s -p %s -m %s --dport %s -j DNAT --to-destination %s", f.Public, in, f.Protocol, f.Protocol, f.Ports, f.destination())
+        err := addRule("nat", "PREROUTING", spec, f.Source, f.Line)
+        if err != nil {
+            return nil, err
+        }
+
+        spec = fmt.Sprintf("-d %s%s -p %s -m %s --dport %s -m conntrack --ctstate DNAT -j ACCEPT", f.Backend, in, f.Protocol, f.Protocol, backendPorts)
+        err = addRule("filter", "FORWARD", spec, f.Source, f.Line)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    for _, n := range s.Sources {
+        if (addressFamily(n.Network) == familyIpv6) != ipv6 {
+            continue
+        }
+
+        spec := "-s " + n.Network + " -o " + n.Interface + " -j MASQUERADE"
+        if !n.Masquerade {
+            spec = "-s " + n.Network + " -o " + n.Interface + " -j SNAT --to-source " + n.To
+        }
+
+        err := addRule("nat", "POSTROUTING", spec, n.Source, n.Line)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return state, nil
+}
+
+// readNat compiles the nat files for this manager's family, returning nil if there are none
+func (s *IptablesManager) readNat(basedir string) (*IptablesState, error) {
+    nat, err := readNatDeclarations(natDir(basedir))
+    if err != nil {
+        return nil, err
+    }
+
+    if nat == nil {
+        return nil, nil
+    }
+
+    vips, err := s.runtime.Vips.readDesired(path.Dir(basedir) + "/vips")
+    if err != nil {
+        return nil, err
+    }
+
+    return nat.compile(s.Ipv6, vips)
+}
+
+// unroutable returns the forwards whose backend no route covers
+func (s *NatDeclarations) unroutable(routes4 *RoutesState, routes6 *RoutesState) []*NatForward {
+    forwards := []*NatForward{}
+    for _, f := range s.Forwards {
+        routes := routes4
+        if f.Backend.To4() == nil {
+            routes = routes6
+        }
+        if !routes.routes(f.Backend) {
+            forwards = append(forwards, f)
+        }
+    }
+    return forwards
+}
+
+// vipRoutes adds the subnets of the vips, which are connected once the vips are assigned
+func vipRoutes(vips map[string]*Vip, routes4 *RoutesState, routes6 *RoutesState) {
+    for _, vip := range vips {
+        if vip.Interface == "" {
+            continue
+        }
+
+        ip, network, err := net.ParseCIDR(vip.Ip)
+        if err != nil {
+            continue
+        }
+
+        route := &Route{Dest: network.String(), Device: vip.Interface}
+        if ip.To4() != nil {
+            routes4.Routes = append(routes4.Routes, route)
+        } else {
+            routes6.Routes = append(routes6.Routes, route)
+        }
+    }
+}
+
+// desiredRoutes returns the routes declared in basedir, including the subnets of the declared vips
+func (s *Runtime) desiredRoutes(basedir string) (*RoutesState, *RoutesState, error) {
+    routes4, err := s.Routes4.readDesired(basedir + "/route4")
+    if err != nil {
+        return nil, nil, err
+    }
+
+    routes6, err := s.Routes6.readDesired(basedir + "/route6")
+    if err != nil {
+        return nil, nil, err
+    }
+
+    vips, err := s.Vips.readDesired(basedir + "/vips")
+    if err != nil {
+        return nil, nil, err
+    }
+
+    vipRoutes(vips, routes4, routes6)
+
+    return routes4, routes6, nil
+}
+
+// addConnectedRoutes adds the connected subnets, which aren't declared in apply.d; the kernel creates them from the
+// interface addresses
+func (s *Runtime) addConnectedRoutes(routes4 *RoutesState, routes6 *RoutesState) {
+    for _, routes := range []*RoutesState{routes4, routes6} {
+        current, err := showRoutes(s, routes == routes6)
+        if err != nil {
+            log.Printf("routes: Unable to read connected routes: %v", err)
+            continue
+        }
+
+        for _, route := range current.Routes {
+            if route.Protocol == "kernel" {
+                routes.Routes = append(routes.Routes, route)
+            }
+        }
+    }
+}
+
+// checkNatRoutes verifies that every forward target is reachable, through the routes in apply.d or a connected subnet
+func (s *FirewallManager) checkNatRoutes(basedir string) error {
+    nat, err := readNatDeclarations(basedir + "/nat")
+    if err != nil {
+        return err
+    }
+
+    if nat == nil || len(nat.Forwards) == 0 {
+        return nil
+    }
+
+    routes4, routes6, err := s.runtime.desiredRoutes(basedir)
+    if err != nil {
+        return err
+    }
+
+    s.runtime.addConnectedRoutes(routes4, routes6)
+
+    unroutable := nat.unroutable(routes4, routes6)
+    if len(unroutable) == 0 {
+        return nil
+    }
+
+    errors := []string{}
+    for _, f := range unroutable {
+        err := fileError(f.Source, f.Line, fmt.Errorf("Forward target %s is not routable", f.Backend))
+        if len(unroutable) == 1 {
+            return err
+        }
+        errors = append(errors, err.Error())
+    }
+
+    return fmt.Errorf("%d forward targets are not routable: %s", len(unroutable), strings.Join(errors, "; "))
+}
@@ -0,0 +1,932 @@
+package applyd
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "github.com/fathomdb/gommons"
+    "log"
+    "os"
+    "os/exec"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+type NftablesManager struct {
+    runtime *Runtime
+}
+
+type NftablesState struct {
+    Tables map[string]*NftablesTable
+}
+
+type NftablesTable struct {
+    Family string
+    Name   string
+    Chains map[string]*NftablesChain
+    Sets   map[string]*NftablesSet
+}
+
+type NftablesChain struct {
+    Name     string
+    Type     string
+    Hook     string
+    Priority string
+    Policy   string
+    Rules    []string
+}
+
+type NftablesSet struct {
+    Name     string
+    Type     string
+    Flags    string
+    Elements []string
+}
+
+func NewNftablesManager(firewall *FirewallManager) *NftablesManager {
+    p := &NftablesManager{}
+    p.runtime = firewall.runtime
+    return p
+}
+
+func (s *NftablesTable) key() string {
+    return s.Family + " " + s.Name
+}
+
+func (s *NftablesState) table(family string, name string) *NftablesTable {
+    key := family + " " + name
+    table := s.Tables[key]
+    if table == nil {
+        table = &NftablesTable{}
+        table.Family = family
+        table.Name = name
+        table.Chains = make(map[string]*NftablesChain)
+        table.Sets = make(map[string]*NftablesSet)
+
+        s.Tables[key] = table
+    }
+    return table
+}
+
+// The named priorities; nft prints these, but the JSON has the numeric value
+var nftablesPriorities = map[string]int{
+    "raw":      -300,
+    "mangle":   -150,
+    "dstnat":   -100,
+    "filter":   0,
+    "security": 50,
+    "srcnat":   100,
+}
+
+func normalizeNftPriority(tokens []string) string {
+    if len(tokens) == 0 {
+        return ""
+    }
+
+    value, found := nftablesPriorities[tokens[0]]
+    if !found {
+        return strings.Join(tokens, " ")
+    }
+
+    if len(tokens) == 3 {
+        offset, err := strconv.Atoi(tokens[2])
+        if err == nil {
+            if tokens[1] == "-" {
+                value -= offset
+            } else {
+                value += offset
+            }
+        }
+    }
+
+    return strconv.Itoa(value)
+}
+
+// joinNftTokens renders tokens the way nft prints them, so that rules can be compared as text.
+// Lists are "a,b" but anonymous sets are "{ a, b }"
+func joinNftTokens(tokens []string) string {
+    var buffer bytes.Buffer
+
+    depth := 0
+    for i, t := range tokens {
+        if t == "," {
+            if depth > 0 {
+                buffer.WriteString(", ")
+            } else {
+                buffer.WriteString(",")
+            }
+            continue
+        }
+
+        if t == "{" {
+            depth++
+        } else if t == "}" {
+            depth--
+        }
+
+        if i != 0 && tokens[i-1] != "," {
+            buffer.WriteString(" ")
+        }
+        buffer.WriteString(t)
+    }
+
+    return buffer.String()
+}
+
+func normalizeNftRule(tokens []string) string {
+    normalized := []string{}
+    for i := 0; i < len(tokens); i++ {
+        t := tokens[i]
+
+        // nft quotes interface names, but the JSON doesn't; only comments and log prefixes stay quoted
+        if strings.HasPrefix(t, "\"") && i != 0 && tokens[i-1] != "comment" && tokens[i-1] != "prefix" {
+            unquoted, err := strconv.Unquote(t)
+            if err == nil {
+                t = unquoted
+            }
+        }
+
+        normalized = append(normalized, t)
+
+        // Counter values are state, not configuration
+        if tokens[i] == "counter" && (i+4) < len(tokens) && tokens[i+1] == "packets" && tokens[i+3] == "bytes" {
+            i += 4
+        }
+    }
+    return joinNftTokens(normalized)
+}
+
+func tokenizeNft(text string) ([]string, error) {
+    tokens := []string{}
+
+    current := ""
+    flush := func() {
+        if current != "" {
+            tokens = append(tokens, current)
+            current = ""
+        }
+    }
+
+    for i := 0; i < len(text); i++ {
+        c := text[i]
+        switch c {
+        case '"':
+            end := strings.IndexByte(text[i+1:], '"')
+            if end == -1 {
+                return nil, fmt.Errorf("Unterminated string")
+            }
+            current += text[i : i+end+2]
+            i += end + 1
+
+        case '#':
+            flush()
+            end := strings.IndexByte(text[i:], '\n')
+            if end == -1 {
+                i = len(text)
+            } else {
+                i += end - 1
+            }
+
+        case ' ', '\t', '\r':
+            flush()
+
+        case '\n', ';', '{', '}', ',':
+            flush()
+            tokens = append(tokens, string(c))
+
+        default:
+            current += string(c)
+        }
+    }
+    flush()
+
+    return tokens, nil
+}
+
+type nftParser struct {
+    tokens []string
+    pos    int
+}
+
+// next reads a statement, stopping at a terminator, the start of a block, or the end of the enclosing block.
+// Braces that don't start a block (anonymous sets, set elements) are kept in the statement.
+func (p *nftParser) next() (statement []string, block bool, end bool) {
+    depth := 0
+
+    for p.pos < len(p.tokens) {
+        t := p.tokens[p.pos]
+        p.pos++
+
+        if depth == 0 {
+            switch t {
+            case "\n", ";":
+                if len(statement) != 0 {
+                    return statement, false, false
+                }
+                continue
+
+            case "}":
+                if len(statement) != 0 {
+                    p.pos--
+                    return statement, false, false
+                }
+                return nil, false, true
+
+            case "{":
+                if len(statement) != 0 {
+                    switch statement[0] {
+                    case "table", "chain", "set", "map":
+                        return statement, true, false
+                    }
+                }
+            }
+        }
+
+        if t == "\n" {
+            continue
+        }
+        if t == "{" {
+            depth++
+        } else if t == "}" {
+            depth--
+        }
+
+        statement = append(statement, t)
+    }
+
+    return statement, false, len(statement) == 0
+}
+
+func parseNftables(text string) (*NftablesState, error) {
+    tokens, err := tokenizeNft(text)
+    if err != nil {
+        return nil, err
+    }
+
+    state := &NftablesState{}
+    state.Tables = make(map[string]*NftablesTable)
+
+    p := &nftParser{tokens: tokens}
+
+    for {
+        statement, block, end := p.next()
+        if end {
+            if p.pos < len(p.tokens) {
+                return nil, fmt.Errorf("Unexpected }")
+            }
+            break
+        }
+
+        if statement[0] == "flush" && len(statement) == 2 && statement[1] == "ruleset" {
+            // Common at the top of nft files; we replace tables anyway
+            continue
+        }
+
+        if statement[0] != "table" || !block {
+            return nil, fmt.Errorf("Expected table, found: %s", strings.Join(statement, " "))
+        }
+
+        family := "ip"
+        name := ""
+        if len(statement) == 2 {
+            name = statement[1]
+        } else if len(statement) == 3 {
+            family = statement[1]
+            name = statement[2]
+        } else {
+            return nil, fmt.Errorf("Error parsing table: %s", strings.Join(statement, " "))
+        }
+
+        err = p.parseTable(state.table(family, name))
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return state, nil
+}
+
+func (p *nftParser) parseTable(table *NftablesTable) error {
+    for {
+        statement, block, end := p.next()
+        if end {
+            return nil
+        }
+
+        if !block || len(statement) != 2 {
+            return fmt.Errorf("Error parsing table %s: %s", table.Name, strings.Join(statement, " "))
+        }
+
+        name := statement[1]
+
+        switch statement[0] {
+        case "chain":
+            if table.Chains[name] != nil {
+                return fmt.Errorf("Duplicate chain: %s", name)
+            }
+
+            chain := &NftablesChain{}
+            chain.Name = name
+            err := p.parseChain(chain)
+            if err != nil {
+                return err
+            }
+            table.Chains[name] = chain
+
+        case "set":
+            if table.Sets[name] != nil {
+                return fmt.Errorf("Duplicate set: %s", name)
+            }
+
+            set := &NftablesSet{}
+            set.Name = name
+            err := p.parseSet(set)
+            if err != nil {
+                return err
+            }
+            table.Sets[name] = set
+
+        default:
+            return fmt.Errorf("Unsupported object in table %s: %s", table.Name, statement[0])
+        }
+    }
+}
+
+func (p *nftParser) parseChain(chain *NftablesChain) error {
+    for {
+        statement, block, end := p.next()
+        if end {
+            return nil
+        }
+
+        if block {
+            return fmt.Errorf("Unexpected block in chain %s", chain.Name)
+        }
+
+        if statement[0] == "type" {
+            // type <type> hook <hook> priority <priority>
+            if len(statement) < 6 || statement[2] != "hook" || statement[4] != "priority" {
+                return fmt.Errorf("Error parsing chain %s: %s", chain.Name, strings.Join(statement, " "))
+            }
+            chain.Type = statement[1]
+            chain.Hook = statement[3]
+            chain.Priority = normalizeNftPriority(statement[5:])
+        } else if statement[0] == "policy" && len(statement) == 2 {
+            chain.Policy = statement[1]
+        } else {
+            chain.Rules = append(chain.Rules, normalizeNftRule(statement))
+        }
+    }
+}
+
+func (p *nftParser) parseSet(set *NftablesSet) error {
+    for {
+        statement, block, end := p.next()
+        if end {
+            sort.Strings(set.Elements)
+            return nil
+        }
+
+        if block || len(statement) < 2 {
+            return fmt.Errorf("Error parsing set %s", set.Name)
+        }
+
+        switch statement[0] {
+        case "type":
+            set.Type = strings.Join(statement[1:], " ")
+
+        case "flags":
+            set.Flags = strings.Join(statement[1:], "")
+
+        case "elements":
+            if len(statement) < 4 || statement[1] != "=" || statement[2] != "{" || statement[len(statement)-1] != "}" {
+                return fmt.Errorf("Error parsing elements of set %s", set.Name)
+            }
+
+            var element []string
+            for _, t := range statement[3:] {
+                if t == "," || t == "}" {
+                    if len(element) != 0 {
+                        set.Elements = append(set.Elements, strings.Join(element, " "))
+                    }
+                    element = nil
+                } else {
+                    element = append(element, t)
+                }
+            }
+
+        default:
+            return fmt.Errorf("Unsupported option in set %s: %s", set.Name, statement[0])
+        }
+    }
+}
+
+func nftablesList(runtime *Runtime) (*NftablesState, error) {
+    cmd := exec.Command("/usr/sbin/nft", "-j", "list", "ruleset")
+
+    output, err := runtime.query("nft-ruleset-json", cmd)
+    if err != nil {
+        return nil, err
+    }
+
+    return parseNftablesJson(output)
+}
+
+func parseNftablesJson(data []byte) (*NftablesState, error) {
+    var doc struct {
+        Nftables []map[string]map[string]interface{} `json:"nftables"`
+    }
+
+    err := json.Unmarshal(data, &doc)
+    if err != nil {
+        return nil, fmt.Errorf("Error parsing nft output: %v", err)
+    }
+
+    state := &NftablesState{}
+    state.Tables = make(map[string]*NftablesTable)
+
+    str := func(o map[string]interface{}, key string) string {
+        return renderNftValue(o[key])
+    }
+
+    for _, item := range doc.Nftables {
+        for kind, o := range item {
+            switch kind {
+            case "table":
+                state.table(str(o, "family"), str(o, "name"))
+
+            case "chain":
+                chain := &NftablesChain{}
+                chain.Name = str(o, "name")
+                chain.Type = str(o, "type")
+                chain.Hook = str(o, "hook")
+                chain.Priority = str(o, "prio")
+                chain.Policy = str(o, "policy")
+
+                state.table(str(o, "family"), str(o, "table")).Chains[chain.Name] = chain
+
+            case "set":
+                set := &NftablesSet{}
+                set.Name = str(o, "name")
+                if types, ok := o["type"].([]interface{}); ok {
+                    set.Type = renderNftValueList(types, " . ")
+                } else {
+                    set.Type = str(o, "type")
+                }
+                if flags, ok := o["flags"].([]interface{}); ok {
+                    set.Flags = renderNftValueList(flags, ",")
+                }
+                if elements, ok := o["elem"].([]interface{}); ok {
+                    for _, e := range elements {
+                        set.Elements = append(set.Elements, renderNftValue(e))
+                    }
+                }
+                sort.Strings(set.Elements)
+
+                state.table(str(o, "family"), str(o, "table")).Sets[set.Name] = set
+
+            case "rule":
+                table := state.table(str(o, "family"), str(o, "table"))
+                chain := table.Chains[str(o, "chain")]
+                if chain == nil {
+                    return nil, fmt.Errorf("Rule for unknown chain %s", str(o, "chain"))
+                }
+
+                statements := []string{}
+                if exprs, ok := o["expr"].([]interface{}); ok {
+                    for _, expr := range exprs {
+                        statements = append(statements, renderNftStatement(expr))
+                    }
+                }
+                if comment, ok := o["comment"].(string); ok {
+                    statements = append(statements, "comment "+strconv.Quote(comment))
+                }
+
+                chain.Rules = append(chain.Rules, strings.Join(statements, " "))
+            }
+        }
+    }
+
+    return state, nil
+}
+
+// Meta keys that nft prints without the meta keyword
+var nftablesUnqualifiedMeta = map[string]bool{
+    "iif": true, "oif": true, "iifname": true, "oifname": true, "iifgroup": true, "oifgroup": true, "mark": true,
+}
+
+func renderNftValueList(values []interface{}, separator string) string {
+    rendered := []string{}
+    for _, v := range values {
+        rendered = append(rendered, renderNftValue(v))
+    }
+    return strings.Join(rendered, separator)
+}
+
+func renderNftJson(v interface{}) string {
+    data, _ := json.Marshal(v)
+    return string(data)
+}
+
+func renderNftValue(v interface{}) string {
+    switch t := v.(type) {
+    case nil:
+        return ""
+    case string:
+        return t
+    case float64:
+        return strconv.FormatFloat(t, 'f', -1, 64)
+    case bool:
+        return strconv.FormatBool(t)
+    case []interface{}:
+        return renderNftValueList(t, ",")
+    case map[string]interface{}:
+        for k, o := range t {
+            m, _ := o.(map[string]interface{})
+
+            switch k {
+            case "payload":
+                if m["protocol"] != nil {
+                    return renderNftValue(m["protocol"]) + " " + renderNftValue(m["field"])
+                }
+            case "meta":
+                key := renderNftValue(m["key"])
+                if nftablesUnqualifiedMeta[key] {
+                    return key
+                }
+                return "meta " + key
+            case "ct":
+                return "ct " + renderNftValue(m["key"])
+            case "set":
+                if list, ok := o.([]interface{}); ok {
+                    return "{ " + renderNftValueList(list, ", ") + " }"
+                }
+                return "{ " + renderNftValue(o) + " }"
+            case "prefix":
+                return renderNftValue(m["addr"]) + "/" + renderNftValue(m["len"])
+            case "range":
+                if list, ok := o.([]interface{}); ok {
+                    return renderNftValueList(list, "-")
+                }
+            case "concat":
+                if list, ok := o.([]interface{}); ok {
+                    return renderNftValueList(list, " . ")
+                }
+            case "elem":
+                return renderNftValue(m["val"])
+            }
+        }
+    }
+
+    // Something we don't know how to print; it will never match, so we will always reapply
+    return renderNftJson(v)
+}
+
+func renderNftStatement(v interface{}) string {
+    stmt, ok := v.(map[string]interface{})
+    if !ok {
+        return renderNftJson(v)
+    }
+
+    for k, o := range stmt {
+        m, _ := o.(map[string]interface{})
+
+        switch k {
+        case "match":
+            left := renderNftValue(m["left"])
+            right := renderNftValue(m["right"])
+            op := renderNftValue(m["op"])
+            if op == "==" || op == "in" {
+                return left + " " + right
+            }
+            return left + " " + op + " " + right
+
+        case "counter":
+            return "counter"
+
+        case "accept", "drop", "continue", "return", "notrack", "masquerade":
+            return k
+
+        case "jump", "goto":
+            return k + " " + renderNftValue(m["target"])
+
+        case "reject":
+            if m == nil {
+                return "reject"
+            }
+            return strings.TrimSpace("reject with " + renderNftValue(m["type"]) + " " + renderNftValue(m["expr"]))
+
+        case "log":
+            s := "log"
+            if m != nil && m["prefix"] != nil {
+                s += " prefix " + strconv.Quote(renderNftValue(m["prefix"]))
+            }
+            if m != nil && m["level"] != nil {
+                s += " level " + renderNftValue(m["level"])
+            }
+            return s
+
+        case "snat", "dnat":
+            s := k + " to " + renderNftValue(m["addr"])
+            if m["port"] != nil {
+                s += ":" + renderNftValue(m["port"])
+            }
+            return s
+
+        case "limit":
+            s := "limit rate "
+            if m["inv"] == true {
+                s += "over "
+            }
+            s += renderNftValue(m["rate"]) + "/" + renderNftValue(m["per"])
+            if m["burst"] != nil && renderNftValue(m["burst"]) != "0" {
+                s += " burst " + renderNftValue(m["burst"]) + " packets"
+            }
+            return s
+
+        case "mangle":
+            return renderNftValue(m["key"]) + " set " + renderNftValue(m["value"])
+        }
+    }
+
+    return renderNftJson(v)
+}
+
+func (s *NftablesChain) matches(o *NftablesChain) bool {
+    if s.Type != o.Type || s.Hook != o.Hook || s.Priority != o.Priority || s.Policy != o.Policy {
+        return false
+    }
+
+    return stringSliceEquals(s.Rules, o.Rules)
+}
+
+func (s *NftablesSet) matches(o *NftablesSet) bool {
+    if s.Type != o.Type || s.Flags != o.Flags {
+        return false
+    }
+
+    return stringSliceEquals(s.Elements, o.Elements)
+}
+
+func (s *NftablesChain) writeConf(w *bytes.Buffer) {
+    w.WriteString("    chain " + s.Name + " {\n")
+    if s.Type != "" {
+        w.WriteString("        type " + s.Type + " hook " + s.Hook + " priority " + s.Priority + ";")
+        if s.Policy != "" {
+            w.WriteString(" policy " + s.Policy + ";")
+        }
+        w.WriteString("\n")
+    }
+    for _, rule := range s.Rules {
+        w.WriteString("        " + rule + "\n")
+    }
+    w.WriteString("    }\n")
+}
+
+func (s *NftablesSet) writeConf(w *bytes.Buffer) {
+    w.WriteString("    set " + s.Name + " {\n")
+    w.WriteString("        type " + s.Type + "\n")
+    if s.Flags != "" {
+        w.WriteString("        flags " + s.Flags + "\n")
+    }
+    if len(s.Elements) != 0 {
+        w.WriteString("        elements = { " + strings.Join(s.Elements, ", ") + " }\n")
+    }
+    w.WriteString("    }\n")
+}
+
+func (s *NftablesState) keys() []string {
+    keys := []string{}
+    for key, _ := range s.Tables {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+func (s *NftablesTable) setNames() []string {
+    names := []string{}
+    for name, _ := range s.Sets {
+        names = append(names, name)
+    }
+    return canonicalNames(names, nil)
+}
+
+func (s *NftablesTable) chainNames() []string {
+    names := []string{}
+    for name, _ := range s.Chains {
+        names = append(names, name)
+    }
+    return canonicalNames(names, nil)
+}
+
+func (s *NftablesTable) writeConf(w *bytes.Buffer) {
+    w.WriteString("table " + s.key() + " {\n")
+    for _, name := range s.setNames() {
+        s.Sets[name].writeConf(w)
+    }
+    for _, name := range s.chainNames() {
+        s.Chains[name].writeConf(w)
+    }
+    w.WriteString("}\n")
+}
+
+func (s *NftablesChain) describe() string {
+    var buffer bytes.Buffer
+    s.writeConf(&buffer)
+    return buffer.String()
+}
+
+func (s *NftablesSet) describe() string {
+    var buffer bytes.Buffer
+    s.writeConf(&buffer)
+    return buffer.String()
+}
+
+// diff returns the changes for one table; current may be empty
+func (desired *NftablesTable) diff(current *NftablesTable) []*Change {
+    changes := []*Change{}
+
+    add := func(key string, action string, currentText string, desiredText string) {
+        change := &Change{}
+        change.Manager = "nftables"
+        change.Key = desired.key() + "/" + key
+        change.Action = action
+        change.Current = currentText
+        change.Desired = desiredText
+        changes = append(changes, change)
+    }
+
+    for _, name := range canonicalNames(append(desired.setNames(), current.setNames()...), nil) {
+        d := desired.Sets[name]
+        c := current.Sets[name]
+        if d == nil {
+            add("set "+name, ActionRemove, c.describe(), "")
+        } else if c == nil {
+            add("set "+name, ActionAdd, "", d.describe())
+        } else if !d.matches(c) {
+            add("set "+name, ActionChange, c.describe(), d.describe())
+        }
+    }
+
+    for _, name := range canonicalNames(append(desired.chainNames(), current.chainNames()...), nil) {
+        d := desired.Chains[name]
+        c := current.Chains[name]
+        if d == nil {
+            add(name, ActionRemove, c.describe(), "")
+        } else if c == nil {
+            add(name, ActionAdd, "", d.describe())
+        } else if !d.matches(c) {
+            add(name, ActionChange, c.describe(), d.describe())
+        }
+    }
+
+    return changes
+}
+
+func nftablesApply(runtime *Runtime, conf string) error {
+    cmd := exec.Command("/usr/sbin/nft", "-f", "-")
+    cmd.Stdin = bytes.NewBufferString(conf)
+
+    _, err := Execute(cmd, runtime.retryPolicy())
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
+
+func readNftablesDir(basedir string) (*NftablesState, error) {
+    files, err := gommons.ListDirectoryNames(basedir)
+    if err != nil {
+        log.Printf("nftables: Error listing files in dir %s: %v", basedir, err)
+        return nil, err
+    }
+
+    desired := &NftablesState{}
+    desired.Tables = make(map[string]*NftablesTable)
+
+    for _, file := range files {
+        path := basedir + "/" + file
+
+        text, err := gommons.TryReadTextFile(path, "")
+        if err != nil {
+            return nil, err
+        }
+
+        state, err := parseNftables(text)
+        if err != nil {
+            return nil, fileError(path, 0, err)
+        }
+
+        for key, table := range state.Tables {
+            if desired.Tables[key] != nil {
+                return nil, fileError(path, 0, fmt.Errorf("Table %s is also defined in another file", key))
+            }
+            desired.Tables[key] = table
+        }
+    }
+
+    return desired, nil
+}
+
+func (s *NftablesManager) plan(current *NftablesState, basedir string) (*Plan, error) {
+    desired, err := readNftablesDir(basedir)
+    if err != nil {
+        return nil, err
+    }
+
+    plan := &Plan{}
+
+    var conf bytes.Buffer
+
+    for _, key := range desired.keys() {
+        table := desired.Tables[key]
+        currentTable := current.Tables[key]
+
+        exists := currentTable != nil
+        if !exists {
+            currentTable = &NftablesTable{Chains: make(map[string]*NftablesChain), Sets: make(map[string]*NftablesSet)}
+        }
+
+        changes := table.diff(currentTable)
+        if len(changes) == 0 {
+            continue
+        }
+
+        for _, change := range changes {
+            plan.add(change)
+        }
+
+        // Replace the whole table; this is a single transaction so it is atomic
+        if exists {
+            conf.WriteString("delete table " + key + "\n")
+        }
+        table.writeConf(&conf)
+    }
+
+    for _, key := range current.keys() {
+        if desired.Tables[key] == nil {
+            // In kernel, not on disk
+            log.Printf("nftables: Ignoring table %s", key)
+        }
+    }
+
+    if plan.IsEmpty() {
+        return plan, nil
+    }
+
+    script := conf.String()
+    plan.addAction(func() error {
+        log.Printf("nftables: Applying new configuration %s", script)
+
+        return nftablesApply(s.runtime, script)
+    })
+
+    return plan, nil
+}
+
+func (s *NftablesManager) Plan(basedir string) (*Plan, error) {
+    isdir, err := gommons.IsDirectory(basedir)
+    if err != nil {
+        return nil, err
+    }
+
+    if !isdir {
+        log.Printf("nftables: Directory not found; skipping %s", basedir)
+        return &Plan{}, nil
+    }
+
+    current, err := nftablesList(s.runtime)
+    if err != nil {
+        return nil, err
+    }
+
+    return s.plan(current, basedir)
+}
+
+func (s *NftablesManager) Apply(basedir string) (err error) {
+    plan, err := s.Plan(basedir)
+    if err != nil {
+        return err
+    }
+
+    return plan.Apply()
+}
+
+func (s *NftablesManager) Save(basedir string) (err error) {
+    cmd := exec.Command("/usr/sbin/nft", "list", "ruleset")
+
+    output, err := s.runtime.query("nft-ruleset", cmd)
+    if err != nil {
+        return err
+    }
+
+    err = os.MkdirAll(basedir, 0700)
+    if err != nil {
+        return err
+    }
+
+    return writeTextFile(basedir+"/10-saved", string(output))
+}
@@ -0,0 +1,545 @@
+package applyd
+
+import (
+    "bytes"
+    "fmt"
+    "github.com/fathomdb/gommons"
+    "io/ioutil"
+    "log"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+)
+
+// Policy files live in apply.d/policy, and describe the firewall in terms of zones and services:
+//
+//   zone lan interface eth1 eth2
+//   zone office net 10.1.0.0/16 2001:db8:1::/48
+//   zone partners ipset partner-nets
+//   service ssh tcp 22
+//   service web tcp 80,443
+//   service ping icmp echo-request
+//   allow office -> local ssh web
+//   allow lan -> wan any
+//   deny any -> local
+//
+// "local" is this host, and "any" is anywhere (or any service).  Traffic to local is filtered in INPUT,
+// from local in OUTPUT, and between other zones in FORWARD; each gets a POLICY- chain, which accepts established
+// connections first.  Rules are compiled to both families, as far as each zone's addresses allow, and merged
+// with the iptables files; raw rules can use #@priority to go before the policy.
+
+const (
+    policyZoneLocal  = "local"
+    policyZoneAny    = "any"
+    policyServiceAny = "any"
+)
+
+var policyActions = map[string]string{
+    "allow":  "ACCEPT",
+    "deny":   "DROP",
+    "reject": "REJECT",
+}
+
+type PolicyZone struct {
+    Name       string
+    Interfaces []string
+    Nets       []string
+    Ipsets     []string
+}
+
+type PolicyPort struct {
+    Protocol string
+    // Ports for tcp, udp and sctp; the type for icmp
+    Ports string
+}
+
+type PolicyService struct {
+    Name  string
+    Ports []*PolicyPort
+}
+
+type PolicyRule struct {
+    Action   string
+    From     string
+    To       string
+    Services []string
+
+    Source string
+    Line   int
+}
+
+// A PolicyStatement is a line of a policy file, for reporting changes
+type PolicyStatement struct {
+    Text   string
+    Source string
+    Line   int
+}
+
+type FirewallPolicy struct {
+    Zones      map[string]*PolicyZone
+    Services   map[string]*PolicyService
+    Rules      []*PolicyRule
+    Statements []*PolicyStatement
+}
+
+func policyDir(basedir string) string {
+    return path.Dir(basedir) + "/policy"
+}
+
+func newFirewallPolicy() *FirewallPolicy {
+    p := &FirewallPolicy{}
+    p.Zones = make(map[string]*PolicyZone)
+    p.Services = make(map[string]*PolicyService)
+    return p
+}
+
+// readFirewallPolicy reads the policy files in dir, returning nil if there are none
+func readFirewallPolicy(dir string) (*FirewallPolicy, error) {
+    isdir, err := gommons.IsDirectory(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    if !isdir {
+        return nil, nil
+    }
+
+    names, err := gommons.ListDirectoryNames(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    policy := newFirewallPolicy()
+
+    for _, name := range names {
+        p := dir + "/" + name
+
+        text, err := gommons.TryReadTextFile(p, "")
+        if err != nil {
+            return nil, err
+        }
+
+        err = policy.parse(p, text)
+        if err != nil {
+            return nil, fileError(p, 0, err)
+        }
+    }
+
+    err = policy.check()
+    if err != nil {
+        return nil, err
+    }
+
+    return policy, nil
+}
+
+func (s *FirewallPolicy) parse(source string, text string) error {
+    for i, line := range strings.Split(text, "\n") {
+        if strings.Contains(line, "#") {
+            line = line[:strings.Index(line, "#")]
+        }
+
+        fields := strings.Fields(line)
+        if len(fields) == 0 {
+            continue
+        }
+
+        switch fields[0] {
+        case "zone":
+            if len(fields) < 4 {
+                return parseErrorf(i+1, "Expected zone <name> interface|net|ipset <value>...: %s", line)
+            }
+
+            name := fields[1]
+            if name == policyZoneLocal || name == policyZoneAny {
+                return parseErrorf(i+1, "Zone %s is reserved", name)
+            }
+
+            zone := s.Zones[name]
+            if zone == nil {
+                zone = &PolicyZone{Name: name}
+                s.Zones[name] = zone
+            }
+
+            values := fields[3:]
+            switch fields[2] {
+            case "interface":
+                zone.Interfaces = append(zone.Interfaces, values...)
+            case "net":
+                for _, value := range values {
+                    if addressFamily(value) == familyAny {
+                        return parseErrorf(i+1, "Invalid address for zone %s: %s", name, value)
+                    }
+                }
+                zone.Nets = append(zone.Nets, values...)
+            case "ipset":
+                zone.Ipsets = append(zone.Ipsets, values...)
+            default:
+                return parseErrorf(i+1, "Unknown zone member type: %s", fields[2])
+            }
+
+        case "service":
+            if len(fields) < 3 || len(fields) > 4 {
+                return parseErrorf(i+1, "Expected service <name> <protocol> [<ports>]: %s", line)
+            }
+
+            name := fields[1]
+            if name == policyServiceAny {
+                return parseErrorf(i+1, "Service %s is reserved", name)
+            }
+
+            port := &PolicyPort{Protocol: canonicalIptablesProtocol(fields[2])}
+            if len(fields) == 4 {
+                port.Ports = fields[3]
+            }
+
+            switch port.Protocol {
+            case "tcp", "udp", "sctp":
+                if port.Ports == "" {
+                    return parseErrorf(i+1, "Service %s needs ports for %s", name, port.Protocol)
+                }
+                port.Ports = canonicalIptablesPorts(strings.Replace(port.Ports, "-", ":", -1))
+                _, ok := parsePortRanges(port.Ports)
+                if !ok {
+                    return parseErrorf(i+1, "Invalid ports for service %s: %s", name, fields[3])
+                }
+            case "icmp":
+            default:
+                return parseErrorf(i+1, "Unknown protocol for service %s: %s", name, fields[2])
+            }
+
+            service := s.Services[name]
+            if service == nil {
+                service = &PolicyService{Name: name}
+                s.Services[name] = service
+            }
+            service.Ports = append(service.Ports, port)
+
+        case "allow", "deny", "reject":
+            if len(fields) < 4 || fields[2] != "->" {
+                return parseErrorf(i+1, "Expected %s <zone> -> <zone> [<service>...]: %s", fields[0], line)
+            }
+
+            rule := &PolicyRule{}
+            rule.Action = fields[0]
+            rule.From = fields[1]
+            rule.To = fields[3]
+            rule.Services = fields[4:]
+            rule.Source = source
+            rule.Line = i + 1
+
+            if rule.From == policyZoneLocal && rule.To == policyZoneLocal {
+                return parseErrorf(i+1, "Traffic from local to local is not filtered")
+            }
+
+            s.Rules = append(s.Rules, rule)
+
+        default:
+            return parseErrorf(i+1, "Unknown policy statement: %s", fields[0])
+        }
+
+        s.Statements = append(s.Statements, &PolicyStatement{Text: strings.Join(fields, " "), Source: source, Line: i + 1})
+    }
+
+    return nil
+}
+
+// check verifies the zones and services the rules refer to, which can be declared in any file
+func (s *FirewallPolicy) check() error {
+    for _, rule := range s.Rules {
+        for _, zone := range []string{rule.From, rule.To} {
+            if zone != policyZoneLocal && zone != policyZoneAny && s.Zones[zone] == nil {
+                return fileError(rule.Source, rule.Line, fmt.Errorf("Unknown zone: %s", zone))
+            }
+        }
+
+        for _, service := range rule.Services {
+            if service != policyServiceAny && s.Services[service] == nil {
+                return fileError(rule.Source, rule.Line, fmt.Errorf("Unknown service: %s", service))
+            }
+        }
+    }
+
+    return nil
+}
+
+func policyChain(rule *PolicyRule) string {
+    if rule.To == policyZoneLocal {
+        return "INPUT"
+    }
+    if rule.From == policyZoneLocal {
+        return "OUTPUT"
+    }
+    return "FORWARD"
+}
+
+// zoneMatches returns the alternative matches for a zone in this family, as source (src) or destination (dst).
+// A zone with no members in this family returns none.
+func (s *FirewallPolicy) zoneMatches(name string, direction string, ipv6 bool, ipsets map[string]string) []string {
+    if name == policyZoneLocal || name == policyZoneAny {
+        return []string{""}
+    }
+
+    zone := s.Zones[name]
+    family := familyIpv4
+    if ipv6 {
+        family = familyIpv6
+    }
+
+    matches := []string{}
+
+    for _, iface := range zone.Interfaces {
+        if direction == "src" {
+            matches = append(matches, "-i "+iface)
+        } else {
+            matches = append(matches, "-o "+iface)
+        }
+    }
+
+    for _, net := range zone.Nets {
+        if addressFamily(net) != family {
+            continue
+        }
+        if direction == "src" {
+            matches = append(matches, "-s "+net)
+        } else {
+            matches = append(matches, "-d "+net)
+        }
+    }
+
+    for _, ipset := range zone.Ipsets {
+        f := ipsets[ipset]
+        if f != familyAny && f != family {
+            continue
+        }
+        matches = append(matches, "-m set --match-set "+ipset+" "+direction)
+    }
+
+    return matches
+}
+
+func (s *FirewallPolicy) serviceMatches(names []string, ipv6 bool) []string {
+    if len(names) == 0 || containsString(names, policyServiceAny) {
+        return []string{""}
+    }
+
+    matches := []string{}
+    for _, name := range names {
+        for _, port := range s.Services[name].Ports {
+            switch port.Protocol {
+            case "icmp":
+                match := "-p icmp"
+                if ipv6 {
+                    match = "-p ipv6-icmp"
+                }
+                if port.Ports != "" {
+                    if ipv6 {
+                        icmpType := dualStackIcmpv6Types[port.Ports]
+                        if icmpType == "" {
+                            // Only meaningful for IPv4
+                            continue
+                        }
+                        match += " -m icmp6 --icmpv6-type " + icmpType
+                    } else {
+                        match += " -m icmp --icmp-type " + port.Ports
+                    }
+                }
+                matches = append(matches, match)
+
+            default:
+                if strings.Contains(port.Ports, ",") {
+                    matches = append(matches, "-p "+port.Protocol+" -m multiport --dports "+port.Ports)
+                } else {
+                    matches = append(matches, "-p "+port.Protocol+" -m "+port.Protocol+" --dport "+port.Ports)
+                }
+            }
+        }
+    }
+    return matches
+}
+
+// compile builds the POLICY- chains for one family
+func (s *FirewallPolicy) compile(ipv6 bool, ipsets map[string]string) (*IptablesState, error) {
+    state := &IptablesState{}
+    state.Ipv6 = ipv6
+    state.Tables = make(map[string]*IptablesTable)
+
+    table := &IptablesTable{}
+    table.Name = "filter"
+    table.Chains = make(map[string]*IptablesChain)
+
+    addRules := func(chain *IptablesChain, spec string, source string, line int) error {
+        rules, err := parseIptablesRule(ipv6, spec)
+        if err != nil {
+            return fileError(source, line, err)
+        }
+        for _, rule := range rules {
+            rule.Source = source
+            rule.Line = line
+        }
+        chain.Rules = append(chain.Rules, rules...)
+        return nil
+    }
+
+    for _, rule := range s.Rules {
+        builtin := policyChain(rule)
+        name := "POLICY-" + builtin
+
+        chain := table.Chains[name]
+        if chain == nil {
+            parent := &IptablesChain{Name: builtin, Default: "-"}
+            table.Chains[builtin] = parent
+
+            err := addRules(parent, "-j "+name, rule.Source, rule.Line)
+            if err != nil {
+                return nil, err
+            }
+
+            chain = &IptablesChain{Name: name, Default: "-"}
+            table.Chains[name] = chain
+
+            err = addRules(chain, "-m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT", rule.Source, rule.Line)
+            if err != nil {
+                return nil, err
+            }
+        }
+
+        target := policyActions[rule.Action]
+
+        for _, from := range s.zoneMatches(rule.From, "src", ipv6, ipsets) {
+            for _, to := range s.zoneMatches(rule.To, "dst", ipv6, ipsets) {
+                for _, service := range s.serviceMatches(rule.Services, ipv6) {
+                    spec := strings.TrimSpace(strings.Join([]string{from, to, service}, " ") + " -j " + target)
+
+                    err := addRules(chain, spec, rule.Source, rule.Line)
+                    if err != nil {
+                        return nil, err
+                    }
+                }
+            }
+        }
+    }
+
+    if len(table.Chains) != 0 {
+        state.Tables[table.Name] = table
+    }
+
+    return state, nil
+}
+
+// readPolicy compiles the policy files for this manager's family, returning nil if there are none
+func (s *IptablesManager) readPolicy(basedir string) (*IptablesState, error) {
+    policy, err := readFirewallPolicy(policyDir(basedir))
+    if err != nil {
+        return nil, err
+    }
+
+    if policy == nil {
+        return nil, nil
+    }
+
+    // Only zones of ipsets need the ipset families
+    ipsets := make(map[string]string)
+    for _, zone := range policy.Zones {
+        if len(zone.Ipsets) == 0 {
+            continue
+        }
+
+        ipsets, err = s.ipsetFamilies(path.Dir(basedir) + "/ipset")
+        if err != nil {
+            return nil, err
+        }
+        break
+    }
+
+    return policy.compile(s.Ipv6, ipsets)
+}
+
+func readPolicyState(file string) ([]string, error) {
+    text, err := gommons.TryReadTextFile(file, "")
+    if err != nil {
+        return nil, err
+    }
+
+    statements := []string{}
+    for _, line := range strings.Split(text, "\n") {
+        if line != "" {
+            statements = append(statements, line)
+        }
+    }
+    return statements, nil
+}
+
+// planPolicy reports the policy statements added and removed since the policy was last applied.
+// The rule changes they cause are planned by the iptables managers; this records the policy once they're applied.
+func (s *FirewallManager) planPolicy(basedir string) (*Plan, error) {
+    plan := &Plan{}
+
+    policy, err := readFirewallPolicy(basedir + "/policy")
+    if err != nil {
+        return nil, err
+    }
+
+    if policy == nil {
+        policy = newFirewallPolicy()
+    }
+
+    statePath := s.runtime.Config.PolicyStateFile
+
+    applied, err := readPolicyState(statePath)
+    if err != nil {
+        return nil, err
+    }
+
+    var desired bytes.Buffer
+    declared := make(map[string]bool)
+
+    for _, statement := range policy.Statements {
+        desired.WriteString(statement.Text + "\n")
+        declared[statement.Text] = true
+
+        if containsString(applied, statement.Text) {
+            continue
+        }
+
+        change := &Change{}
+        change.Manager = "policy"
+        change.Key = statement.Text
+        change.Action = ActionAdd
+        change.Desired = fmt.Sprintf("%s  # %s:%d", statement.Text, statement.Source, statement.Line)
+        plan.add(change)
+    }
+
+    for _, statement := range applied {
+        if declared[statement] {
+            continue
+        }
+
+        change := &Change{}
+        change.Manager = "policy"
+        change.Key = statement
+        change.Action = ActionRemove
+        change.Current = statement
+        plan.add(change)
+    }
+
+    if plan.IsEmpty() {
+        return plan, nil
+    }
+
+    conf := desired.String()
+
+    plan.addAction(func() error {
+        log.Printf("policy: Recording applied policy in %s", statePath)
+
+        err := os.MkdirAll(filepath.Dir(statePath), 0700)
+        if err != nil {
+            return err
+        }
+
+        return ioutil.WriteFile(statePath, []byte(conf), 0600)
+    })
+
+    return plan, nil
+}
@@ -0,0 +1,425 @@
+package applyd
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Firewall stats report the packet and byte counters of every iptables rule, grouped by the apply.d file it came from.
+// The kernel only knows the counts since each rule was created, so we remember (in firewall-stats-file)
+// when each rule was first seen and last hit; a rule with no hits for firewall-unused-after is a cleanup candidate.
+
+type FirewallRuleStats struct {
+    Command string
+    Table   string
+    Chain   string
+    // The rule number, counting from 1 as iptables --line-numbers does
+    Number int
+    Spec   string
+    // The file and line the rule was declared at, or "" if it isn't in apply.d
+    Origin string
+
+    Packets uint64
+    Bytes   uint64
+
+    // Zero if the rule hasn't been hit since we started tracking it
+    LastHit time.Time
+    Unused  bool
+
+    // Distinguishes identical rules in a chain; occurrence counts them from 1
+    key        string
+    occurrence int
+}
+
+type FirewallStats struct {
+    Captured    time.Time
+    UnusedAfter time.Duration
+    Rules       []*FirewallRuleStats
+}
+
+type firewallRuleHistory struct {
+    FirstSeen time.Time
+    LastHit   time.Time
+    Packets   uint64
+}
+
+type firewallStatsHistory struct {
+    Rules map[string]*firewallRuleHistory
+}
+
+func readFirewallStatsHistory(path string) (*firewallStatsHistory, error) {
+    history := &firewallStatsHistory{}
+
+    data, err := ioutil.ReadFile(path)
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+
+    if err == nil {
+        err = json.Unmarshal(data, history)
+        if err != nil {
+            return nil, fmt.Errorf("Error parsing firewall stats %s: %v", path, err)
+        }
+    }
+
+    if history.Rules == nil {
+        history.Rules = make(map[string]*firewallRuleHistory)
+    }
+
+    return history, nil
+}
+
+func (s *firewallStatsHistory) write(path string) error {
+    data, err := json.MarshalIndent(s, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    err = os.MkdirAll(filepath.Dir(path), 0700)
+    if err != nil {
+        return err
+    }
+
+    return ioutil.WriteFile(path, data, 0600)
+}
+
+// update records the rule's counters, and decides whether it is unused
+func (s *firewallStatsHistory) update(rule *FirewallRuleStats, now time.Time, unusedAfter time.Duration) {
+    h := s.Rules[rule.key]
+    if h == nil {
+        h = &firewallRuleHistory{}
+        h.FirstSeen = now
+        s.Rules[rule.key] = h
+
+        if rule.Packets != 0 {
+            h.LastHit = now
+        }
+    } else if rule.Packets > h.Packets || (rule.Packets < h.Packets && rule.Packets != 0) {
+        // Counters go backwards if the rule was recreated without them
+        h.LastHit = now
+    }
+    h.Packets = rule.Packets
+
+    rule.LastHit = h.LastHit
+
+    cutoff := now.Add(-unusedAfter)
+    if h.LastHit.IsZero() {
+        rule.Unused = h.FirstSeen.Before(cutoff)
+    } else {
+        rule.Unused = h.LastHit.Before(cutoff)
+    }
+}
+
+// stats returns the counters of every rule in the kernel, with the apply.d location of the rules declared there
+func (s *IptablesManager) stats(basedir string) ([]*FirewallRuleStats, error) {
+    current, err := iptablesSave(s.runtime, s.Ipv6)
+    if err != nil {
+        return nil, err
+    }
+
+    desired, err := s.readDesired(basedir)
+    if err != nil {
+        return nil, err
+    }
+
+    stats := []*FirewallRuleStats{}
+
+    for _, tableName := range current.tableNames() {
+        table := current.Tables[tableName]
+
+        for _, chainName := range table.chainNames() {
+            chain := table.Chains[chainName]
+
+            // Declared rules are paired with kernel rules in order, as identical rules can repeat
+            declared := make(map[string][]*IptablesRule)
+            if desired != nil && desired.Tables[tableName] != nil && desired.Tables[tableName].Chains[chainName] != nil {
+                for _, rule := range desired.Tables[tableName].Chains[chainName].Rules {
+                    declared[rule.Spec] = append(declared[rule.Spec], rule)
+                }
+            }
+
+            seen := make(map[string]int)
+
+            for i, rule := range chain.Rules {
+                r := &FirewallRuleStats{}
+                r.Command = s.command()
+                r.Table = tableName
+                r.Chain = chainName
+                r.Number = i + 1
+                r.Spec = rule.Spec
+                r.Packets = rule.Counters.Packets
+                r.Bytes = rule.Counters.Bytes
+
+                candidates := declared[rule.Spec]
+                if len(candidates) != 0 {
+                    r.Origin = candidates[0].location()
+                    declared[rule.Spec] = candidates[1:]
+                } else {
+                    r.Origin = rule.sourceTag()
+                }
+
+                seen[rule.Spec]++
+                r.occurrence = seen[rule.Spec]
+                r.key = fmt.Sprintf("%s %s/%s %s", r.Command, tableName, chainName, rule.Spec)
+                if seen[rule.Spec] > 1 {
+                    r.key += fmt.Sprintf(" #%d", seen[rule.Spec])
+                }
+
+                stats = append(stats, r)
+            }
+        }
+    }
+
+    return stats, nil
+}
+
+func (s *FirewallManager) Stats(basedir string) (*FirewallStats, error) {
+    if s.useNftables() {
+        return nil, fmt.Errorf("Firewall stats are only supported with the iptables backend")
+    }
+
+    config := s.runtime.Config
+
+    stats := &FirewallStats{}
+    stats.Captured = time.Now().UTC()
+    stats.UnusedAfter = config.FirewallUnusedAfter
+
+    for _, iptables := range []*IptablesManager{s.ip4tables, s.ip6tables} {
+        rules, err := iptables.stats(basedir + "/" + iptables.command())
+        if err != nil {
+            return nil, err
+        }
+        stats.Rules = append(stats.Rules, rules...)
+    }
+
+    history, err := readFirewallStatsHistory(config.FirewallStatsFile)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, rule := range stats.Rules {
+        history.update(rule, stats.Captured, config.FirewallUnusedAfter)
+    }
+
+    // A snapshot isn't the host, so it mustn't change what we remember about the host
+    if s.runtime.snapshot != nil {
+        return stats, nil
+    }
+
+    // Rules that no longer exist are forgotten
+    keys := make(map[string]bool)
+    for _, rule := range stats.Rules {
+        keys[rule.key] = true
+    }
+    for key, _ := range history.Rules {
+        if !keys[key] {
+            delete(history.Rules, key)
+        }
+    }
+
+    err = history.write(config.FirewallStatsFile)
+    if err != nil {
+        return nil, err
+    }
+
+    return stats, nil
+}
+
+// Describe lists the rules grouped by the file that declared them; rules not in apply.d come last
+func (s *FirewallStats) Describe() string {
+    var buffer bytes.Buffer
+
+    groups := make(map[string][]*FirewallRuleStats)
+    for _, rule := range s.Rules {
+        file := rule.Origin
+        if i := strings.LastIndex(file, ":"); i != -1 {
+            file = file[:i]
+        }
+        groups[file] = append(groups[file], rule)
+    }
+
+    files := []string{}
+    for file, _ := range groups {
+        if file != "" {
+            files = append(files, file)
+        }
+    }
+    sort.Strings(files)
+    if groups[""] != nil {
+        files = append(files, "")
+    }
+
+    unused := 0
+
+    for _, file := range files {
+        if file == "" {
+            buffer.WriteString("(not declared in apply.d)\n")
+        } else {
+            buffer.WriteString(file + "\n")
+        }
+
+        for _, rule := range groups[file] {
+            line := fmt.Sprintf("  %s %s/%s %d: %d packets, %d bytes: -A %s %s", rule.Command, rule.Table, rule.Chain, rule.Number, rule.Packets, rule.Bytes, rule.Chain, rule.Spec)
+            if rule.Unused {
+                unused++
+                if rule.LastHit.IsZero() {
+                    line += "  # unused: never hit"
+                } else {
+                    line += "  # unused: last hit " + rule.LastHit.Format(time.RFC3339)
+                }
+            }
+            buffer.WriteString(line + "\n")
+        }
+    }
+
+    buffer.WriteString(fmt.Sprintf("%d rules, %d with no hits in %s\n", len(s.Rules), unused, s.UnusedAfter))
+
+    return buffer.String()
+}
+
+func (s *Runtime) FirewallStats(basedir string) (*FirewallStats, error) {
+    return s.Firewall.Stats(basedir)
+}
+
+// firewallMetrics accumulates counter deltas between polls, so the exported counters never go backwards,
+// even when a rule is recreated.
+type firewallMetrics struct {
+    mutex sync.Mutex
+
+    previous map[string]*FirewallRuleStats
+    packets  map[string]uint64
+    bytes    map[string]uint64
+    last     *FirewallStats
+}
+
+func newFirewallMetrics() *firewallMetrics {
+    m := &firewallMetrics{}
+    m.previous = make(map[string]*FirewallRuleStats)
+    m.packets = make(map[string]uint64)
+    m.bytes = make(map[string]uint64)
+    return m
+}
+
+func counterDelta(previous uint64, current uint64) uint64 {
+    if current < previous {
+        // Reset; everything counted since is new
+        return current
+    }
+    return current - previous
+}
+
+func (s *firewallMetrics) record(stats *FirewallStats) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    previous := make(map[string]*FirewallRuleStats)
+    for _, rule := range stats.Rules {
+        // The first poll of a rule is its baseline
+        p := s.previous[rule.key]
+        if p != nil {
+            s.packets[rule.key] += counterDelta(p.Packets, rule.Packets)
+            s.bytes[rule.key] += counterDelta(p.Bytes, rule.Bytes)
+        }
+        previous[rule.key] = rule
+    }
+
+    for key, _ := range s.packets {
+        if previous[key] == nil {
+            delete(s.packets, key)
+            delete(s.bytes, key)
+        }
+    }
+
+    s.previous = previous
+    s.last = stats
+}
+
+func escapeMetricLabel(s string) string {
+    s = strings.Replace(s, "\\", "\\\\", -1)
+    s = strings.Replace(s, "\"", "\\\"", -1)
+    s = strings.Replace(s, "\n", "\\n", -1)
+    return s
+}
+
+// write renders the metrics in the Prometheus text format
+func (s *firewallMetrics) write(buffer *bytes.Buffer) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if s.last == nil {
+        return
+    }
+
+    // Identical rules in a chain would otherwise be the same series
+    labels := func(rule *FirewallRuleStats) string {
+        return fmt.Sprintf("{command=\"%s\",table=\"%s\",chain=\"%s\",rule=\"%s\",occurrence=\"%d\",origin=\"%s\"}",
+            rule.Command, rule.Table, rule.Chain, escapeMetricLabel(rule.Spec), rule.occurrence, escapeMetricLabel(rule.Origin))
+    }
+
+    buffer.WriteString("# HELP applyd_firewall_rule_packets_total Packets matched by the rule since applyd started watching\n")
+    buffer.WriteString("# TYPE applyd_firewall_rule_packets_total counter\n")
+    for _, rule := range s.last.Rules {
+        buffer.WriteString(fmt.Sprintf("applyd_firewall_rule_packets_total%s %d\n", labels(rule), s.packets[rule.key]))
+    }
+
+    buffer.WriteString("# HELP applyd_firewall_rule_bytes_total Bytes matched by the rule since applyd started watching\n")
+    buffer.WriteString("# TYPE applyd_firewall_rule_bytes_total counter\n")
+    for _, rule := range s.last.Rules {
+        buffer.WriteString(fmt.Sprintf("applyd_firewall_rule_bytes_total%s %d\n", labels(rule), s.bytes[rule.key]))
+    }
+
+    buffer.WriteString("# HELP applyd_firewall_rule_unused Whether the rule has had no hits for firewall-unused-after\n")
+    buffer.WriteString("# TYPE applyd_firewall_rule_unused gauge\n")
+    for _, rule := range s.last.Rules {
+        unused := 0
+        if rule.Unused {
+            unused = 1
+        }
+        buffer.WriteString(fmt.Sprintf("applyd_firewall_rule_unused%s %d\n", labels(rule), unused))
+    }
+}
+
+// ServeFirewallMetrics polls the firewall counters every interval, and serves them on listen at /metrics
+func (s *Runtime) ServeFirewallMetrics(basedir string, listen string, interval time.Duration) error {
+    metrics := newFirewallMetrics()
+
+    poll := func() {
+        stats, err := s.FirewallStats(basedir)
+        if err != nil {
+            log.Printf("stats: Error reading firewall counters: %v", err)
+            return
+        }
+        metrics.record(stats)
+    }
+
+    poll()
+
+    go func() {
+        for range time.Tick(interval) {
+            poll()
+        }
+    }()
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+        var buffer bytes.Buffer
+        metrics.write(&buffer)
+
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+        w.Write(buffer.Bytes())
+    })
+
+    log.Printf("stats: Serving firewall metrics on %s/metrics, polling every %s", listen, interval)
+
+    return http.ListenAndServe(listen, mux)
+}
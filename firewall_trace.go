@@ -0,0 +1,808 @@
+package applyd
+
+import (
+    "bytes"
+    "fmt"
+    "log"
+    "net"
+    "strconv"
+    "strings"
+)
+
+// A trace evaluates a hypothetical packet against the desired rules in apply.d, without changing the kernel.
+// It follows the packet through the raw, mangle, nat and filter tables for its path (INPUT, FORWARD or OUTPUT),
+// into user chains, and through ipset lookups against the sets declared in apply.d.
+// Matches we can't evaluate offline are assumed to match, and the trace says so.
+// A DNAT in PREROUTING can change where the packet goes: the path is decided again from the new destination,
+// against the host's addresses and the vips and routes in apply.d.
+
+type TracePacket struct {
+    Protocol        string
+    Source          net.IP
+    Destination     net.IP
+    SourcePort      int
+    DestinationPort int
+    InInterface     string
+    OutInterface    string
+
+    // The conntrack state: NEW, ESTABLISHED, RELATED, INVALID or UNTRACKED
+    State string
+    // For tcp; defaults to SYN for a NEW connection, ACK otherwise
+    TcpFlags []string
+    // For icmp, the type (and optionally code), as numbers: 8 or 3/1
+    IcmpType string
+}
+
+type TraceStep struct {
+    Table string
+    Chain string
+    // The rule number, counting from 1; 0 for the chain policy
+    Number int
+    Rule   *IptablesRule
+    Text   string
+}
+
+type FirewallTrace struct {
+    Packet  *TracePacket
+    Path    string
+    Steps   []*TraceStep
+    Verdict string
+}
+
+// The hooks a packet passes through, in order, for each path
+var tracePaths = map[string][]string{
+    "INPUT":   {"raw/PREROUTING", "mangle/PREROUTING", "nat/PREROUTING", "mangle/INPUT", "filter/INPUT", "nat/INPUT"},
+    "FORWARD": {"raw/PREROUTING", "mangle/PREROUTING", "nat/PREROUTING", "mangle/FORWARD", "filter/FORWARD", "mangle/POSTROUTING", "nat/POSTROUTING"},
+    "OUTPUT":  {"raw/OUTPUT", "mangle/OUTPUT", "nat/OUTPUT", "filter/OUTPUT", "mangle/POSTROUTING", "nat/POSTROUTING"},
+}
+
+// Targets that end the packet's traversal entirely
+var traceFinalTargets = []string{"DROP", "REJECT", "QUEUE", "NFQUEUE"}
+
+// Targets that end the traversal of the table, accepting the packet
+var traceNatTargets = []string{"DNAT", "SNAT", "MASQUERADE", "REDIRECT", "NETMAP"}
+
+const traceMaxDepth = 64
+
+func (s *TracePacket) ipv6() bool {
+    ip := s.Source
+    if ip == nil {
+        ip = s.Destination
+    }
+    return ip != nil && ip.To4() == nil
+}
+
+// Path returns the path the packet takes: INPUT if it only has an input interface, OUTPUT if it only has an output interface
+func (s *TracePacket) Path() string {
+    if s.InInterface != "" && s.OutInterface != "" {
+        return "FORWARD"
+    }
+    if s.OutInterface != "" {
+        return "OUTPUT"
+    }
+    return "INPUT"
+}
+
+func (s *TracePacket) normalize() {
+    s.Protocol = canonicalIptablesProtocol(s.Protocol)
+    if s.Protocol == "icmp" && s.ipv6() {
+        s.Protocol = "ipv6-icmp"
+    }
+
+    s.State = strings.ToUpper(s.State)
+    if s.State == "" {
+        s.State = "NEW"
+    }
+
+    if s.Protocol == "tcp" && len(s.TcpFlags) == 0 {
+        if s.State == "NEW" {
+            s.TcpFlags = []string{"SYN"}
+        } else {
+            s.TcpFlags = []string{"ACK"}
+        }
+    }
+}
+
+func (s *TracePacket) String() string {
+    var buffer bytes.Buffer
+
+    endpoint := func(ip net.IP, port int) string {
+        text := "*"
+        if ip != nil {
+            text = ip.String()
+        }
+        if port != 0 {
+            if ip != nil && ip.To4() == nil {
+                text = "[" + text + "]"
+            }
+            text += ":" + strconv.Itoa(port)
+        }
+        return text
+    }
+
+    buffer.WriteString(s.Protocol + " " + endpoint(s.Source, s.SourcePort) + " -> " + endpoint(s.Destination, s.DestinationPort))
+    if s.InInterface != "" {
+        buffer.WriteString(" in " + s.InInterface)
+    }
+    if s.OutInterface != "" {
+        buffer.WriteString(" out " + s.OutInterface)
+    }
+    buffer.WriteString(" " + s.State)
+    if len(s.TcpFlags) != 0 {
+        buffer.WriteString(" " + strings.Join(s.TcpFlags, ","))
+    }
+    if s.IcmpType != "" {
+        buffer.WriteString(" type " + s.IcmpType)
+    }
+
+    return buffer.String()
+}
+
+type iptablesTracer struct {
+    rules  *IptablesState
+    ipsets *IpsetState
+    packet *TracePacket
+    trace  *FirewallTrace
+
+    // The addresses of this host, and the routes to everything else
+    local  []net.IP
+    routes *RoutesState
+}
+
+func (t *iptablesTracer) isLocal(ip net.IP) bool {
+    for _, local := range t.local {
+        if local.Equal(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// reroute decides the path again after the destination changed in PREROUTING, noting any change in the trace
+func (t *iptablesTracer) reroute(table string, chain string) {
+    p := t.packet
+    if p.Destination == nil || t.trace.Path == "OUTPUT" || len(t.local) == 0 {
+        return
+    }
+
+    path := "FORWARD"
+    if t.isLocal(p.Destination) {
+        path = "INPUT"
+    }
+    if path == t.trace.Path {
+        return
+    }
+
+    text := "rerouted from " + t.trace.Path + " to " + path + ": " + p.Destination.String()
+    if path == "INPUT" {
+        text += " is local"
+        p.OutInterface = ""
+    } else {
+        text += " is not local"
+        if p.OutInterface == "" && t.routes != nil {
+            route := t.routes.lookup(p.Destination)
+            if route != nil && route.Device != "" {
+                p.OutInterface = route.Device
+            }
+        }
+        if p.OutInterface != "" {
+            text += ", out " + p.OutInterface
+        } else {
+            text += "; no route gives the output interface, so -o matches are assumed"
+        }
+    }
+
+    t.step(table, chain, 0, nil, text)
+    t.trace.Path = path
+}
+
+func (t *iptablesTracer) step(table string, chain string, number int, rule *IptablesRule, text string) {
+    t.trace.Steps = append(t.trace.Steps, &TraceStep{Table: table, Chain: chain, Number: number, Rule: rule, Text: text})
+}
+
+// run passes the packet through each hook of its path, returning the final verdict
+func (t *iptablesTracer) run() (string, error) {
+    hooks := tracePaths[t.trace.Path]
+    for i := 0; i < len(hooks); i++ {
+        hook := hooks[i]
+        parts := strings.SplitN(hook, "/", 2)
+        tableName, chainName := parts[0], parts[1]
+
+        // Only the first packet of a connection sees the nat table
+        if tableName == "nat" && t.packet.State != "NEW" {
+            continue
+        }
+
+        table := t.rules.Tables[tableName]
+        if table == nil || table.Chains[chainName] == nil {
+            continue
+        }
+
+        destination := t.packet.Destination
+
+        verdict, err := t.chain(table, chainName, 0)
+        if err != nil {
+            return "", err
+        }
+
+        if verdict == "" {
+            policy := table.Chains[chainName].Default
+            if policy == "" || policy == "-" {
+                policy = "ACCEPT"
+            }
+            t.step(tableName, chainName, 0, nil, "policy "+policy)
+            verdict = policy
+        }
+
+        if verdict != "ACCEPT" {
+            return verdict, nil
+        }
+
+        if hook == "nat/PREROUTING" && !destination.Equal(t.packet.Destination) {
+            t.reroute(tableName, chainName)
+
+            // The paths share the PREROUTING hooks, so we carry on after this one
+            hooks = tracePaths[t.trace.Path]
+            i = indexOf(hooks, hook)
+        }
+    }
+
+    return "ACCEPT", nil
+}
+
+// chain evaluates the packet against a chain, returning the verdict, or "" if the packet returns from the chain
+func (t *iptablesTracer) chain(table *IptablesTable, name string, depth int) (string, error) {
+    if depth > traceMaxDepth {
+        return "", fmt.Errorf("Chain loop reached %s/%s", table.Name, name)
+    }
+
+    chain := table.Chains[name]
+    if chain == nil {
+        return "", fmt.Errorf("Jump to undeclared chain %s/%s", table.Name, name)
+    }
+
+    for i, rule := range chain.Rules {
+        matched, assumed := t.matches(rule)
+        if !matched {
+            continue
+        }
+
+        text := "-A " + name + " " + rule.Spec
+        if len(assumed) != 0 {
+            text += "  # assumed to match: " + strings.Join(assumed, ", ")
+        }
+        t.step(table.Name, name, i+1, rule, text)
+
+        target := rule.Target
+        switch {
+        case target == "":
+            // Counts the packet, and nothing more
+
+        case target == "ACCEPT":
+            return "ACCEPT", nil
+
+        case target == "RETURN":
+            return "", nil
+
+        case containsString(traceFinalTargets, target):
+            return target, nil
+
+        case containsString(traceNatTargets, target):
+            t.nat(rule)
+            t.trace.Steps[len(t.trace.Steps)-1].Text += "  # now " + t.packet.String()
+            return "ACCEPT", nil
+
+        case target == "NOTRACK" || (target == "CT" && targetOption(rule, "--notrack") != nil):
+            t.packet.State = "UNTRACKED"
+
+        case table.Chains[target] != nil:
+            verdict, err := t.chain(table, target, depth+1)
+            if err != nil {
+                return "", err
+            }
+            if verdict != "" {
+                return verdict, nil
+            }
+
+            // With -g, returning from the target returns from this chain too
+            if rule.Jump == "-g" {
+                return "", nil
+            }
+
+        default:
+            // LOG, MARK and the like don't decide the packet's fate
+        }
+    }
+
+    return "", nil
+}
+
+func targetOption(rule *IptablesRule, name string) *IptablesOption {
+    for _, o := range rule.TargetOptions {
+        if o.Name == name {
+            return o
+        }
+    }
+    return nil
+}
+
+// nat rewrites the packet as a nat target would
+func (t *iptablesTracer) nat(rule *IptablesRule) {
+    var to *IptablesOption
+    switch rule.Target {
+    case "DNAT":
+        to = targetOption(rule, "--to-destination")
+    case "SNAT":
+        to = targetOption(rule, "--to-source")
+    case "REDIRECT":
+        ports := targetOption(rule, "--to-ports")
+        if ports != nil && len(ports.Values) == 1 {
+            port, err := strconv.Atoi(strings.SplitN(ports.Values[0], "-", 2)[0])
+            if err == nil {
+                t.packet.DestinationPort = port
+            }
+        }
+        return
+    }
+
+    if to == nil || len(to.Values) != 1 {
+        return
+    }
+
+    // The first address (and port) of any range
+    value := strings.SplitN(to.Values[0], "-", 2)[0]
+    host, portText := value, ""
+    if strings.HasPrefix(value, "[") {
+        end := strings.Index(value, "]")
+        if end != -1 {
+            host = value[1:end]
+            portText = strings.TrimPrefix(value[end+1:], ":")
+        }
+    } else if strings.Count(value, ":") == 1 {
+        parts := strings.SplitN(value, ":", 2)
+        host, portText = parts[0], parts[1]
+    }
+
+    ip := net.ParseIP(host)
+    port, _ := strconv.Atoi(portText)
+
+    if rule.Target == "DNAT" {
+        if ip != nil {
+            t.packet.Destination = ip
+        }
+        if port != 0 {
+            t.packet.DestinationPort = port
+        }
+    } else {
+        if ip != nil {
+            t.packet.Source = ip
+        }
+        if port != 0 {
+            t.packet.SourcePort = port
+        }
+    }
+}
+
+// matches evaluates the rule's matches, returning whether it matched, and the matches that were assumed
+func (t *iptablesTracer) matches(rule *IptablesRule) (bool, []string) {
+    assumed := []string{}
+
+    for _, o := range rule.Options {
+        matched, ok := t.matchOption(o)
+        if !ok {
+            assumed = append(assumed, o.Name+" "+strings.Join(o.Values, " "))
+            continue
+        }
+        if matched == o.Negated {
+            return false, nil
+        }
+    }
+
+    for _, m := range rule.Matches {
+        for _, o := range m.Options {
+            matched, ok := t.matchModule(m.Module, o)
+            if !ok {
+                assumed = append(assumed, "-m "+m.Module+" "+o.Name)
+                continue
+            }
+            if matched == o.Negated {
+                return false, nil
+            }
+        }
+    }
+
+    return true, assumed
+}
+
+func matchTraceAddress(ip net.IP, cidr string) (bool, bool) {
+    if ip == nil {
+        return false, false
+    }
+
+    _, network, err := net.ParseCIDR(cidr)
+    if err != nil {
+        // A hostname, which we'd have to resolve
+        return false, false
+    }
+
+    return network.Contains(ip), true
+}
+
+// matchTraceInterface matches an interface name; a trailing + matches any suffix
+func matchTraceInterface(iface string, pattern string) bool {
+    if strings.HasSuffix(pattern, "+") {
+        return strings.HasPrefix(iface, strings.TrimSuffix(pattern, "+"))
+    }
+    return iface == pattern
+}
+
+// matchTracePorts matches a port against a list of ports and ranges, e.g. 22,80,1000:2000
+func matchTracePorts(port int, ports string) (bool, bool) {
+    ranges, ok := parsePortRanges(ports)
+    if !ok {
+        return false, false
+    }
+
+    for _, r := range ranges {
+        if port >= r[0] && port <= r[1] {
+            return true, true
+        }
+    }
+    return false, true
+}
+
+// matchOption evaluates -s, -d, -i, -o, -p and -f, ignoring negation.  The second result is false if we can't evaluate it.
+func (t *iptablesTracer) matchOption(o *IptablesOption) (bool, bool) {
+    p := t.packet
+
+    switch o.Name {
+    case "-s":
+        return matchTraceAddress(p.Source, o.Values[0])
+    case "-d":
+        return matchTraceAddress(p.Destination, o.Values[0])
+    case "-i":
+        return matchTraceInterface(p.InInterface, o.Values[0]), true
+    case "-o":
+        if p.OutInterface == "" && t.trace.Path == "FORWARD" {
+            // Forwarded after a DNAT, to an interface we couldn't tell
+            return false, false
+        }
+        return matchTraceInterface(p.OutInterface, o.Values[0]), true
+    case "-p":
+        return o.Values[0] == "all" || o.Values[0] == p.Protocol, true
+    case "-f":
+        // We only trace first fragments (or unfragmented packets)
+        return false, true
+    }
+
+    return false, false
+}
+
+func (t *iptablesTracer) matchModule(module string, o *IptablesOption) (bool, bool) {
+    p := t.packet
+
+    switch module {
+    case "tcp", "udp", "sctp", "multiport":
+        switch o.Name {
+        case "--sport", "--sports":
+            return matchTracePorts(p.SourcePort, o.Values[0])
+        case "--dport", "--dports":
+            return matchTracePorts(p.DestinationPort, o.Values[0])
+        case "--ports":
+            source, ok := matchTracePorts(p.SourcePort, o.Values[0])
+            destination, _ := matchTracePorts(p.DestinationPort, o.Values[0])
+            return source || destination, ok
+        case "--tcp-flags":
+            return matchTraceTcpFlags(p.TcpFlags, o.Values[0], o.Values[1]), true
+        }
+
+    case "icmp", "icmp6":
+        if o.Name == "--icmp-type" || o.Name == "--icmpv6-type" {
+            if o.Values[0] == "any" {
+                return true, true
+            }
+            if p.IcmpType == "" {
+                return false, false
+            }
+            // A rule for the type matches any code
+            return o.Values[0] == p.IcmpType || o.Values[0] == strings.SplitN(p.IcmpType, "/", 2)[0], true
+        }
+
+    case "conntrack", "state":
+        if o.Name == "--ctstate" || o.Name == "--state" {
+            return containsString(strings.Split(o.Values[0], ","), p.State), true
+        }
+
+    case "iprange":
+        if o.Name == "--src-range" || o.Name == "--dst-range" {
+            ip := p.Source
+            if o.Name == "--dst-range" {
+                ip = p.Destination
+            }
+            return matchTraceRange(ip, o.Values[0])
+        }
+
+    case "set":
+        if o.Name == "--match-set" && len(o.Values) == 2 {
+            return t.matchSet(o.Values[0], strings.Split(o.Values[1], ","), 0)
+        }
+
+    case "comment", "limit":
+        return true, true
+    }
+
+    return false, false
+}
+
+func matchTraceTcpFlags(flags []string, mask string, comp string) bool {
+    set := func(list string) map[string]bool {
+        m := make(map[string]bool)
+        if list == "NONE" {
+            return m
+        }
+        for _, f := range strings.Split(list, ",") {
+            m[f] = true
+        }
+        return m
+    }
+
+    masked := set(mask)
+    want := set(comp)
+    have := set(strings.Join(flags, ","))
+
+    for flag, _ := range masked {
+        if have[flag] != want[flag] {
+            return false
+        }
+    }
+    return true
+}
+
+func matchTraceRange(ip net.IP, ipRange string) (bool, bool) {
+    bounds := strings.SplitN(ipRange, "-", 2)
+    if ip == nil || len(bounds) != 2 {
+        return false, false
+    }
+
+    low := net.ParseIP(bounds[0])
+    high := net.ParseIP(bounds[1])
+    if low == nil || high == nil {
+        return false, false
+    }
+
+    return bytes.Compare(ip.To16(), low.To16()) >= 0 && bytes.Compare(ip.To16(), high.To16()) <= 0, true
+}
+
+// matchSet looks the packet up in a declared ipset; directions is the src,dst flags of --match-set
+func (t *iptablesTracer) matchSet(name string, directions []string, depth int) (bool, bool) {
+    ipset := t.ipsets.Ipsets[name]
+    if ipset == nil || depth > traceMaxDepth {
+        return false, false
+    }
+
+    fields := strings.Fields(ipset.Spec)
+    if len(fields) == 0 {
+        return false, false
+    }
+
+    setType := fields[0]
+
+    if setType == "list:set" {
+        for _, member := range ipset.Members {
+            matched, ok := t.matchSet(strings.Fields(member)[0], directions, depth+1)
+            if !ok {
+                return false, false
+            }
+            if matched {
+                return true, true
+            }
+        }
+        return false, true
+    }
+
+    colon := strings.Index(setType, ":")
+    if colon == -1 {
+        return false, false
+    }
+    dimensions := strings.Split(setType[colon+1:], ",")
+    if len(directions) < len(dimensions) {
+        return false, false
+    }
+
+    // nomatch entries are exceptions to the wider entries of the set
+    found := false
+    for _, member := range ipset.Members {
+        memberFields := strings.Fields(member)
+        if len(memberFields) == 0 {
+            continue
+        }
+
+        values := strings.Split(memberFields[0], ",")
+        if len(values) != len(dimensions) {
+            return false, false
+        }
+
+        matched := true
+        for i, dimension := range dimensions {
+            ok := false
+            matched, ok = t.matchSetValue(dimension, directions[i], values[i])
+            if !ok {
+                return false, false
+            }
+            if !matched {
+                break
+            }
+        }
+
+        if !matched {
+            continue
+        }
+        if containsString(memberFields[1:], "nomatch") {
+            return false, true
+        }
+        found = true
+    }
+
+    return found, true
+}
+
+func (t *iptablesTracer) matchSetValue(dimension string, direction string, value string) (bool, bool) {
+    p := t.packet
+
+    switch dimension {
+    case "ip", "net":
+        ip := p.Source
+        if direction == "dst" {
+            ip = p.Destination
+        }
+        if ip == nil {
+            return false, false
+        }
+
+        if strings.Contains(value, "-") {
+            return matchTraceRange(ip, value)
+        }
+        if !strings.Contains(value, "/") {
+            member := net.ParseIP(value)
+            return member != nil && member.Equal(ip), member != nil
+        }
+        return matchTraceAddress(ip, value)
+
+    case "port":
+        port := p.SourcePort
+        if direction == "dst" {
+            port = p.DestinationPort
+        }
+
+        protocol := "tcp"
+        if i := strings.Index(value, ":"); i != -1 {
+            protocol = canonicalIptablesProtocol(value[:i])
+            value = value[i+1:]
+        }
+        if protocol != p.Protocol {
+            return false, true
+        }
+        return matchTracePorts(port, strings.Replace(value, "-", ":", 1))
+
+    case "iface":
+        iface := p.InInterface
+        if direction == "dst" {
+            iface = p.OutInterface
+        }
+        return iface == value, true
+    }
+
+    return false, false
+}
+
+func (s *FirewallManager) trace(basedir string, packet *TracePacket) (*FirewallTrace, error) {
+    if s.useNftables() {
+        return nil, fmt.Errorf("Tracing is only supported with the iptables backend")
+    }
+
+    packet.normalize()
+
+    iptables := s.ip4tables
+    if packet.ipv6() {
+        iptables = s.ip6tables
+    }
+
+    rules, err := iptables.readDesired(basedir + "/" + iptables.command())
+    if err != nil {
+        return nil, err
+    }
+    if rules == nil {
+        rules = &IptablesState{Ipv6: iptables.Ipv6, Tables: make(map[string]*IptablesTable)}
+    }
+
+    ipsets, err := s.ipsets.readDesired(basedir + "/ipset")
+    if err != nil {
+        return nil, err
+    }
+
+    trace := &FirewallTrace{}
+    trace.Path = packet.Path()
+
+    // The trace reports the packet as it arrived, before any nat
+    original := *packet
+    trace.Packet = &original
+
+    t := &iptablesTracer{rules: rules, ipsets: ipsets, packet: packet, trace: trace}
+
+    t.local, t.routes, err = s.traceRouting(basedir, packet.ipv6())
+    if err != nil {
+        return nil, err
+    }
+
+    trace.Verdict, err = t.run()
+    if err != nil {
+        return nil, err
+    }
+
+    return trace, nil
+}
+
+// traceRouting returns the addresses of this host (as it is, and with the vips in apply.d), and the routes in apply.d
+// along with the connected subnets
+func (s *FirewallManager) traceRouting(basedir string, ipv6 bool) ([]net.IP, *RoutesState, error) {
+    local := []net.IP{}
+
+    addresses, err := buildIpMap(s.runtime)
+    if err != nil {
+        log.Printf("trace: Unable to read the host's addresses: %v", err)
+    } else {
+        for _, address := range addresses.Ips {
+            local = append(local, address.Ip)
+        }
+    }
+
+    vips, err := s.runtime.Vips.readDesired(basedir + "/vips")
+    if err != nil {
+        return nil, nil, err
+    }
+    for _, vip := range vips {
+        ip, err := parseIp(vip.Ip)
+        if err == nil && ip != nil {
+            local = append(local, ip)
+        }
+    }
+
+    routes4, routes6, err := s.runtime.desiredRoutes(basedir)
+    if err != nil {
+        return nil, nil, err
+    }
+    s.runtime.addConnectedRoutes(routes4, routes6)
+
+    if ipv6 {
+        return local, routes6, nil
+    }
+    return local, routes4, nil
+}
+
+func (s *FirewallTrace) Describe() string {
+    var buffer bytes.Buffer
+
+    buffer.WriteString("Packet: " + s.Packet.String() + " (" + s.Path + ")\n")
+
+    for _, step := range s.Steps {
+        key := step.Table + "/" + step.Chain
+        if step.Number != 0 {
+            key += " " + strconv.Itoa(step.Number)
+        }
+
+        line := "  " + key + ": " + step.Text
+        if step.Rule != nil && step.Rule.location() != "" {
+            line += "  (" + step.Rule.location() + ")"
+        }
+        buffer.WriteString(line + "\n")
+    }
+
+    buffer.WriteString("Verdict: " + s.Verdict + "\n")
+
+    return buffer.String()
+}
+
+// TraceFirewall evaluates the packet against the firewall declared in basedir
+func (s *Runtime) TraceFirewall(basedir string, packet *TracePacket) (*FirewallTrace, error) {
+    return s.Firewall.trace(basedir, packet)
+}
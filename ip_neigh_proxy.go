@@ -1,9 +1,9 @@
 package applyd
 
 import (
-    "fmt"
     "github.com/fathomdb/gommons"
     "log"
+    "os"
     "os/exec"
     "sort"
     "strings"
@@ -82,7 +82,7 @@ func (a *IpNeighborProxyState) matches(b *IpNeighborProxyState) bool {
 func (s *IpNeighborProxyManager) parse(spec string) (*IpNeighborProxyState, error) {
     state := &IpNeighborProxyState{}
 
-    for _, line := range strings.Split(spec, "\n") {
+    for i, line := range strings.Split(spec, "\n") {
         if line == "" {
             continue
         }
@@ -117,20 +117,20 @@ func (s *IpNeighborProxyManager) parse(spec string) (*IpNeighborProxyState, erro
                 fields = fields[1:]
             } else if token == "proxy" {
                 if len(fields) < 2 {
-                    return nil, fmt.Errorf("Error parsing line: %s", line)
+                    return nil, parseErrorf(i+1, "Error parsing line: %s", line)
                 }
 
                 addr = fields[1]
                 fields = fields[2:]
             } else if token == "dev" {
                 if len(fields) < 2 {
-                    return nil, fmt.Errorf("Error parsing line: %s", line)
+                    return nil, parseErrorf(i+1, "Error parsing line: %s", line)
                 }
 
                 dev = fields[1]
                 fields = fields[2:]
             } else {
-                return nil, fmt.Errorf("Cannot parse line %s", line)
+                return nil, parseErrorf(i+1, "Cannot parse line %s", line)
             }
         }
 
@@ -147,13 +147,13 @@ func (s *IpNeighborProxyManager) parse(spec string) (*IpNeighborProxyState, erro
     return state, nil
 }
 
-func (s *IpNeighborProxy) apply() (err error) {
+func (s *IpNeighborProxy) apply(runtime *Runtime) (err error) {
     cmd := exec.Command("/sbin/ip", "-6", "neigh", "add", "proxy", s.Address)
     if s.Device != "" {
         cmd.Args = append(cmd.Args, "dev", s.Device)
     }
 
-    _, err = Execute(cmd)
+    _, err = Execute(cmd, runtime.retryPolicy())
     if err != nil {
         return err
     }
@@ -169,43 +169,108 @@ func (s *IpNeighborProxyManager) readFile(path string) (*IpNeighborProxyState, e
 
     state, err := s.parse(text)
     if err != nil {
-        return nil, err
+        return nil, fileError(path, 0, err)
     }
 
     return state, nil
 }
 
-func (s *IpNeighborProxyState) apply() (err error) {
-    for _, proxy := range s.IpNeighborProxies {
-        err = proxy.apply()
-        if err != nil {
-            return err
+func showNeighborProxies(runtime *Runtime) (*IpNeighborProxyState, error) {
+    cmd := exec.Command("/sbin/ip", "-6", "neigh", "show", "proxy")
+
+    output, err := runtime.query("ip6neigh", cmd)
+    if err != nil {
+        return nil, err
+    }
+
+    state := &IpNeighborProxyState{}
+
+    for _, line := range strings.Split(string(output), "\n") {
+        fields := strings.Fields(line)
+        if len(fields) == 0 {
+            continue
         }
+
+        // Format is: <addr> dev <dev> proxy
+        proxy := &IpNeighborProxy{}
+        proxy.Address = fields[0]
+
+        i := indexOf(fields, "dev")
+        if i != -1 && (i+1) < len(fields) {
+            proxy.Device = fields[i+1]
+        }
+
+        state.IpNeighborProxies = append(state.IpNeighborProxies, proxy)
     }
 
+    state.normalize()
+
+    return state, nil
+}
+
+func (s *IpNeighborProxy) buildConf() string {
+    conf := "ip -6 neigh add proxy " + s.Address
+    if s.Device != "" {
+        conf = conf + " dev " + s.Device
+    }
+    return conf
+}
+
+func (s *IpNeighborProxyState) find(proxy *IpNeighborProxy) *IpNeighborProxy {
+    for _, p := range s.IpNeighborProxies {
+        if p.matches(proxy) {
+            return p
+        }
+    }
     return nil
 }
 
-func (s *IpNeighborProxyManager) apply(state *IpNeighborProxyState, basedir string) error {
+func (s *IpNeighborProxyManager) plan(state *IpNeighborProxyState, basedir string) (*Plan, error) {
     files, err := gommons.ListDirectoryNames(basedir)
     if err != nil {
-        log.Printf("ipset: Error listing files in dir %s: %v", basedir, err)
-        return err
+        log.Printf("ip neigh: Error listing files in dir %s: %v", basedir, err)
+        return nil, err
     }
 
+    plan := &Plan{}
+
     for _, file := range files {
         path := basedir + "/" + file
 
-        state, err := s.readFile(path)
+        fileState, err := s.readFile(path)
         if err != nil {
-            return err
+            return nil, err
+        }
+
+        for _, proxy := range fileState.IpNeighborProxies {
+            if state.find(proxy) != nil {
+                continue
+            }
+
+            change := &Change{}
+            change.Manager = "ip6neigh"
+            change.Key = proxy.Address
+            change.Action = ActionAdd
+            change.Desired = proxy.buildConf()
+
+            plan.add(change)
+
+            p := proxy
+            plan.addAction(func() error {
+                log.Printf("ip neigh: Adding %s from %s", p.Address, path)
+                return p.apply(s.runtime)
+            })
         }
+    }
+
+    return plan, nil
+}
 
-        // Configuration needs to be applied
-        // There's no way to find out the current config!
-        log.Printf("ip neigh: Applying %s", file)
+func (s *IpNeighborProxyManager) createFiles(state *IpNeighborProxyState, basedir string) error {
+    for _, proxy := range state.IpNeighborProxies {
+        path := basedir + "/" + proxy.Address
 
-        err = state.apply()
+        err := writeTextFile(path, proxy.buildConf()+"\n")
         if err != nil {
             return err
         }
@@ -214,26 +279,49 @@ func (s *IpNeighborProxyManager) apply(state *IpNeighborProxyState, basedir stri
     return nil
 }
 
-func (s *IpNeighborProxyManager) Apply(basedir string) (err error) {
-    isdir, err := gommons.IsDirectory(basedir)
+func (s *IpNeighborProxyManager) Save(basedir string) (err error) {
+    state, err := showNeighborProxies(s.runtime)
+    if err != nil {
+        return err
+    }
+
+    err = os.MkdirAll(basedir, 0700)
     if err != nil {
         return err
     }
 
+    err = s.createFiles(state, basedir)
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
+
+func (s *IpNeighborProxyManager) Plan(basedir string) (*Plan, error) {
+    isdir, err := gommons.IsDirectory(basedir)
+    if err != nil {
+        return nil, err
+    }
+
     if !isdir {
         log.Printf("ip6neigh: Directory not found; skipping %s", basedir)
-        return nil
+        return &Plan{}, nil
+    }
+
+    current, err := showNeighborProxies(s.runtime)
+    if err != nil {
+        return nil, err
     }
 
-    //	ipsetState, err := ipsetSave(nil)
-    //	if err != nil {
-    //		return err
-    //	}
+    return s.plan(current, basedir)
+}
 
-    err = s.apply(nil, basedir)
+func (s *IpNeighborProxyManager) Apply(basedir string) (err error) {
+    plan, err := s.Plan(basedir)
     if err != nil {
         return err
     }
 
-    return nil
+    return plan.Apply()
 }
@@ -0,0 +1,115 @@
+package applyd
+
+import (
+    "bytes"
+    "fmt"
+    "log"
+)
+
+const (
+    ActionAdd    = "add"
+    ActionChange = "change"
+    ActionRemove = "remove"
+)
+
+// A Change is a single object whose kernel state differs from apply.d
+type Change struct {
+    Manager string
+    Key     string
+    Action  string
+    Current string
+    Desired string
+}
+
+// A Plan is the set of changes a manager would make, along with the actions that make them.
+// Building a plan only reads state; nothing is changed until Apply is called.
+// Preflight checks all run before any action, so a failing check aborts the whole plan.
+// A preflight that has to change the kernel registers a cleanup, which undoes it if a check fails.
+type Plan struct {
+    Changes    []*Change
+    preflights []func() error
+    cleanups   []func() error
+    actions    []func() error
+}
+
+func (s *Change) String() string {
+    return s.Manager + ": " + s.Action + " " + s.Key
+}
+
+func (s *Plan) add(change *Change) {
+    s.Changes = append(s.Changes, change)
+}
+
+func (s *Plan) addAction(action func() error) {
+    s.actions = append(s.actions, action)
+}
+
+func (s *Plan) addPreflight(preflight func() error) {
+    s.preflights = append(s.preflights, preflight)
+}
+
+func (s *Plan) addCleanup(cleanup func() error) {
+    s.cleanups = append(s.cleanups, cleanup)
+}
+
+func (s *Plan) merge(o *Plan) {
+    s.Changes = append(s.Changes, o.Changes...)
+    s.preflights = append(s.preflights, o.preflights...)
+    s.cleanups = append(s.cleanups, o.cleanups...)
+    s.actions = append(s.actions, o.actions...)
+}
+
+func (s *Plan) IsEmpty() bool {
+    return len(s.Changes) == 0
+}
+
+func (s *Plan) Apply() (err error) {
+    for _, preflight := range s.preflights {
+        err = preflight()
+        if err != nil {
+            s.cleanup()
+            return err
+        }
+    }
+
+    for _, action := range s.actions {
+        err = action()
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// cleanup undoes what the preflights changed, latest first
+func (s *Plan) cleanup() {
+    for i := len(s.cleanups) - 1; i >= 0; i-- {
+        err := s.cleanups[i]()
+        if err != nil {
+            log.Printf("plan: Cleanup after failed preflight: %v", err)
+        }
+    }
+}
+
+func (s *Plan) Describe() string {
+    var buffer bytes.Buffer
+
+    for _, change := range s.Changes {
+        buffer.WriteString(change.String() + "\n")
+        if change.Current != "" {
+            buffer.WriteString(indentLines("- ", change.Current))
+        }
+        if change.Desired != "" {
+            buffer.WriteString(indentLines("+ ", change.Desired))
+        }
+    }
+
+    if len(s.Changes) == 0 {
+        buffer.WriteString("No changes\n")
+    } else {
+        buffer.WriteString(fmt.Sprintf("%d changes\n", len(s.Changes)))
+    }
+
+    return buffer.String()
+}
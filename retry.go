@@ -0,0 +1,110 @@
+package applyd
+
+import (
+    "bytes"
+    "fmt"
+    "strings"
+    "time"
+)
+
+// A command can fail because something else holds a resource for a moment (the xtables lock, most often),
+// and failing the whole run for that is worse than waiting.  A RetryPolicy says which failures are worth
+// another attempt, and how long to wait; the retries are recorded in the RunReport.
+
+// Exit code of the iptables tools for a resource problem, including the xtables lock
+const xtablesResourceProblem = 4
+
+type RetryPolicy struct {
+    Attempts int
+    // The wait before the second attempt; it doubles for each attempt after, up to MaxBackoff
+    Backoff    time.Duration
+    MaxBackoff time.Duration
+
+    // A failure is retryable if it exits with one of these codes, or its output contains one of these patterns
+    ExitCodes []int
+    Patterns  []string
+
+    // Where retries are recorded, if not nil
+    Report *RunReport
+}
+
+var defaultRetryPatterns = []string{
+    "xtables lock",
+    "Resource temporarily unavailable",
+    "Device or resource busy",
+}
+
+func (s *RetryPolicy) retryable(exitCode int, output string) bool {
+    for _, code := range s.ExitCodes {
+        if code == exitCode {
+            return true
+        }
+    }
+
+    for _, pattern := range s.Patterns {
+        if strings.Contains(output, pattern) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// delay returns the wait after the given (failed) attempt
+func (s *RetryPolicy) delay(attempt int) time.Duration {
+    delay := s.Backoff
+    for i := 1; i < attempt; i++ {
+        delay *= 2
+        if s.MaxBackoff != 0 && delay >= s.MaxBackoff {
+            return s.MaxBackoff
+        }
+    }
+    return delay
+}
+
+// retryPolicy returns the policy from the host configuration
+func (s *Runtime) retryPolicy() *RetryPolicy {
+    policy := &RetryPolicy{}
+    policy.Attempts = s.Config.CommandAttempts
+    policy.Backoff = s.Config.CommandBackoff
+    policy.MaxBackoff = 30 * time.Second
+    policy.ExitCodes = s.Config.CommandRetryExitCodes
+    policy.Patterns = defaultRetryPatterns
+    policy.Report = s.Report
+    return policy
+}
+
+type RetryRecord struct {
+    Time    time.Time
+    Command string
+    Attempt int
+    Delay   time.Duration
+    Error   string
+}
+
+// A RunReport records what happened during a run, beyond the changes in the plan
+type RunReport struct {
+    Retries []*RetryRecord
+}
+
+func (s *RunReport) addRetry(record *RetryRecord) {
+    s.Retries = append(s.Retries, record)
+}
+
+func (s *RunReport) IsEmpty() bool {
+    return len(s.Retries) == 0
+}
+
+func (s *RunReport) Describe() string {
+    var buffer bytes.Buffer
+
+    for _, retry := range s.Retries {
+        buffer.WriteString(fmt.Sprintf("retry: %s failed (attempt %d), retried after %s: %s\n", retry.Command, retry.Attempt, retry.Delay, retry.Error))
+    }
+
+    if len(s.Retries) != 0 {
+        buffer.WriteString(fmt.Sprintf("%d retries\n", len(s.Retries)))
+    }
+
+    return buffer.String()
+}
@@ -4,11 +4,15 @@ import (
     "fmt"
     "github.com/fathomdb/gommons"
     "log"
+    "net"
+    "os"
     "os/exec"
     "strings"
 )
 
 type RoutesManager struct {
+    runtime *Runtime
+
     Ipv6 bool
 }
 
@@ -27,10 +31,13 @@ type Route struct {
     Via       string
     Scope     string
     Device    string
+    Pref      string
+    Onlink    bool
 }
 
 func NewRoutesManager(runtime *Runtime, ipv6 bool) *RoutesManager {
     p := &RoutesManager{}
+    p.runtime = runtime
     p.Ipv6 = ipv6
     return p
 }
@@ -107,6 +114,28 @@ func parseRoute(line string) (r *Route, err error) {
             } else {
                 return nil, fmt.Errorf("Error parsing route spec (src): %s", line)
             }
+        } else if f == "pref" {
+            if (i + 1) < len(fields) {
+                r.Pref = fields[i+1]
+                if r.Pref == "medium" {
+                    // The default
+                    r.Pref = ""
+                }
+                i++
+            } else {
+                return nil, fmt.Errorf("Error parsing route spec (pref): %s", line)
+            }
+        } else if f == "expires" {
+            if (i + 1) < len(fields) {
+                // Ignore; learned routes only
+                i++
+            } else {
+                return nil, fmt.Errorf("Error parsing route spec (expires): %s", line)
+            }
+        } else if f == "onlink" {
+            r.Onlink = true
+        } else if f == "linkdown" || f == "dead" {
+            // Ignore; link state, not configuration
         } else {
             return nil, fmt.Errorf("Error parsing route spec (unknown key): %s in %s", f, line)
         }
@@ -125,13 +154,13 @@ func readRouteFile(path string) (route *Route, err error) {
 
     route, err = parseRoute(text)
     if err != nil {
-        return nil, err
+        return nil, fileError(path, firstLineNumber(text), err)
     }
 
     return route, nil
 }
 
-func showRoutes(ipv6 bool) (state *RoutesState, err error) {
+func showRoutes(runtime *Runtime, ipv6 bool) (state *RoutesState, err error) {
     cmd := exec.Command("/sbin/ip")
     if ipv6 {
         cmd.Args = append(cmd.Args, "-6")
@@ -139,7 +168,12 @@ func showRoutes(ipv6 bool) (state *RoutesState, err error) {
 
     cmd.Args = append(cmd.Args, "route", "show")
 
-    output, err := Execute(cmd)
+    key := "route4"
+    if ipv6 {
+        key = "route6"
+    }
+
+    output, err := runtime.query(key, cmd)
     if err != nil {
         return nil, err
     }
@@ -164,6 +198,15 @@ func showRoutes(ipv6 bool) (state *RoutesState, err error) {
     return state, nil
 }
 
+func (s *RoutesState) findByDest(dest string) *Route {
+    for _, route := range s.Routes {
+        if route.Dest == dest {
+            return route
+        }
+    }
+    return nil
+}
+
 func routeMatch(l, r *Route) bool {
     return *l == *r
 }
@@ -177,6 +220,14 @@ func (s *Route) buildArgs(ipv6 bool) []string {
 
     args = append(args, "route", "add")
 
+    args = append(args, s.buildFields()...)
+    return args
+}
+
+// buildFields returns the route in the format of a route file
+func (s *Route) buildFields() []string {
+    args := make([]string, 0)
+
     args = append(args, s.Dest)
 
     if s.Protocol != "" {
@@ -197,20 +248,30 @@ func (s *Route) buildArgs(ipv6 bool) []string {
     if s.Device != "" {
         args = append(args, "dev", s.Device)
     }
+    if s.Pref != "" {
+        args = append(args, "pref", s.Pref)
+    }
+    if s.Onlink {
+        args = append(args, "onlink")
+    }
     return args
 }
 
+func (s *Route) buildConf() string {
+    return strings.Join(s.buildFields(), " ")
+}
+
 func (s *Route) buildSpec(ipv6 bool) string {
     args := s.buildArgs(ipv6)
     key := strings.Join(args, " ")
     return key
 }
 
-func (s *Route) apply(ipv6 bool) (err error) {
+func (s *Route) apply(runtime *Runtime, ipv6 bool) (err error) {
     args := s.buildArgs(ipv6)
 
     cmd := exec.Command("/sbin/ip", args...)
-    _, err = Execute(cmd)
+    _, err = Execute(cmd, runtime.retryPolicy())
     if err != nil {
         return err
     }
@@ -218,13 +279,22 @@ func (s *Route) apply(ipv6 bool) (err error) {
     return nil
 }
 
-func (s *RoutesManager) apply(state *RoutesState, basedir string) error {
+func (s *RoutesManager) name() string {
+    if s.Ipv6 {
+        return "route6"
+    }
+    return "route4"
+}
+
+func (s *RoutesManager) plan(state *RoutesState, basedir string) (*Plan, error) {
     files, err := gommons.ListDirectoryNames(basedir)
     if err != nil {
         log.Printf("routes: Error listing files in dir %s: %v", basedir, err)
-        return err
+        return nil, err
     }
 
+    plan := &Plan{}
+
     existingRoutes := make(map[string]*Route)
 
     for _, v := range state.Routes {
@@ -237,11 +307,17 @@ func (s *RoutesManager) apply(state *RoutesState, basedir string) error {
 
         fileRoute, err := readRouteFile(path)
         if err != nil {
-            return err
+            return nil, err
         }
 
         key := fileRoute.buildSpec(s.Ipv6)
 
+        change := &Change{}
+        change.Manager = s.name()
+        change.Key = filename
+        change.Action = ActionAdd
+        change.Desired = fileRoute.buildConf()
+
         existingRoute := existingRoutes[key]
         if existingRoute != nil {
             delete(existingRoutes, key)
@@ -250,16 +326,34 @@ func (s *RoutesManager) apply(state *RoutesState, basedir string) error {
                 //log.Printf("Configuration match: %s", filename)
                 continue
             } else {
-                log.Printf("Configuration mismatch: %s %s", existingRoute, fileRoute)
+                log.Printf("Configuration mismatch: %v %v", existingRoute, fileRoute)
             }
+
+            change.Action = ActionChange
+            change.Current = existingRoute.buildConf()
         } else {
             log.Printf("Adding new route: %s", key)
+
+            // Show the kernel's version of the route, if it has one that we didn't recognize
+            similar := state.findByDest(fileRoute.Dest)
+            if similar != nil {
+                change.Current = similar.buildConf()
+            }
         }
 
-        // Configuration needs to be applied
-        log.Printf("route: Applying changed configuration from disk: %s", filename)
+        plan.add(change)
+
+        plan.addAction(func() error {
+            // Configuration needs to be applied
+            log.Printf("route: Applying changed configuration from disk: %s", change.Key)
 
-        fileRoute.apply(s.Ipv6)
+            err := fileRoute.apply(s.runtime, s.Ipv6)
+            if err != nil {
+                // Not fatal; the other routes may still apply
+                log.Printf("route: Error applying %s: %v", change.Key, err)
+            }
+            return nil
+        })
     }
 
     for _, v := range existingRoutes {
@@ -267,29 +361,207 @@ func (s *RoutesManager) apply(state *RoutesState, basedir string) error {
         log.Printf("routes: Ignoring %s", v.buildSpec(s.Ipv6))
     }
 
+    return plan, nil
+}
+
+// routeFileName builds a stable file name for a route; the destination, plus the metric if set.
+// Routes that would share a name (ECMP, or the same prefix on two devices) are told apart by device, then gateway.
+func routeFileName(route *Route, distinct int) string {
+    name := strings.Replace(route.Dest, "/", "_", -1)
+    if route.Metric != "" {
+        name = name + "_metric" + route.Metric
+    }
+    if distinct >= 1 && route.Device != "" {
+        name = name + "_dev" + route.Device
+    }
+    if distinct >= 2 && route.Via != "" {
+        name = name + "_via" + strings.Replace(route.Via, "/", "_", -1)
+    }
+    return name
+}
+
+// routeFileNames names the file of each route, using the plainest name that no other route shares
+func routeFileNames(routes []*Route) (map[*Route]string, error) {
+    names := make(map[*Route]string)
+
+    for distinct := 0; distinct <= 2; distinct++ {
+        counts := make(map[string]int)
+        for _, route := range routes {
+            if names[route] == "" {
+                counts[routeFileName(route, distinct)]++
+            }
+        }
+
+        for _, route := range routes {
+            name := routeFileName(route, distinct)
+            if names[route] == "" && counts[name] == 1 {
+                names[route] = name
+            }
+        }
+    }
+
+    for _, route := range routes {
+        if names[route] == "" {
+            return nil, fmt.Errorf("Cannot give route %s a file of its own; another route has the same destination, metric, device and gateway", route.buildConf())
+        }
+    }
+
+    return names, nil
+}
+
+func (s *RoutesManager) createFiles(state *RoutesState, basedir string) error {
+    routes := []*Route{}
+    for _, route := range state.Routes {
+        if route.Protocol == "kernel" || route.Protocol == "ra" {
+            // Created by the kernel as a side effect of addresses & router advertisements
+            continue
+        }
+
+        if route.ErrorCode != "" {
+            // We can't express the route type in a route file
+            log.Printf("routes: Skipping %s", route.buildSpec(s.Ipv6))
+            continue
+        }
+
+        routes = append(routes, route)
+    }
+
+    names, err := routeFileNames(routes)
+    if err != nil {
+        return err
+    }
+
+    for _, route := range routes {
+        path := basedir + "/" + names[route]
+
+        err := writeTextFile(path, route.buildConf()+"\n")
+        if err != nil {
+            return err
+        }
+    }
+
     return nil
 }
 
-func (s *RoutesManager) Apply(basedir string) (err error) {
-    isdir, err := gommons.IsDirectory(basedir)
+func (s *RoutesManager) Save(basedir string) (err error) {
+    state, err := showRoutes(s.runtime, s.Ipv6)
     if err != nil {
         return err
     }
 
+    err = os.MkdirAll(basedir, 0700)
+    if err != nil {
+        return err
+    }
+
+    err = s.createFiles(state, basedir)
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
+
+// readDesired reads the routes declared in basedir
+func (s *RoutesManager) readDesired(basedir string) (*RoutesState, error) {
+    state := &RoutesState{}
+    state.Routes = make([]*Route, 0)
+
+    isdir, err := gommons.IsDirectory(basedir)
+    if err != nil {
+        return nil, err
+    }
+
+    if !isdir {
+        return state, nil
+    }
+
+    files, err := gommons.ListDirectoryNames(basedir)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, file := range files {
+        route, err := readRouteFile(basedir + "/" + file)
+        if err != nil {
+            return nil, err
+        }
+        state.Routes = append(state.Routes, route)
+    }
+
+    return state, nil
+}
+
+// routes returns true if some route (other than an error route) covers ip
+func (s *RoutesState) routes(ip net.IP) bool {
+    return s.lookup(ip) != nil
+}
+
+// lookup returns the most specific route to ip, or nil if there is none
+func (s *RoutesState) lookup(ip net.IP) *Route {
+    var best *Route
+    bestOnes := -1
+
+    for _, route := range s.Routes {
+        if route.ErrorCode != "" {
+            continue
+        }
+
+        if route.Dest == "default" {
+            if bestOnes < 0 {
+                best = route
+                bestOnes = 0
+            }
+            continue
+        }
+
+        dest := route.Dest
+        if !strings.Contains(dest, "/") {
+            if strings.Contains(dest, ":") {
+                dest += "/128"
+            } else {
+                dest += "/32"
+            }
+        }
+
+        _, network, err := net.ParseCIDR(dest)
+        if err != nil || !network.Contains(ip) {
+            continue
+        }
+
+        ones, _ := network.Mask.Size()
+        if ones > bestOnes {
+            best = route
+            bestOnes = ones
+        }
+    }
+    return best
+}
+
+func (s *RoutesManager) Plan(basedir string) (*Plan, error) {
+    isdir, err := gommons.IsDirectory(basedir)
+    if err != nil {
+        return nil, err
+    }
+
     if !isdir {
         log.Printf("routes: Directory not found; skipping %s", basedir)
-        return nil
+        return &Plan{}, nil
     }
 
-    current, err := showRoutes(s.Ipv6)
+    current, err := showRoutes(s.runtime, s.Ipv6)
     if err != nil {
-        return err
+        return nil, err
     }
 
-    err = s.apply(current, basedir)
+    return s.plan(current, basedir)
+}
+
+func (s *RoutesManager) Apply(basedir string) (err error) {
+    plan, err := s.Plan(basedir)
     if err != nil {
         return err
     }
 
-    return nil
+    return plan.Apply()
 }
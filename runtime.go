@@ -1,8 +1,12 @@
 package applyd
 
-import ()
+import (
+    "fmt"
+)
 
 type Runtime struct {
+    Config *Config
+
     Packages    *PackageManager
     Firewall    *FirewallManager
     IpNeighbors *IpNeighborProxyManager
@@ -10,10 +14,19 @@ type Runtime struct {
     Tunnels     *TunnelsManager
     Routes4     *RoutesManager
     Routes6     *RoutesManager
+
+    // What happened during the run, such as commands that were retried
+    Report *RunReport
+
+    // When set, kernel state is read from the snapshot rather than the host
+    snapshot *Snapshot
+    recorder *Snapshot
 }
 
 func NewRuntime() (*Runtime, error) {
     runtime := &Runtime{}
+    runtime.Config = NewConfig()
+    runtime.Report = &RunReport{}
 
     runtime.Packages = NewPackageManager(runtime)
     runtime.Firewall = NewFirewallManager(runtime)
@@ -26,3 +39,127 @@ func NewRuntime() (*Runtime, error) {
 
     return runtime, nil
 }
+
+func (s *Runtime) Save(basedir string) (err error) {
+    err = s.Firewall.Save(basedir)
+    if err != nil {
+        return err
+    }
+
+    err = s.IpNeighbors.Save(basedir + "/ip6neigh")
+    if err != nil {
+        return err
+    }
+
+    err = s.Tunnels.Save(basedir + "/tunnel")
+    if err != nil {
+        return err
+    }
+
+    err = s.Vips.Save(basedir + "/vips")
+    if err != nil {
+        return err
+    }
+
+    err = s.Routes4.Save(basedir + "/route4")
+    if err != nil {
+        return err
+    }
+
+    err = s.Routes6.Save(basedir + "/route6")
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
+
+func (s *Runtime) Plan(basedir string) (*Plan, error) {
+    plan := &Plan{}
+
+    firewall, err := s.Firewall.Plan(basedir)
+    if err != nil {
+        return nil, err
+    }
+    plan.merge(firewall)
+
+    ipNeighbors, err := s.IpNeighbors.Plan(basedir + "/ip6neigh")
+    if err != nil {
+        return nil, err
+    }
+    plan.merge(ipNeighbors)
+
+    tunnels, err := s.Tunnels.Plan(basedir + "/tunnel")
+    if err != nil {
+        return nil, err
+    }
+    plan.merge(tunnels)
+
+    vips, err := s.Vips.Plan(basedir + "/vips")
+    if err != nil {
+        return nil, err
+    }
+    plan.merge(vips)
+
+    routes4, err := s.Routes4.Plan(basedir + "/route4")
+    if err != nil {
+        return nil, err
+    }
+    plan.merge(routes4)
+
+    routes6, err := s.Routes6.Plan(basedir + "/route6")
+    if err != nil {
+        return nil, err
+    }
+    plan.merge(routes6)
+
+    return plan, nil
+}
+
+// Verify plans again after an apply; anything still in the plan did not converge
+func (s *Runtime) Verify(basedir string) (*Plan, error) {
+    plan, err := s.Plan(basedir)
+    if err != nil {
+        return nil, err
+    }
+
+    return plan, nil
+}
+
+func (s *Runtime) Apply(basedir string) (err error) {
+    if s.snapshot != nil {
+        return fmt.Errorf("Cannot apply against a snapshot")
+    }
+
+    err = s.Firewall.Apply(basedir)
+    if err != nil {
+        return err
+    }
+
+    err = s.IpNeighbors.Apply(basedir + "/ip6neigh")
+    if err != nil {
+        return err
+    }
+
+    err = s.Tunnels.Apply(basedir + "/tunnel")
+    if err != nil {
+        return err
+    }
+
+    err = s.Vips.Apply(basedir + "/vips")
+    if err != nil {
+        return err
+    }
+
+    err = s.Routes4.Apply(basedir + "/route4")
+    if err != nil {
+        return err
+    }
+
+    err = s.Routes6.Apply(basedir + "/route6")
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
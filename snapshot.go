@@ -0,0 +1,167 @@
+package applyd
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "os/exec"
+    "time"
+)
+
+// A Snapshot is the output of every command applyd uses to read kernel state.
+// Planning against a snapshot needs neither root nor the host it was captured on.
+// Outputs are keyed by what was read (e.g. "iptables-save"), not by the command line, so that changing the
+// flags or path of a command doesn't orphan the snapshots already taken.
+type Snapshot struct {
+    Hostname string
+    Captured time.Time
+    Outputs  map[string]string
+}
+
+// query runs a command that reads kernel state, or takes its output from the snapshot if we have one.
+// key names what the command reads.
+func (s *Runtime) query(key string, cmd *exec.Cmd) ([]byte, error) {
+    if s.snapshot != nil {
+        output, found := s.snapshot.Outputs[key]
+        if !found {
+            return nil, fmt.Errorf("Not captured in snapshot: %s", key)
+        }
+        return []byte(output), nil
+    }
+
+    output, err := Execute(cmd, s.retryPolicy())
+    if err != nil {
+        return nil, err
+    }
+
+    if s.recorder != nil {
+        s.recorder.Outputs[key] = string(output)
+    }
+
+    return output, nil
+}
+
+func (s *Runtime) UseSnapshot(snapshot *Snapshot) {
+    s.snapshot = snapshot
+}
+
+func (s *Runtime) CaptureSnapshot() (*Snapshot, error) {
+    if s.snapshot != nil {
+        return nil, fmt.Errorf("Cannot capture a snapshot from a snapshot")
+    }
+
+    snapshot := &Snapshot{}
+    snapshot.Captured = time.Now().UTC()
+    snapshot.Outputs = make(map[string]string)
+
+    hostname, err := os.Hostname()
+    if err != nil {
+        return nil, err
+    }
+    snapshot.Hostname = hostname
+
+    s.recorder = snapshot
+    defer func() {
+        s.recorder = nil
+    }()
+
+    // Detect again, so that the outputs detection reads are captured too
+    s.Firewall.iptablesBackend = nil
+    s.Firewall.ebtables.variant = ""
+    s.Firewall.arptables.variant = ""
+
+    // Not every host has every tool, so we capture what we can
+    captures := map[string]func() error{
+        "iptables": func() error {
+            _, err := iptablesSave(s, false)
+            return err
+        },
+        "ip6tables": func() error {
+            _, err := iptablesSave(s, true)
+            return err
+        },
+        "ipset": func() error {
+            _, err := ipsetSave(s, nil)
+            return err
+        },
+        "ebtables": func() error {
+            s.Firewall.ebtables.usesNft()
+            _, err := l2tablesSave(s, s.Firewall.ebtables)
+            return err
+        },
+        "arptables": func() error {
+            s.Firewall.arptables.usesNft()
+            _, err := l2tablesSave(s, s.Firewall.arptables)
+            return err
+        },
+        "nftables": func() error {
+            _, err := nftablesList(s)
+            if err != nil {
+                return err
+            }
+
+            // Save uses the text form
+            _, err = s.query("nft-ruleset", exec.Command("/usr/sbin/nft", "list", "ruleset"))
+            return err
+        },
+        "ip6neigh": func() error {
+            _, err := showNeighborProxies(s)
+            return err
+        },
+        "tunnels": func() error {
+            _, err := showTunnels(s)
+            return err
+        },
+        "addresses": func() error {
+            _, err := buildIpMap(s)
+            return err
+        },
+        "route4": func() error {
+            _, err := showRoutes(s, false)
+            return err
+        },
+        "route6": func() error {
+            _, err := showRoutes(s, true)
+            return err
+        },
+    }
+
+    for name, capture := range captures {
+        err := capture()
+        if err != nil {
+            log.Printf("snapshot: Unable to capture %s: %v", name, err)
+        }
+    }
+
+    return snapshot, nil
+}
+
+func ReadSnapshot(path string) (*Snapshot, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    snapshot := &Snapshot{}
+    err = json.Unmarshal(data, snapshot)
+    if err != nil {
+        return nil, fmt.Errorf("Error parsing snapshot %s: %v", path, err)
+    }
+
+    if snapshot.Outputs == nil {
+        snapshot.Outputs = make(map[string]string)
+    }
+
+    return snapshot, nil
+}
+
+func (s *Snapshot) Write(path string) error {
+    data, err := json.MarshalIndent(s, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    return ioutil.WriteFile(path, data, 0600)
+}
@@ -4,11 +4,13 @@ import (
     "fmt"
     "github.com/fathomdb/gommons"
     "log"
+    "os"
     "os/exec"
     "strings"
 )
 
 type TunnelsManager struct {
+    runtime *Runtime
 }
 
 type TunnelsState struct {
@@ -24,6 +26,7 @@ type Tunnel struct {
 
 func NewTunnelsManager(runtime *Runtime) *TunnelsManager {
     p := &TunnelsManager{}
+    p.runtime = runtime
     return p
 }
 
@@ -44,7 +47,7 @@ func parseTunnel(line string) (t *Tunnel, err error) {
     t.Mode = modemap[fields[0]]
 
     if t.Mode == "" {
-        return nil, fmt.Errorf("Error parsing tunnel spec (mode): %s", line)
+        return nil, fmt.Errorf("Error parsing tunnel spec (unknown mode %s): %s", fields[0], line)
     }
 
     i := 1
@@ -117,17 +120,17 @@ func readTunnelFile(name string, path string) (tunnel *Tunnel, err error) {
 
     tunnel, err = parseTunnel(text)
     if err != nil {
-        return nil, err
+        return nil, fileError(path, firstLineNumber(text), err)
     }
 
     tunnel.Name = name
     return tunnel, nil
 }
 
-func showTunnels() (state *TunnelsState, err error) {
+func showTunnels(runtime *Runtime) (state *TunnelsState, err error) {
     cmd := exec.Command("/sbin/ip", "-6", "tunnel", "show")
 
-    output, err := Execute(cmd)
+    output, err := runtime.query("tunnels", cmd)
     if err != nil {
         return nil, err
     }
@@ -177,7 +180,19 @@ func tunnelMatch(l, r *Tunnel) bool {
     return true
 }
 
-func (s *Tunnel) apply() (err error) {
+// buildConf returns the tunnel in the format of a tunnel file
+func (s *Tunnel) buildConf() string {
+    conf := s.Mode
+    if s.Local != "" {
+        conf = conf + " local " + s.Local
+    }
+    if s.Remote != "" {
+        conf = conf + " remote " + s.Remote
+    }
+    return conf
+}
+
+func (s *Tunnel) apply(runtime *Runtime) (err error) {
     log.Printf("tunnel: Creating %s", s.Name)
 
     cmd := exec.Command("/sbin/ip", "-6", "tunnel", "add", s.Name)
@@ -191,7 +206,7 @@ func (s *Tunnel) apply() (err error) {
         cmd.Args = append(cmd.Args, "remote", s.Remote)
     }
 
-    _, err = Execute(cmd)
+    _, err = Execute(cmd, runtime.retryPolicy())
     if err != nil {
         return err
     }
@@ -199,12 +214,12 @@ func (s *Tunnel) apply() (err error) {
     return nil
 }
 
-func (s *Tunnel) ipLinkUp() (err error) {
+func (s *Tunnel) ipLinkUp(runtime *Runtime) (err error) {
     log.Printf("tunnel: bringing link up %s", s.Name)
 
     cmd := exec.Command("/sbin/ip", "-6", "link", "set", s.Name, "up")
 
-    _, err = Execute(cmd)
+    _, err = Execute(cmd, runtime.retryPolicy())
     if err != nil {
         return err
     }
@@ -212,13 +227,15 @@ func (s *Tunnel) ipLinkUp() (err error) {
     return nil
 }
 
-func (s *TunnelsManager) apply(state *TunnelsState, basedir string) error {
+func (s *TunnelsManager) plan(state *TunnelsState, basedir string) (*Plan, error) {
     files, err := gommons.ListDirectoryNames(basedir)
     if err != nil {
         log.Printf("tunnel: Error listing files in dir %s: %v", basedir, err)
-        return err
+        return nil, err
     }
 
+    plan := &Plan{}
+
     existingTunnels := make(map[string]*Tunnel)
 
     for k, v := range state.Tunnels {
@@ -230,9 +247,15 @@ func (s *TunnelsManager) apply(state *TunnelsState, basedir string) error {
 
         fileTunnel, err := readTunnelFile(key, path)
         if err != nil {
-            return err
+            return nil, err
         }
 
+        change := &Change{}
+        change.Manager = "tunnel"
+        change.Key = key
+        change.Action = ActionAdd
+        change.Desired = fileTunnel.buildConf()
+
         existingTunnel := existingTunnels[key]
         if existingTunnel != nil {
             delete(existingTunnels, key)
@@ -241,49 +264,94 @@ func (s *TunnelsManager) apply(state *TunnelsState, basedir string) error {
                 log.Printf("Configuration match: %s", key)
                 continue
             }
+
+            change.Action = ActionChange
+            change.Current = existingTunnel.buildConf()
         }
 
-        // Configuration needs to be applied
-        log.Printf("tunnel: Applying changed configuration from disk: %s", key)
+        plan.add(change)
 
-        err = fileTunnel.apply()
-        if err != nil {
-            return err
+        plan.addAction(func() error {
+            // Configuration needs to be applied
+            log.Printf("tunnel: Applying changed configuration from disk: %s", fileTunnel.Name)
+
+            err := fileTunnel.apply(s.runtime)
+            if err != nil {
+                return err
+            }
+            return fileTunnel.ipLinkUp(s.runtime)
+        })
+    }
+
+    for k, _ := range existingTunnels {
+        // Configured in kernel, not on disk
+        log.Printf("tunnel: Ignoring %s", k)
+    }
+
+    return plan, nil
+}
+
+func (s *TunnelsManager) createFiles(state *TunnelsState, basedir string) error {
+    for name, tunnel := range state.Tunnels {
+        if name == "ip6tnl0" {
+            // The fallback device, created by the kernel module
+            continue
         }
-        err = fileTunnel.ipLinkUp()
+
+        path := basedir + "/" + name
+
+        err := writeTextFile(path, tunnel.buildConf()+"\n")
         if err != nil {
             return err
         }
     }
 
-    for k, _ := range existingTunnels {
-        // Configured in kernel, not on disk
-        log.Printf("tunnel: Ignoring %s", k)
+    return nil
+}
+
+func (s *TunnelsManager) Save(basedir string) (err error) {
+    state, err := showTunnels(s.runtime)
+    if err != nil {
+        return err
+    }
+
+    err = os.MkdirAll(basedir, 0700)
+    if err != nil {
+        return err
+    }
+
+    err = s.createFiles(state, basedir)
+    if err != nil {
+        return err
     }
 
     return nil
 }
 
-func (s *TunnelsManager) Apply(basedir string) (err error) {
+func (s *TunnelsManager) Plan(basedir string) (*Plan, error) {
     isdir, err := gommons.IsDirectory(basedir)
     if err != nil {
-        return err
+        return nil, err
     }
 
     if !isdir {
         log.Printf("tunnels: Directory not found; skipping %s", basedir)
-        return nil
+        return &Plan{}, nil
     }
 
-    current, err := showTunnels()
+    current, err := showTunnels(s.runtime)
     if err != nil {
-        return err
+        return nil, err
     }
 
-    err = s.apply(current, basedir)
+    return s.plan(current, basedir)
+}
+
+func (s *TunnelsManager) Apply(basedir string) (err error) {
+    plan, err := s.Plan(basedir)
     if err != nil {
         return err
     }
 
-    return nil
+    return plan.Apply()
 }
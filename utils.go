@@ -1,18 +1,131 @@
 package applyd
 
 import (
+    "bytes"
     "fmt"
+    "github.com/fathomdb/gommons"
+    "io/ioutil"
     "log"
     "os/exec"
+    "strings"
+    "time"
 )
 
-func Execute(cmd *exec.Cmd) (output []byte, err error) {
-    output, err = cmd.CombinedOutput()
+type ParseError struct {
+    Path    string
+    Line    int
+    Message string
+}
+
+func (e *ParseError) Error() string {
+    location := e.Path
+    if e.Line != 0 {
+        location = fmt.Sprintf("%s:%d", location, e.Line)
+    }
+    if location == "" {
+        return e.Message
+    }
+    return location + ": " + e.Message
+}
+
+func parseErrorf(line int, format string, args ...interface{}) error {
+    return &ParseError{Line: line, Message: fmt.Sprintf(format, args...)}
+}
+
+// fileError attaches the file (and line, if the parser didn't know it) to a parse error
+func fileError(path string, line int, err error) error {
+    e := &ParseError{Path: path, Line: line, Message: err.Error()}
+    if pe, ok := err.(*ParseError); ok {
+        e.Message = pe.Message
+        if pe.Line != 0 {
+            e.Line = pe.Line
+        }
+    }
+    return e
+}
+
+func firstLineNumber(text string) int {
+    for i, line := range strings.Split(text, "\n") {
+        if strings.TrimSpace(line) != "" {
+            return i + 1
+        }
+    }
+    return 0
+}
+
+// Execute runs the command, trying again if it fails in a way the policy says is retryable.
+// A nil policy means a single attempt.  The output of the last attempt is returned even if it failed.
+func Execute(cmd *exec.Cmd, policy *RetryPolicy) (output []byte, err error) {
+    // Each attempt needs its own stdin
+    var stdin []byte
+    if cmd.Stdin != nil && policy != nil && policy.Attempts > 1 {
+        stdin, err = ioutil.ReadAll(cmd.Stdin)
+        if err != nil {
+            return nil, err
+        }
+        cmd.Stdin = bytes.NewReader(stdin)
+    }
+
+    for attempt := 1; ; attempt++ {
+        output, err = cmd.CombinedOutput()
+        if err == nil {
+            return output, nil
+        }
+
+        exitCode := -1
+        if exitErr, ok := err.(*exec.ExitError); ok {
+            exitCode = exitErr.ExitCode()
+        }
+
+        if policy == nil || attempt >= policy.Attempts || !policy.retryable(exitCode, string(output)) {
+            log.Printf("Failed %s", cmd)
+            log.Printf("Output: %s", output)
+
+            return output, fmt.Errorf("Error running %s: %s", cmd, err)
+        }
+
+        delay := policy.delay(attempt)
+        message := strings.TrimSpace(string(output))
+        if message == "" {
+            message = err.Error()
+        }
+
+        log.Printf("Retrying %s in %s (attempt %d of %d failed): %s", cmd, delay, attempt, policy.Attempts, message)
+        if policy.Report != nil {
+            policy.Report.addRetry(&RetryRecord{Time: time.Now().UTC(), Command: cmd.String(), Attempt: attempt, Delay: delay, Error: message})
+        }
+
+        time.Sleep(delay)
+
+        next := exec.Command(cmd.Path)
+        next.Args = cmd.Args
+        next.Env = cmd.Env
+        next.Dir = cmd.Dir
+        if stdin != nil {
+            next.Stdin = bytes.NewReader(stdin)
+        }
+        cmd = next
+    }
+}
+
+func indentLines(prefix string, text string) string {
+    var lines []string
+    for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+        lines = append(lines, prefix+line)
+    }
+    return strings.Join(lines, "\n") + "\n"
+}
+
+// writeTextFile writes the file, unless it already has the given contents
+func writeTextFile(path string, text string) error {
+    f, err := gommons.TryReadTextFile(path, "")
     if err != nil {
-        log.Printf("Failed %s", cmd)
-        log.Printf("Output: %s", output)
+        return err
+    }
 
-        return nil, fmt.Errorf("Error running %s: %s", cmd, err)
+    if f == text {
+        return nil
     }
-    return output, nil
+
+    return ioutil.WriteFile(path, []byte(text), 0700)
 }
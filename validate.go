@@ -0,0 +1,529 @@
+package applyd
+
+import (
+    "fmt"
+    "github.com/fathomdb/gommons"
+    "strings"
+)
+
+const (
+    SeverityError   = "error"
+    SeverityWarning = "warning"
+)
+
+type Diagnostic struct {
+    Path     string
+    Line     int
+    Severity string
+    Message  string
+}
+
+func (s *Diagnostic) String() string {
+    location := s.Path
+    if s.Line != 0 {
+        location = fmt.Sprintf("%s:%d", location, s.Line)
+    }
+    return location + ": " + s.Severity + ": " + s.Message
+}
+
+type validator struct {
+    runtime     *Runtime
+    diagnostics []*Diagnostic
+
+    ipsets        map[string]bool
+    ipsetFamilies map[string]string
+}
+
+type chainDefault struct {
+    path   string
+    line   int
+    policy string
+}
+
+// Validate parses every file under basedir and checks it for semantic problems, without reading or changing kernel state
+func (s *Runtime) Validate(basedir string) ([]*Diagnostic, error) {
+    v := &validator{}
+    v.runtime = s
+    v.ipsets = make(map[string]bool)
+    v.ipsetFamilies = make(map[string]string)
+
+    // ipsets first, so that iptables rules can be checked against them
+    err := v.validateDir(basedir+"/ipset", v.validateIpset)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, ipv6 := range []bool{false, true} {
+        dir := basedir + "/iptables"
+        if ipv6 {
+            dir = basedir + "/ip6tables"
+        }
+
+        err = v.validateIptablesDir(dir, ipv6)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    for _, dir := range []string{basedir + "/ebtables", basedir + "/arptables"} {
+        err = v.validateDir(dir, v.validateL2tables)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    err = v.validateDualStackDir(basedir + "/firewall")
+    if err != nil {
+        return nil, err
+    }
+
+    v.validatePolicyDir(basedir + "/policy")
+
+    err = v.validateNatDir(basedir)
+    if err != nil {
+        return nil, err
+    }
+
+    err = v.validateDir(basedir+"/ip6neigh", v.validateIpNeighbors)
+    if err != nil {
+        return nil, err
+    }
+
+    err = v.validateDir(basedir+"/tunnel", v.validateTunnel)
+    if err != nil {
+        return nil, err
+    }
+
+    err = v.validateDir(basedir+"/vips", v.validateVip)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, ipv6 := range []bool{false, true} {
+        dir := basedir + "/route4"
+        if ipv6 {
+            dir = basedir + "/route6"
+        }
+
+        err = v.validateDir(dir, func(path string, name string, text string) {
+            v.validateRoute(path, text, ipv6)
+        })
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return v.diagnostics, nil
+}
+
+func HasErrors(diagnostics []*Diagnostic) bool {
+    for _, d := range diagnostics {
+        if d.Severity == SeverityError {
+            return true
+        }
+    }
+    return false
+}
+
+func (v *validator) report(path string, line int, severity string, format string, args ...interface{}) {
+    d := &Diagnostic{}
+    d.Path = path
+    d.Line = line
+    d.Severity = severity
+    d.Message = fmt.Sprintf(format, args...)
+
+    v.diagnostics = append(v.diagnostics, d)
+}
+
+// reportError records a parse error; line overrides the line known to the parser, if set
+func (v *validator) reportError(path string, line int, err error) {
+    pe := fileError(path, line, err).(*ParseError)
+    if line != 0 {
+        pe.Line = line
+    }
+    v.report(pe.Path, pe.Line, SeverityError, "%s", pe.Message)
+}
+
+func (v *validator) validateDir(dir string, fn func(path string, name string, text string)) error {
+    isdir, err := gommons.IsDirectory(dir)
+    if err != nil {
+        return err
+    }
+
+    if !isdir {
+        return nil
+    }
+
+    files, err := gommons.ListDirectoryNames(dir)
+    if err != nil {
+        return err
+    }
+
+    for _, file := range files {
+        path := dir + "/" + file
+
+        text, err := gommons.TryReadTextFile(path, "")
+        if err != nil {
+            return err
+        }
+
+        fn(path, file, text)
+    }
+
+    return nil
+}
+
+func familyName(ipv6 bool) string {
+    if ipv6 {
+        return "IPv6"
+    }
+    return "IPv4"
+}
+
+func validateAddress(s string, ipv6 bool) error {
+    ip, err := parseIp(s)
+    if err != nil || ip == nil {
+        return fmt.Errorf("Invalid address: %s", s)
+    }
+
+    if isIpv4(ip) == ipv6 {
+        return fmt.Errorf("Address family mismatch: %s is not %s", s, familyName(ipv6))
+    }
+
+    return nil
+}
+
+func (v *validator) validateIpset(path string, name string, text string) {
+    v.ipsets[name] = true
+
+    ipset, err := readIpsetFile(name, path)
+    if err != nil {
+        v.reportError(path, 0, err)
+        return
+    }
+
+    v.ipsetFamilies[name] = ipsetFamily(ipset.Spec)
+
+    if !strings.HasPrefix(ipset.Spec, "hash:ip") && !strings.HasPrefix(ipset.Spec, "hash:net") {
+        return
+    }
+
+    fields := strings.Fields(ipset.Spec)
+    ipv6 := indexOf(fields, "inet6") != -1
+
+    for i, line := range strings.Split(text, "\n") {
+        fields := strings.Fields(line)
+        if len(fields) < 3 || fields[0] != "add" {
+            continue
+        }
+
+        member := fields[2]
+        if strings.Contains(member, ",") {
+            // A compound member (ip,port etc)
+            member = member[:strings.Index(member, ",")]
+        }
+
+        err = validateAddress(member, ipv6)
+        if err != nil {
+            v.report(path, i+1, SeverityError, "%v", err)
+        }
+    }
+}
+
+func (v *validator) validateIptablesDir(dir string, ipv6 bool) error {
+    isdir, err := gommons.IsDirectory(dir)
+    if err != nil {
+        return err
+    }
+
+    if !isdir {
+        return nil
+    }
+
+    sources, err := listIptablesSources(dir)
+    if err != nil {
+        return err
+    }
+
+    defaults := make(map[string]*chainDefault)
+    for _, source := range sources {
+        text, err := gommons.TryReadTextFile(source.Path, "")
+        if err != nil {
+            return err
+        }
+
+        v.validateIptables(source, text, ipv6, defaults)
+    }
+
+    return nil
+}
+
+func (v *validator) validateIptables(source *iptablesSource, text string, ipv6 bool, defaults map[string]*chainDefault) {
+    path := source.Path
+
+    _, err := source.parse(ipv6, text)
+    if err != nil {
+        v.reportError(path, 0, err)
+        return
+    }
+
+    table := source.Table
+
+    for i, line := range strings.Split(text, "\n") {
+        if strings.HasPrefix(line, "*") {
+            table = line[1:]
+        } else if strings.HasPrefix(line, ":") {
+            fields := strings.Fields(line[1:])
+            policy := fields[1]
+            if policy == "-" {
+                continue
+            }
+
+            key := table + "/" + fields[0]
+
+            previous := defaults[key]
+            if previous == nil {
+                defaults[key] = &chainDefault{path, i + 1, policy}
+            } else if previous.policy == policy {
+                v.report(path, i+1, SeverityWarning, "Default for chain %s is also set at %s:%d", key, previous.path, previous.line)
+            } else {
+                v.report(path, i+1, SeverityError, "Conflicting default for chain %s: %s vs %s at %s:%d", key, policy, previous.policy, previous.path, previous.line)
+            }
+        } else if strings.HasPrefix(line, "-A ") {
+            fields := strings.Fields(line)
+
+            for j := 0; j+1 < len(fields); j++ {
+                f := fields[j]
+                value := fields[j+1]
+
+                switch f {
+                case "-s", "--source", "-d", "--destination":
+                    for _, addr := range strings.Split(value, ",") {
+                        err = validateAddress(addr, ipv6)
+                        if err != nil {
+                            v.report(path, i+1, SeverityError, "%v", err)
+                        }
+                    }
+
+                case "--match-set":
+                    if !v.ipsets[value] {
+                        v.report(path, i+1, SeverityError, "Ipset not found: %s", value)
+                    }
+                }
+            }
+        }
+    }
+}
+
+func (v *validator) validateDualStackDir(dir string) error {
+    isdir, err := gommons.IsDirectory(dir)
+    if err != nil {
+        return err
+    }
+
+    if !isdir {
+        return nil
+    }
+
+    sources, err := listIptablesSources(dir)
+    if err != nil {
+        return err
+    }
+
+    for _, source := range sources {
+        text, err := gommons.TryReadTextFile(source.Path, "")
+        if err != nil {
+            return err
+        }
+
+        v.validateDualStack(source, text)
+    }
+
+    return nil
+}
+
+func (v *validator) validateDualStack(source *iptablesSource, text string) {
+    for _, ipv6 := range []bool{false, true} {
+        compiled, err := compileDualStack(text, ipv6, v.ipsetFamilies)
+        if err != nil {
+            v.reportError(source.Path, 0, err)
+            return
+        }
+
+        _, err = source.parse(ipv6, compiled)
+        if err != nil {
+            v.reportError(source.Path, 0, err)
+            return
+        }
+    }
+}
+
+func (v *validator) validatePolicyDir(dir string) {
+    // Policy errors already carry the file they're in
+    reportError := func(err error) {
+        if pe, ok := err.(*ParseError); ok {
+            v.report(pe.Path, pe.Line, SeverityError, "%s", pe.Message)
+        } else {
+            v.report(dir, 0, SeverityError, "%v", err)
+        }
+    }
+
+    policy, err := readFirewallPolicy(dir)
+    if err != nil {
+        reportError(err)
+        return
+    }
+
+    if policy == nil {
+        return
+    }
+
+    for _, ipv6 := range []bool{false, true} {
+        _, err = policy.compile(ipv6, v.ipsetFamilies)
+        if err != nil {
+            reportError(err)
+            return
+        }
+    }
+
+    for _, rule := range policy.Rules {
+        for _, zone := range []string{rule.From, rule.To} {
+            z := policy.Zones[zone]
+            if z == nil {
+                continue
+            }
+            for _, ipset := range z.Ipsets {
+                if !v.ipsets[ipset] {
+                    v.report(rule.Source, rule.Line, SeverityError, "Zone %s references unknown ipset %s", zone, ipset)
+                }
+            }
+        }
+    }
+}
+
+func (v *validator) validateNatDir(basedir string) error {
+    nat, err := readNatDeclarations(basedir + "/nat")
+    if err != nil {
+        if pe, ok := err.(*ParseError); ok {
+            v.report(pe.Path, pe.Line, SeverityError, "%s", pe.Message)
+            return nil
+        }
+        return err
+    }
+
+    if nat == nil {
+        return nil
+    }
+
+    vips, err := v.runtime.Vips.readDesired(basedir + "/vips")
+    if err != nil {
+        return err
+    }
+
+    for _, ipv6 := range []bool{false, true} {
+        _, err = nat.compile(ipv6, vips)
+        if err != nil {
+            if pe, ok := err.(*ParseError); ok {
+                v.report(pe.Path, pe.Line, SeverityError, "%s", pe.Message)
+                return nil
+            }
+            return err
+        }
+    }
+
+    routes4, routes6, err := v.runtime.desiredRoutes(basedir)
+    if err != nil {
+        return err
+    }
+
+    // Connected subnets aren't in apply.d, so this is only a warning
+    for _, f := range nat.unroutable(routes4, routes6) {
+        v.report(f.Source, f.Line, SeverityWarning, "Forward target %s is not covered by any route in apply.d", f.Backend)
+    }
+
+    return nil
+}
+
+func (v *validator) validateL2tables(path string, name string, text string) {
+    _, err := parseL2tablesSave(text)
+    if err != nil {
+        v.reportError(path, 0, err)
+    }
+}
+
+func (v *validator) validateIpNeighbors(path string, name string, text string) {
+    // The format is line-based, so we parse line by line to report the line number
+    for i, line := range strings.Split(text, "\n") {
+        state, err := v.runtime.IpNeighbors.parse(line)
+        if err != nil {
+            v.reportError(path, i+1, err)
+            continue
+        }
+
+        for _, proxy := range state.IpNeighborProxies {
+            err = validateAddress(proxy.Address, true)
+            if err != nil {
+                v.report(path, i+1, SeverityError, "%v", err)
+            }
+        }
+    }
+}
+
+func (v *validator) validateTunnel(path string, name string, text string) {
+    line := firstLineNumber(text)
+
+    tunnel, err := parseTunnel(text)
+    if err != nil {
+        v.reportError(path, line, err)
+        return
+    }
+
+    for _, addr := range []string{tunnel.Local, tunnel.Remote} {
+        if addr == "" || addr == "any" {
+            continue
+        }
+
+        err = validateAddress(addr, true)
+        if err != nil {
+            v.report(path, line, SeverityError, "%v", err)
+        }
+    }
+}
+
+func (v *validator) validateVip(path string, name string, text string) {
+    line := firstLineNumber(text)
+
+    vip, err := readVipFile(name, path)
+    if err != nil {
+        v.reportError(path, 0, err)
+        return
+    }
+
+    ipv6 := strings.Contains(name, ":")
+
+    err = validateAddress(vip.Ip, ipv6)
+    if err != nil {
+        v.report(path, line, SeverityError, "%v", err)
+    }
+}
+
+func (v *validator) validateRoute(path string, text string, ipv6 bool) {
+    line := firstLineNumber(text)
+
+    route, err := parseRoute(text)
+    if err != nil {
+        v.reportError(path, line, err)
+        return
+    }
+
+    for _, addr := range []string{route.Dest, route.Via, route.Src} {
+        if addr == "" || addr == "default" {
+            continue
+        }
+
+        err = validateAddress(addr, ipv6)
+        if err != nil {
+            v.report(path, line, SeverityError, "%v", err)
+        }
+    }
+}
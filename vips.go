@@ -6,11 +6,13 @@ import (
     "github.com/fathomdb/gommons"
     "log"
     "net"
+    "os"
     "os/exec"
     "strings"
 )
 
 type VipsManager struct {
+    runtime *Runtime
 }
 
 type VipsState struct {
@@ -28,11 +30,14 @@ type IpState struct {
 
 type InterfaceIp struct {
     Ip        net.IP
+    Cidr      string
     Interface string
+    Dynamic   bool
 }
 
 func NewVipsManager(runtime *Runtime) *VipsManager {
     p := &VipsManager{}
+    p.runtime = runtime
     return p
 }
 
@@ -53,10 +58,10 @@ func parseIp(s string) (ip net.IP, err error) {
     return ip, nil
 }
 
-func buildIpMap() (state *IpState, err error) {
+func buildIpMap(runtime *Runtime) (state *IpState, err error) {
     cmd := exec.Command("/bin/ip", "--oneline", "address", "show")
 
-    output, err := Execute(cmd)
+    output, err := runtime.query("addresses", cmd)
     if err != nil {
         return nil, err
     }
@@ -94,6 +99,8 @@ func buildIpMap() (state *IpState, err error) {
             return nil, err
         }
         vip.Ip = ip
+        vip.Cidr = cidr
+        vip.Dynamic = indexOf(fields, "dynamic") != -1
 
         state.Ips = append(state.Ips, vip)
     }
@@ -148,7 +155,7 @@ func buildIpMap() (state *IpState, err error) {
 //    return "", nil
 //}
 
-func addIp(dev string, ip string) (err error) {
+func addIp(runtime *Runtime, dev string, ip string) (err error) {
     log.Printf("vips: Adding %s %s", dev, ip)
 
     args := make([]string, 0)
@@ -160,7 +167,7 @@ func addIp(dev string, ip string) (err error) {
 
     cmd := exec.Command("/bin/ip", args...)
 
-    _, err = Execute(cmd)
+    _, err = Execute(cmd, runtime.retryPolicy())
     if err != nil {
         return err
     }
@@ -168,7 +175,7 @@ func addIp(dev string, ip string) (err error) {
     return nil
 }
 
-func deleteIp(dev string, ip string) (err error) {
+func deleteIp(runtime *Runtime, dev string, ip string) (err error) {
     log.Printf("vips: Deleting %s %s", dev, ip)
 
     args := make([]string, 0)
@@ -180,7 +187,7 @@ func deleteIp(dev string, ip string) (err error) {
 
     cmd := exec.Command("/bin/ip", args...)
 
-    _, err = Execute(cmd)
+    _, err = Execute(cmd, runtime.retryPolicy())
     if err != nil {
         return err
     }
@@ -215,18 +222,16 @@ func (s *IpState) hasIp(ip net.IP, device string) (found bool, err error) {
     return false, nil
 }
 
-func (s *VipsManager) applyFile(state *IpState, key string, path string) (changed bool, err error) {
-    changed = false
-
+func readVipFile(key string, path string) (vip *Vip, err error) {
     text, err := gommons.TryReadTextFile(path, "")
     if err != nil {
-        return changed, err
+        return nil, err
     }
 
     var device string
     var ipString string
 
-    for _, line := range strings.Split(text, "\n") {
+    for i, line := range strings.Split(text, "\n") {
         line = strings.TrimSpace(line)
         if line == "" {
             continue
@@ -234,7 +239,7 @@ func (s *VipsManager) applyFile(state *IpState, key string, path string) (change
 
         fields := strings.Fields(line)
         if len(fields) < 1 || len(fields) > 2 {
-            return changed, fmt.Errorf("Error parsing line: %s", line)
+            return nil, fileError(path, i+1, fmt.Errorf("Error parsing line: %s", line))
         }
 
         device = fields[0]
@@ -251,95 +256,193 @@ func (s *VipsManager) applyFile(state *IpState, key string, path string) (change
         }
     }
 
-    ip, err := parseIp(ipString)
+    vip = &Vip{}
+    vip.Ip = ipString
+    vip.Interface = device
+    return vip, nil
+}
+
+func (s *VipsManager) plan(state *IpState, basedir string) (*Plan, error) {
+    files, err := gommons.ListDirectoryNames(basedir)
     if err != nil {
-        return changed, err
+        log.Printf("Error listing files in dir %s: %v", basedir, err)
+        return nil, err
     }
 
-    if device == "" {
-        // Remove the ip
-        for {
+    plan := &Plan{}
+
+    for _, file := range files {
+        path := basedir + "/" + file
+
+        vip, err := readVipFile(file, path)
+        if err != nil {
+            return nil, err
+        }
+
+        ip, err := parseIp(vip.Ip)
+        if err != nil {
+            return nil, err
+        }
+
+        if vip.Interface == "" {
+            // Remove the ip
             devices, err := state.findDevicesWithIp(ip)
             if err != nil {
-                return changed, err
+                return nil, err
             }
 
             for _, device := range devices {
-                err = deleteIp(device, ipString)
-                if err != nil {
-                    return changed, err
-                }
+                change := &Change{}
+                change.Manager = "vips"
+                change.Key = file
+                change.Action = ActionRemove
+                change.Current = device + " " + vip.Ip
+
+                plan.add(change)
+
+                dev := device
+                plan.addAction(func() error {
+                    return deleteIp(s.runtime, dev, vip.Ip)
+                })
+            }
+        } else {
+            // Create the ip
+            found, err := state.hasIp(ip, vip.Interface)
+            if err != nil {
+                return nil, err
+            }
+
+            if !found {
+                change := &Change{}
+                change.Manager = "vips"
+                change.Key = file
+                change.Action = ActionAdd
+                change.Desired = vip.Interface + " " + vip.Ip
+
+                plan.add(change)
+
+                plan.addAction(func() error {
+                    return addIp(s.runtime, vip.Interface, vip.Ip)
+                })
             }
-            changed = true
         }
-    } else {
-        // Create the ip
-        found, err := state.hasIp(ip, device)
-        if err != nil {
-            return changed, err
+    }
+
+    return plan, nil
+}
+
+func (s *VipsManager) createFiles(state *IpState, basedir string) error {
+    saved := make(map[string]bool)
+
+    for _, vip := range state.Ips {
+        if vip.Ip.IsLoopback() || vip.Ip.IsLinkLocalUnicast() {
+            // Assigned automatically
+            continue
         }
 
-        if !found {
-            err = addIp(device, ipString)
-            if err != nil {
-                return changed, err
-            }
-            changed = true
+        if vip.Dynamic {
+            // Assigned by DHCP or SLAAC
+            continue
+        }
+
+        key := vip.Ip.String()
+        if saved[key] {
+            log.Printf("vips: Skipping duplicate %s on %s", key, vip.Interface)
+            continue
+        }
+        saved[key] = true
+
+        path := basedir + "/" + key
+
+        err := writeTextFile(path, vip.Interface+" "+vip.Cidr+"\n")
+        if err != nil {
+            return err
         }
     }
 
-    return changed, err
+    return nil
 }
 
-func (s *VipsManager) apply(basedir string) error {
-    files, err := gommons.ListDirectoryNames(basedir)
+func (s *VipsManager) Save(basedir string) (err error) {
+    state, err := buildIpMap(s.runtime)
     if err != nil {
-        log.Printf("Error listing files in dir %s: %v", basedir, err)
         return err
     }
 
-    var state *IpState
+    err = os.MkdirAll(basedir, 0700)
+    if err != nil {
+        return err
+    }
 
-    for _, file := range files {
-        if state == nil {
-            state, err = buildIpMap()
-            if err != nil {
-                log.Print("Unable to collect IP state: ", err)
+    err = s.createFiles(state, basedir)
+    if err != nil {
+        return err
+    }
 
-                return err
-            }
-        }
+    return nil
+}
 
-        path := basedir + "/" + file
+// readDesired reads the vips declared in basedir, keyed by address
+func (s *VipsManager) readDesired(basedir string) (map[string]*Vip, error) {
+    vips := make(map[string]*Vip)
+
+    isdir, err := gommons.IsDirectory(basedir)
+    if err != nil {
+        return nil, err
+    }
+
+    if !isdir {
+        return vips, nil
+    }
 
-        changed, err := s.applyFile(state, file, path)
+    files, err := gommons.ListDirectoryNames(basedir)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, file := range files {
+        vip, err := readVipFile(file, basedir+"/"+file)
         if err != nil {
-            return err
+            return nil, err
         }
 
-        if changed {
-            state = nil
+        ip, err := parseIp(vip.Ip)
+        if err != nil || ip == nil {
+            return nil, fmt.Errorf("Invalid address in vip %s: %s", file, vip.Ip)
         }
+
+        vips[ip.String()] = vip
     }
 
-    return nil
+    return vips, nil
 }
 
-func (s *VipsManager) Apply(basedir string) (err error) {
+func (s *VipsManager) Plan(basedir string) (*Plan, error) {
     isdir, err := gommons.IsDirectory(basedir)
     if err != nil {
-        return err
+        return nil, err
     }
 
     if !isdir {
         log.Printf("Vips: Directory not found; skipping %s", basedir)
-        return nil
+        return &Plan{}, nil
     }
 
-    err = s.apply(basedir)
+    state, err := buildIpMap(s.runtime)
+    if err != nil {
+        log.Print("Unable to collect IP state: ", err)
+
+        return nil, err
+    }
+
+    return s.plan(state, basedir)
+}
+
+func (s *VipsManager) Apply(basedir string) (err error) {
+    plan, err := s.Plan(basedir)
     if err != nil {
         return err
     }
 
-    return nil
+    return plan.Apply()
 }